@@ -3,6 +3,7 @@ package client
 import (
 	"errors"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 )
@@ -70,11 +71,16 @@ func TestCircuitBreakerRace(t *testing.T) {
 		return errors.New("test error")
 	}
 
+	// waits for the goroutines, so that they don't starve the tests after this one
+	var wg sync.WaitGroup
+	wg.Add(routines)
 	for r := 0; r < routines; r++ {
 		go func() {
+			defer wg.Done()
 			for i := 0; i < loop; i++ {
 				_ = cb.Call(fn, 100*time.Millisecond)
 			}
 		}()
 	}
+	wg.Wait()
 }
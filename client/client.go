@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
 	"github.com/derekAHua/irpc/log"
 	"github.com/derekAHua/irpc/protocol"
 	"github.com/derekAHua/irpc/share"
@@ -21,6 +22,7 @@ type RPCClient interface {
 	Go(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call
 	Call(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}) error
 	SendRaw(ctx context.Context, r *protocol.Message) (map[string]string, []byte, error)
+	NewStream(ctx context.Context, servicePath, serviceMethod string, args interface{}) (ClientStream, error)
 	Close() error
 	RemoteAddr() string
 
@@ -41,13 +43,20 @@ type (
 		Conn net.Conn
 		r    *bufio.Reader
 
+		writeCh   chan *[]byte  // frames queued for the write loop if write coalescing is enabled
+		writeDone chan struct{} // closed when the connection is down
+
 		mutex        sync.Mutex // protects following
 		seq          uint64
 		pending      map[uint64]*Call
+		streams      map[uint64]*clientStream
 		closing      bool // user has called Close
 		shutdown     bool // server has told us to stop
+		goingAway    bool // server has sent a GoAway and is draining
 		pluginClosed bool // the plugin has been called
 
+		maxMessageLength int // the max message length of the server learned in the handshake
+
 		Plugins PluginContainer
 
 		ServerMessageChan chan<- *protocol.Message
@@ -55,21 +64,27 @@ type (
 
 	// Call represents an active RPC.
 	Call struct {
-		ServicePath   string            // The name of the service and method to call
-		ServiceMethod string            // The name of the service and method to call
-		Metadata      map[string]string // metadata
-		ResMetadata   map[string]string // metadata of response
-		Args          interface{}       // The argument to the function (*struct)
-		Reply         interface{}       // The reply from the function (*struct)
-		Error         error             // After completion, the error status
-		Done          chan *Call        // Strobes when call is complete
-		Raw           bool              // raw message or not
+		ServicePath   string               // The name of the service and method to call
+		ServiceMethod string               // The name of the service and method to call
+		Metadata      map[string]string    // metadata
+		ResMetadata   map[string]string    // metadata of response
+		Extensions    []protocol.Extension // extensions, only sent if Option.ProtocolVersion is protocol.Version2 or later
+		Args          interface{}          // The argument to the function (*struct)
+		Reply         interface{}          // The reply from the function (*struct)
+		Error         error                // After completion, the error status
+		Done          chan *Call           // Strobes when call is complete
+		Raw           bool                 // raw message or not
+
+		seq           uint64
+		priority      int       // set by WithPriority or Option.Priority
+		payloadWriter io.Writer // the payload of the response is written to it if set
 	}
 )
 
 // input wait for server's messages.
 func (client *Client) input() {
 	var err error
+	chunks := protocol.Assembler{Writer: client.payloadWriter}
 
 	for err == nil {
 		res := protocol.NewMessage()
@@ -78,6 +93,13 @@ func (client *Client) input() {
 		}
 
 		err = res.Decode(client.r)
+		if err == protocol.ErrChecksumMismatch {
+			// the message has been read completely, so only its call fails.
+			chunks.Discard(res)
+			client.failCall(res.Seq(), err)
+			err = nil
+			continue
+		}
 		if err != nil {
 			break
 		}
@@ -85,6 +107,27 @@ func (client *Client) input() {
 			_ = client.Plugins.DoClientAfterDecode(res)
 		}
 
+		if res.FrameType() == protocol.FrameGoAway {
+			client.handleGoAway(res.Payload)
+			continue
+		}
+		if client.deliverStream(res) {
+			continue
+		}
+
+		if res.FrameType() == protocol.FrameChunk {
+			if e := chunks.Add(res); e != nil {
+				client.failCall(res.Seq(), e)
+			}
+			continue
+		}
+		if e := chunks.Complete(res); e != nil {
+			if e != protocol.ErrMessageDropped {
+				client.failCall(res.Seq(), e)
+			}
+			continue
+		}
+
 		seq := res.Seq()
 		var call *Call
 		isServerMessage := res.MessageType() == protocol.Request && !res.IsHeartbeat() && res.IsOneway()
@@ -112,6 +155,12 @@ func (client *Client) input() {
 			if len(res.Metadata) > 0 {
 				call.ResMetadata = res.Metadata
 				call.Error = ServiceError(res.Metadata[protocol.ServiceError])
+				if res.Metadata[protocol.ServerOverloaded] != "" {
+					call.Error = ErrServerOverloaded
+				}
+				if res.Metadata[protocol.DeadlineExceeded] != "" {
+					call.Error = context.DeadlineExceeded
+				}
 			}
 
 			if call.Raw {
@@ -128,6 +177,15 @@ func (client *Client) input() {
 		default:
 			if call.Raw {
 				call.Metadata, call.Reply, _ = convertRes2Raw(res)
+			} else if call.payloadWriter != nil {
+				if len(res.Payload) > 0 {
+					if _, e := call.payloadWriter.Write(res.Payload); e != nil {
+						call.Error = e
+					}
+				}
+				if len(res.Metadata) > 0 {
+					call.ResMetadata = res.Metadata
+				}
 			} else {
 				data := res.Payload
 				if len(data) > 0 {
@@ -188,14 +246,131 @@ func (client *Client) input() {
 		call.Error = err
 		call.done()
 	}
+	client.closeStreams(err)
 
 	client.mutex.Unlock()
 
+	if client.writeDone != nil {
+		close(client.writeDone)
+	}
+
 	if err != nil && !closing {
 		log.Errorf("irpc: client protocol error: %v", err)
 	}
 }
 
+// serveWrite is the write loop of the connection, which coalesces queued frames.
+func (client *Client) serveWrite() {
+	w := protocol.BatchWriter{
+		MaxBatchBytes: client.option.WriteBatchBytes,
+		MaxDelay:      client.option.WriteBatchDelay,
+	}
+	if err := w.Serve(client.Conn, client.writeCh, client.writeDone); err != nil && share.Trace {
+		log.Debugf("client failed to write to %s: %v", client.Conn.RemoteAddr().String(), err)
+	}
+}
+
+// write writes the encoded frame data and puts it back into the pool.
+// If write coalescing is enabled, data is queued for the write loop.
+func (client *Client) write(data *[]byte) error {
+	if client.writeCh == nil {
+		_, err := client.Conn.Write(*data)
+		protocol.PutData(data)
+		return err
+	}
+
+	select {
+	case client.writeCh <- data:
+		return nil
+	case <-client.writeDone:
+		protocol.PutData(data)
+		return ErrShutdown
+	}
+}
+
+// compressThreshold returns the payload size over which requests are compressed.
+func (client *Client) compressThreshold() int {
+	if client.option.CompressThreshold == 0 {
+		return protocol.DefaultCompressThreshold
+	}
+	return client.option.CompressThreshold
+}
+
+// payloadWriter returns the writer for the payload of the response m.
+func (client *Client) payloadWriter(m *protocol.Message) io.Writer {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	if call := client.pending[m.Seq()]; call != nil && call.payloadWriter != nil {
+		return call.payloadWriter
+	}
+	return nil
+}
+
+// failCall fails the pending call or the stream of seq with err.
+func (client *Client) failCall(seq uint64, err error) {
+	client.mutex.Lock()
+	call := client.pending[seq]
+	delete(client.pending, seq)
+	st := client.streams[seq]
+	delete(client.streams, seq)
+	client.mutex.Unlock()
+
+	if call != nil {
+		call.Error = err
+		call.done()
+	}
+	if st != nil && st.finish(err) {
+		client.sendCancel(seq)
+	}
+}
+
+// handleGoAway marks the client as closing and fails the requests the server will not handle,
+// which are those not listed in the payload of the GoAway.
+func (client *Client) handleGoAway(payload []byte) {
+	inFlight := make(map[uint64]bool, len(payload)/8)
+	for i := 0; i+8 <= len(payload); i += 8 {
+		inFlight[binary.BigEndian.Uint64(payload[i:])] = true
+	}
+
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+
+	client.closing = true
+	client.goingAway = true
+	for seq, call := range client.pending {
+		if !inFlight[seq] {
+			delete(client.pending, seq)
+			call.Error = ErrServerGoingAway
+			call.done()
+		}
+	}
+	for seq, st := range client.streams {
+		if !inFlight[seq] {
+			delete(client.streams, seq)
+			st.finish(ErrServerGoingAway)
+		}
+	}
+
+	if share.Trace {
+		log.Debugf("server %s is going away with %d requests in flight", client.Conn.RemoteAddr().String(), len(inFlight))
+	}
+}
+
+// isGoingAway returns whether the server has sent a GoAway.
+func (client *Client) isGoingAway() bool {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.goingAway
+}
+
+// pendingRequests returns the number of calls and streams waiting for the server.
+func (client *Client) pendingRequests() int {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return len(client.pending) + len(client.streams)
+}
+
 func (client *Client) handleServerRequest(msg *protocol.Message) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -283,6 +458,7 @@ func (client *Client) Close() (err error) {
 			call.done()
 		}
 	}
+	client.closeStreams(ErrShutdown)
 
 	if !client.pluginClosed {
 		if client.Plugins != nil {
@@ -294,7 +470,6 @@ func (client *Client) Close() (err error) {
 	}
 
 	if client.closing || client.shutdown {
-		client.mutex.Unlock()
 		return ErrShutdown
 	}
 
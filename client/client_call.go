@@ -5,12 +5,15 @@ import (
 	"github.com/derekAHua/irpc/log"
 	"github.com/derekAHua/irpc/protocol"
 	"github.com/derekAHua/irpc/share"
+	"io"
+	"strconv"
 	"time"
 )
 
 type seqKey struct{}
 
 // Call invokes the named function, waits for it to complete, and returns its error status.
+// If ctx is done before the call completes, the call fails with the error of ctx and the server is told to cancel it.
 func (client *Client) Call(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}) error {
 	return client.call(ctx, servicePath, serviceMethod, args, reply)
 }
@@ -30,15 +33,7 @@ func (client *Client) call(ctx context.Context, servicePath, serviceMethod strin
 
 	select {
 	case <-ctx.Done(): // cancel by context
-		client.mutex.Lock()
-		call := client.pending[*seq]
-		delete(client.pending, *seq)
-		client.mutex.Unlock()
-		if call != nil {
-			call.Error = ctx.Err()
-			call.done()
-		}
-
+		client.cancelCall(*seq, ctx.Err())
 		return ctx.Err()
 	case call := <-Done:
 		err = call.Error
@@ -56,11 +51,35 @@ func (client *Client) call(ctx context.Context, servicePath, serviceMethod strin
 	return
 }
 
+// WithPriority returns a context whose requests have priority, overriding Option.Priority.
+// Servers with a handler pool handle requests of higher priorities first, and reject requests
+// of lower priorities first when they are overloaded. Priorities out of share.MinPriority..share.MaxPriority are clamped by servers.
+func WithPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, share.ReqPriorityKey, priority)
+}
+
+// withPriority returns a copy of meta with priority for v1 servers, so that meta shared by requests is not changed.
+func withPriority(meta map[string]string, priority int) map[string]string {
+	m := copyMetadata(meta, 1)
+	m[share.Priority] = strconv.Itoa(priority)
+	return m
+}
+
+// copyMetadata returns a copy of meta with room for extra keys.
+func copyMetadata(meta map[string]string, extra int) map[string]string {
+	m := make(map[string]string, len(meta)+extra)
+	for k, v := range meta {
+		m[k] = v
+	}
+	return m
+}
+
 // Go invokes the function asynchronously.
 // It returns the Call structure representing the invocation.
 // The done channel will signal when the call is complete by returning the same Call object.
 // If done is nil, Go will allocate a new channel which have ten buffer.
 // If non-nil, done must be buffered or Go will deliberately crash.
+// Go doesn't watch ctx, so requests are only canceled on the server with ctx by Call.
 func (client *Client) Go(ctx context.Context, servicePath, serviceMethod string, args interface{}, reply interface{}, done chan *Call) *Call {
 	call := new(Call)
 	call.ServicePath = servicePath
@@ -69,6 +88,16 @@ func (client *Client) Go(ctx context.Context, servicePath, serviceMethod string,
 	if meta != nil { // copy meta in context to meta in requests
 		call.Metadata = meta.(map[string]string)
 	}
+	call.priority = client.option.Priority
+	if priority, ok := ctx.Value(share.ReqPriorityKey).(int); ok {
+		call.priority = priority
+	}
+	if exts, ok := ctx.Value(share.ReqExtensionsKey).([]protocol.Extension); ok {
+		call.Extensions = exts
+	}
+	if w, ok := ctx.Value(share.ResPayloadWriterKey).(io.Writer); ok {
+		call.payloadWriter = w
+	}
 
 	if _, ok := ctx.(*share.Context); !ok {
 		ctx = share.NewContext(ctx)
@@ -98,12 +127,46 @@ func (client *Client) Go(ctx context.Context, servicePath, serviceMethod string,
 	return call
 }
 
+// cancelCall fails the pending call of seq with err and tells the server to cancel it.
+func (client *Client) cancelCall(seq uint64, err error) {
+	client.mutex.Lock()
+	call := client.pending[seq]
+	delete(client.pending, seq)
+	client.mutex.Unlock()
+	if call == nil {
+		return
+	}
+
+	call.Error = err
+	call.done()
+	client.sendCancel(seq)
+}
+
+// sendCancel sends a FrameCancel frame for seq.
+func (client *Client) sendCancel(seq uint64) {
+	req := protocol.GetPooledMsg()
+	req.SetChecksum(client.option.Checksum)
+	req.SetMessageType(protocol.Request)
+	req.SetSeq(seq)
+	req.SetFrameType(protocol.FrameCancel)
+
+	err := client.write(req.EncodeSlicePointer())
+	protocol.FreeMsg(req)
+
+	if err != nil && share.Trace {
+		log.Debugf("client failed to cancel request %d: %v", seq, err)
+	}
+}
+
 // send a message generated by the Call structure to server.
 func (client *Client) send(ctx context.Context, call *Call) {
 	// Register this call.
 	client.mutex.Lock()
 	if client.shutdown || client.closing {
 		call.Error = ErrShutdown
+		if client.goingAway {
+			call.Error = ErrServerGoingAway
+		}
 		client.mutex.Unlock()
 		call.done()
 		return
@@ -128,6 +191,7 @@ func (client *Client) send(ctx context.Context, call *Call) {
 
 	seq := client.seq
 	client.seq++
+	call.seq = seq
 	client.pending[seq] = call
 	client.mutex.Unlock()
 
@@ -136,8 +200,17 @@ func (client *Client) send(ctx context.Context, call *Call) {
 	}
 
 	req := protocol.GetPooledMsg()
+	req.SetVersion(client.option.ProtocolVersion)
+	req.SetChecksum(client.option.Checksum)
 	req.SetMessageType(protocol.Request)
 	req.SetSeq(seq)
+	req.Extensions = append(req.Extensions, call.Extensions...)
+	// v2 requests carry the deadline of ctx in the extension block instead of metadata
+	if client.option.ProtocolVersion >= protocol.Version2 && !isHeartbeat {
+		if deadline, ok := ctx.Deadline(); ok {
+			req.SetDeadline(time.Until(deadline) - client.option.DeadlineMargin)
+		}
+	}
 	if call.Reply == nil {
 		req.SetOneway(true)
 	}
@@ -153,6 +226,13 @@ func (client *Client) send(ctx context.Context, call *Call) {
 	if call.Metadata != nil {
 		req.Metadata = call.Metadata
 	}
+	if call.priority != 0 {
+		if client.option.ProtocolVersion >= protocol.Version2 {
+			req.SetPriority(call.priority)
+		} else {
+			req.Metadata = withPriority(req.Metadata, call.priority)
+		}
+	}
 
 	req.ServicePath = call.ServicePath
 	req.ServiceMethod = call.ServiceMethod
@@ -166,7 +246,13 @@ func (client *Client) send(ctx context.Context, call *Call) {
 		call.done()
 		return
 	}
-	if len(data) > 1024 && client.option.CompressType != protocol.None {
+	if client.exceedsMaxMessageLength(len(data)) {
+		// the server would reject it after reading all of it.
+		client.failCall(seq, protocol.ErrMessageTooLong)
+		protocol.FreeMsg(req)
+		return
+	}
+	if len(data) > client.compressThreshold() && client.option.CompressType != protocol.None {
 		req.SetCompressType(client.option.CompressType)
 	}
 
@@ -180,9 +266,7 @@ func (client *Client) send(ctx context.Context, call *Call) {
 		log.Debugf("client.send for %s.%s, args: %+v in case of client call", call.ServicePath, call.ServiceMethod, call.Args)
 	}
 
-	allData := req.EncodeSlicePointer()
-	_, err = client.Conn.Write(*allData)
-	protocol.PutData(allData)
+	err = req.EncodeChunks(client.option.ChunkSize, client.write)
 
 	if share.Trace {
 		log.Debugf("client.sent for %s.%s, args: %+v in case of client call", call.ServicePath, call.ServiceMethod, call.Args)
@@ -201,9 +285,10 @@ func (client *Client) send(ctx context.Context, call *Call) {
 		return
 	}
 
+	oneway := req.IsOneway()
 	protocol.FreeMsg(req)
 
-	if req.IsOneway() {
+	if oneway {
 		client.mutex.Lock()
 		call = client.pending[seq]
 		delete(client.pending, seq)
@@ -263,9 +348,7 @@ func (client *Client) SendRaw(ctx context.Context, r *protocol.Message) (map[str
 	client.pending[seq] = call
 	client.mutex.Unlock()
 
-	data := r.EncodeSlicePointer()
-	_, err := client.Conn.Write(*data)
-	protocol.PutData(data)
+	err := client.write(r.EncodeSlicePointer())
 
 	if err != nil {
 		client.mutex.Lock()
@@ -294,15 +377,7 @@ func (client *Client) SendRaw(ctx context.Context, r *protocol.Message) (map[str
 
 	select {
 	case <-ctx.Done(): // cancel by context
-		client.mutex.Lock()
-		call := client.pending[seq]
-		delete(client.pending, seq)
-		client.mutex.Unlock()
-		if call != nil {
-			call.Error = ctx.Err()
-			call.done()
-		}
-
+		client.cancelCall(seq, ctx.Err())
 		return nil, nil, ctx.Err()
 	case call := <-done:
 		err = call.Error
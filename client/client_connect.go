@@ -15,6 +15,9 @@ import (
 	"time"
 )
 
+// WriteChanSize is the number of frames queued for the write loop if write coalescing is enabled.
+const WriteChanSize = 1024
+
 // ReaderBuffsize is used for bufio reader.
 const ReaderBuffsize = 16 * 1024
 
@@ -28,6 +31,7 @@ var ConnFactories = map[string]ConnFactoryFn{
 	"quic": newDirectQuicConn,
 	"unix": newDirectConn,
 	"memu": newMemuConn,
+	"shm":  newShmConn,
 }
 
 // Connect connects the server via specified network.
@@ -69,11 +73,24 @@ func (client *Client) Connect(network, address string) (err error) {
 		client.r = bufio.NewReaderSize(conn, ReaderBuffsize)
 		// c.w = bufio.NewWriterSize(conn, WriterBuffsize)
 
-		// start reading and writing since connected
-		go client.input()
+		if client.option.Handshake {
+			err = client.handshake()
+		}
+
+		if err != nil {
+			_ = conn.Close()
+		} else {
+			// start reading and writing since connected
+			if client.option.WriteBatchBytes > 0 {
+				client.writeCh = make(chan *[]byte, WriteChanSize)
+				client.writeDone = make(chan struct{})
+				go client.serveWrite()
+			}
+			go client.input()
 
-		if client.option.Heartbeat && client.option.HeartbeatInterval > 0 {
-			go client.heartbeat()
+			if client.option.Heartbeat && client.option.HeartbeatInterval > 0 {
+				go client.heartbeat()
+			}
 		}
 
 	}
@@ -86,24 +103,12 @@ func (client *Client) Connect(network, address string) (err error) {
 }
 
 func newDirectConn(c *Client, network, address string) (conn net.Conn, err error) {
-	var tlsConn *tls.Conn
-
 	if c == nil {
 		err = fmt.Errorf("nil client")
 		return
 	}
 
-	if c.option.TLSConfig != nil {
-		dialer := &net.Dialer{
-			Timeout: c.option.ConnectTimeout,
-		}
-		tlsConn, err = tls.DialWithDialer(dialer, network, address, c.option.TLSConfig)
-		// or conn:= tls.Client(netConn, &config)
-		conn = net.Conn(tlsConn)
-	} else {
-		conn, err = net.DialTimeout(network, address, c.option.ConnectTimeout)
-	}
-
+	conn, err = c.dialTLS(network, address, c.option.TLSConfig)
 	if err != nil {
 		log.Warnf("failed to dial server: %v", err)
 		return
@@ -122,19 +127,8 @@ func newDirectHTTPConn(c *Client, network, address string) (conn net.Conn, err e
 		path = share.DefaultRPCPath
 	}
 
-	var tlsConn *tls.Conn
-
 	// get conn.
-	if c.option.TLSConfig != nil {
-		dialer := &net.Dialer{
-			Timeout: c.option.ConnectTimeout,
-		}
-		tlsConn, err = tls.DialWithDialer(dialer, "tcp", address, c.option.TLSConfig)
-		// or conn:= tls.Client(netConn, &config)
-		conn = net.Conn(tlsConn)
-	} else {
-		conn, err = net.DialTimeout("tcp", address, c.option.ConnectTimeout)
-	}
+	conn, err = c.dialTLS("tcp", address, c.option.TLSConfig)
 	if err != nil {
 		log.Errorf("failed to dial server: %v", err)
 		return
@@ -191,27 +185,29 @@ func newDirectWSConn(c *Client, network, address string) (conn net.Conn, err err
 		origin = fmt.Sprintf("https://%s", address)
 	}
 
-	if c.option.TLSConfig != nil {
-		config, errN := websocket.NewConfig(url, origin)
-		if errN != nil {
-			return nil, errN
-		}
-
-		config.TlsConfig = c.option.TLSConfig
-		conn, err = websocket.DialConfig(config)
-	} else {
-		conn, err = websocket.Dial(url, "", origin)
+	config, err := websocket.NewConfig(url, origin)
+	if err != nil {
+		return nil, err
 	}
 
-	return
-}
-
-func newDirectKCPConn(_ *Client, _, _ string) (net.Conn, error) {
-	return nil, errors.New("kcp unsupported")
-}
+	var tlsConfig *tls.Config
+	if network == "wss" {
+		tlsConfig = c.option.TLSConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+	}
+	conn, err = c.dialTLS("tcp", address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
 
-func newDirectQuicConn(_ *Client, _, _ string) (net.Conn, error) {
-	return nil, errors.New("quic unsupported")
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ws, nil
 }
 
 func newMemuConn(_ *Client, network, address string) (net.Conn, error) {
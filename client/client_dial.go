@@ -0,0 +1,152 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// DialFunc dials a connection, and can be set as Option.Dialer.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Dial connects to address by Option.Dialer, or through Option.Proxy for tcp networks, within Option.ConnectTimeout.
+// Connection factories in ConnFactories can use it, so that the dialer and the proxy apply to them too.
+func (client *Client) Dial(network, address string) (net.Conn, error) {
+	ctx, cancel := client.connectContext()
+	defer cancel()
+	return client.dialContext(ctx, network, address)
+}
+
+// connectContext returns a context which expires after Option.ConnectTimeout.
+func (client *Client) connectContext() (context.Context, context.CancelFunc) {
+	if client.option.ConnectTimeout > 0 {
+		return context.WithTimeout(context.Background(), client.option.ConnectTimeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+func (client *Client) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if client.option.Dialer != nil {
+		return client.option.Dialer(ctx, network, address)
+	}
+	if client.option.Proxy != nil && strings.HasPrefix(network, "tcp") {
+		return dialProxy(ctx, client.option.Proxy, network, address)
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// dialTLS dials address, and performs the TLS handshake by tlsConfig if it is not nil.
+func (client *Client) dialTLS(network, address string, tlsConfig *tls.Config) (net.Conn, error) {
+	ctx, cancel := client.connectContext()
+	defer cancel()
+
+	conn, err := client.dialContext(ctx, network, address)
+	if err != nil || tlsConfig == nil {
+		return conn, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err = tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialProxy connects to address through the proxy of proxyURL,
+// which is http://[user:password@]host:port or socks5://[user:password@]host:port.
+func dialProxy(ctx context.Context, proxyURL *url.URL, network, address string) (net.Conn, error) {
+	switch proxyURL.Scheme {
+	case "http":
+		return dialHTTPProxy(ctx, proxyURL, address)
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(proxyURL, &net.Dialer{})
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, network, address)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %s", proxyURL.Scheme)
+	}
+}
+
+// dialHTTPProxy connects to address by a CONNECT request to the HTTP proxy.
+func dialHTTPProxy(ctx context.Context, proxyURL *url.URL, address string) (net.Conn, error) {
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer func() { _ = conn.SetDeadline(time.Time{}) }()
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := proxyURL.User; user != nil {
+		password, _ := user.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err = req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.New("proxy CONNECT failed: " + resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps data read into its reader with the response of the proxy.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,150 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T, serve func(conn net.Conn)) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func echo(conn net.Conn) {
+	defer conn.Close()
+	_, _ = io.Copy(conn, conn)
+}
+
+// pipe connects conn to target, and closes both after either side is closed.
+func pipe(conn net.Conn, target string) {
+	defer conn.Close()
+	tc, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer tc.Close()
+	go func() { _, _ = io.Copy(tc, conn) }()
+	_, _ = io.Copy(conn, tc)
+}
+
+func httpProxy(conn net.Conn) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != http.MethodConnect {
+		_ = conn.Close()
+		return
+	}
+	auth := &http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}
+	if user, password, ok := auth.BasicAuth(); !ok || user != "user" || password != "secret" {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		_ = conn.Close()
+		return
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	pipe(conn, req.Host)
+}
+
+// socks5Proxy supports CONNECT with username/password authentication.
+func socks5Proxy(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	buf := make([]byte, 256)
+
+	// methods
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		_ = conn.Close()
+		return
+	}
+	_, _ = io.ReadFull(r, buf[:buf[1]])
+	_, _ = conn.Write([]byte{5, 2})
+
+	// username/password
+	_, _ = io.ReadFull(r, buf[:2])
+	user := make([]byte, buf[1])
+	_, _ = io.ReadFull(r, user)
+	_, _ = io.ReadFull(r, buf[:1])
+	password := make([]byte, buf[0])
+	_, _ = io.ReadFull(r, password)
+	if string(user) != "user" || string(password) != "secret" {
+		_, _ = conn.Write([]byte{1, 1})
+		_ = conn.Close()
+		return
+	}
+	_, _ = conn.Write([]byte{1, 0})
+
+	// request of an IPv4 address
+	_, _ = io.ReadFull(r, buf[:10])
+	ip := net.IP(buf[4:8])
+	port := binary.BigEndian.Uint16(buf[8:10])
+	_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	pipe(&bufferedConn{Conn: conn, r: r}, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+}
+
+func TestDialProxy(t *testing.T) {
+	target := listen(t, echo)
+	httpAddr := listen(t, httpProxy)
+	socks5Addr := listen(t, socks5Proxy)
+
+	for _, proxyURL := range []string{
+		"http://user:secret@" + httpAddr,
+		"socks5://user:secret@" + socks5Addr,
+	} {
+		u, _ := url.Parse(proxyURL)
+		client := NewClient(Option{Proxy: u, ConnectTimeout: time.Second})
+
+		conn, err := client.Dial("tcp", target)
+		if err != nil {
+			t.Fatalf("%s: failed to dial: %v", proxyURL, err)
+		}
+		_, _ = conn.Write([]byte("irpc"))
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "irpc" {
+			t.Fatalf("%s: expect echo, got %q, %v", proxyURL, buf, err)
+		}
+		_ = conn.Close()
+	}
+
+	u, _ := url.Parse("http://user:wrong@" + httpAddr)
+	if _, err := NewClient(Option{Proxy: u}).Dial("tcp", target); err == nil {
+		t.Fatal("expect the proxy to reject the wrong password")
+	}
+}
+
+func TestDialer(t *testing.T) {
+	target := listen(t, echo)
+
+	var dialed string
+	client := NewClient(Option{Dialer: func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = address
+		var d net.Dialer
+		return d.DialContext(ctx, network, target)
+	}})
+	conn, err := newDirectConn(client, "tcp", "irpc.example:8972")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if dialed != "irpc.example:8972" {
+		t.Fatalf("expect the dialer to be used, got %q", dialed)
+	}
+}
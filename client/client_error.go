@@ -6,6 +6,11 @@ import "errors"
 var (
 	ErrShutdown         = errors.New("connection is shut down")
 	ErrUnsupportedCodec = errors.New("unsupported codec")
+	// ErrServerGoingAway the server is shutting down and has not handled the request, so it can be retried on another server.
+	ErrServerGoingAway = errors.New("server is going away")
+	// ErrServerOverloaded the server has rejected the request without handling it because it is overloaded,
+	// so it can be retried on another server.
+	ErrServerOverloaded = errors.New("server is overloaded")
 )
 
 // ServiceError is an error from server.
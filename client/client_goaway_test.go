@@ -0,0 +1,47 @@
+package client
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestHandleGoAway(t *testing.T) {
+	client := NewClient(DefaultOption)
+	client.pending = make(map[uint64]*Call)
+	calls := make([]*Call, 3)
+	for seq := range calls {
+		calls[seq] = &Call{Done: make(chan *Call, 1)}
+		client.pending[uint64(seq)] = calls[seq]
+	}
+
+	// only seq 1 has been read, even though seq 2 was sent after it and seq 0 before it
+	payload := make([]byte, 8)
+	binary.BigEndian.PutUint64(payload, 1)
+	client.handleGoAway(payload)
+
+	for seq, call := range calls {
+		select {
+		case <-call.Done:
+			if seq == 1 {
+				t.Fatalf("the request %d in flight should not be failed", seq)
+			}
+			if call.Error != ErrServerGoingAway {
+				t.Fatalf("expect ErrServerGoingAway for %d, got %v", seq, call.Error)
+			}
+		default:
+			if seq != 1 {
+				t.Fatalf("the request %d not read should be failed", seq)
+			}
+		}
+	}
+	if !client.isGoingAway() || len(client.pending) != 1 {
+		t.Fatalf("expect only the request in flight to be pending, got %d", len(client.pending))
+	}
+
+	// nothing in flight
+	client.pending[3] = &Call{Done: make(chan *Call, 1)}
+	client.handleGoAway(nil)
+	if len(client.pending) != 0 {
+		t.Fatalf("expect no pending requests, got %d", len(client.pending))
+	}
+}
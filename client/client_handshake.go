@@ -0,0 +1,116 @@
+package client
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/derekAHua/irpc/log"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+)
+
+// handshake exchanges handshakes with the server before the client starts reading responses,
+// and falls back to the options both sides support.
+func (client *Client) handshake() error {
+	data, err := json.Marshal(protocol.NewHandshake(share.SerializeTypes()))
+	if err != nil {
+		return err
+	}
+
+	client.mutex.Lock()
+	seq := client.seq
+	client.seq++
+	client.mutex.Unlock()
+
+	// the handshake is in the v1 format, so that any server can decode it.
+	req := protocol.GetPooledMsg()
+	req.SetMessageType(protocol.Request)
+	req.SetSerializeType(protocol.JSON)
+	req.SetFrameType(protocol.FrameHandshake)
+	req.SetSeq(seq)
+	if client.option.Auth != "" {
+		req.Metadata = map[string]string{share.AuthKey: client.option.Auth}
+	}
+	req.Payload = data
+
+	if client.option.ConnectTimeout > 0 {
+		_ = client.Conn.SetDeadline(time.Now().Add(client.option.ConnectTimeout))
+	}
+	defer func() {
+		if client.option.IdleTimeout != 0 {
+			_ = client.Conn.SetDeadline(time.Now().Add(client.option.IdleTimeout))
+		} else {
+			_ = client.Conn.SetDeadline(time.Time{})
+		}
+	}()
+
+	allData := req.EncodeSlicePointer()
+	_, err = client.Conn.Write(*allData)
+	protocol.PutData(allData)
+	protocol.FreeMsg(req)
+	if err != nil {
+		return err
+	}
+
+	res := protocol.NewMessage()
+	if err = res.Decode(client.r); err != nil {
+		return err
+	}
+
+	if len(res.Payload) == 0 {
+		// servers without handshakes reply with an error only.
+		if share.Trace {
+			log.Debugf("server %s doesn't support handshakes: %s", client.Conn.RemoteAddr().String(), res.Metadata[protocol.ServiceError])
+		}
+		client.option.ProtocolVersion = 0
+		client.option.Checksum = false
+		return nil
+	}
+	if res.MessageStatusType() == protocol.Error {
+		return ServiceError(res.Metadata[protocol.ServiceError])
+	}
+
+	remote := &protocol.Handshake{}
+	if err = json.Unmarshal(res.Payload, remote); err != nil {
+		return err
+	}
+	return client.negotiate(remote)
+}
+
+// exceedsMaxMessageLength returns whether a payload of n bytes is too long for the server.
+// Compressed or chunked payloads are left to the server.
+func (client *Client) exceedsMaxMessageLength(n int) bool {
+	if client.maxMessageLength <= 0 || n <= client.maxMessageLength || client.option.CompressType != protocol.None {
+		return false
+	}
+	return client.option.ChunkSize <= 0 || client.option.ProtocolVersion < protocol.Version2
+}
+
+// negotiate changes the options to what the server supports.
+func (client *Client) negotiate(remote *protocol.Handshake) error {
+	opt := &client.option
+
+	if !remote.SupportsVersion(opt.ProtocolVersion) {
+		opt.ProtocolVersion = 0
+	}
+	if !remote.SupportsSerializeType(opt.SerializeType) {
+		found := false
+		for _, st := range remote.SerializeTypes {
+			if share.Codecs[st] != nil {
+				opt.SerializeType = st
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrUnsupportedCodec
+		}
+	}
+	if !remote.SupportsCompressType(opt.CompressType) {
+		opt.CompressType = protocol.None
+	}
+	opt.Checksum = opt.Checksum && remote.Checksum
+	client.maxMessageLength = remote.MaxMessageLength
+
+	return nil
+}
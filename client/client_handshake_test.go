@@ -0,0 +1,39 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/derekAHua/irpc/protocol"
+)
+
+func TestNegotiate(t *testing.T) {
+	client := NewClient(Option{
+		ProtocolVersion: protocol.Version2,
+		SerializeType:   protocol.SerializeType(15), // not supported by the server
+		CompressType:    protocol.Gzip,
+		Checksum:        true,
+	})
+
+	err := client.negotiate(&protocol.Handshake{
+		Versions:         []byte{1},
+		SerializeTypes:   []protocol.SerializeType{protocol.JSON, protocol.MsgPack},
+		CompressTypes:    []protocol.CompressType{protocol.None},
+		MaxMessageLength: 1024,
+	})
+	if err != nil {
+		t.Fatalf("failed to negotiate: %v", err)
+	}
+
+	opt := client.option
+	if opt.ProtocolVersion != 0 || opt.SerializeType != protocol.JSON || opt.CompressType != protocol.None || opt.Checksum {
+		t.Fatalf("unexpected options after negotiation: %+v", opt)
+	}
+	if !client.exceedsMaxMessageLength(2048) {
+		t.Fatalf("expect 2048 bytes to exceed the max message length")
+	}
+
+	err = client.negotiate(&protocol.Handshake{SerializeTypes: []protocol.SerializeType{protocol.SerializeType(14)}})
+	if err != ErrUnsupportedCodec {
+		t.Fatalf("expect ErrUnsupportedCodec, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+//go:build kcp
+// +build kcp
+
+package client
+
+import (
+	"errors"
+	"net"
+
+	"github.com/derekAHua/irpc/share"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+func newDirectKCPConn(c *Client, _, address string) (net.Conn, error) {
+	var block kcp.BlockCrypt
+	if c.option.Block != nil {
+		bc, ok := c.option.Block.(kcp.BlockCrypt)
+		if !ok {
+			return nil, errors.New("kcp: Option.Block must be a kcp.BlockCrypt")
+		}
+		block = bc
+	}
+
+	config := share.DefaultKCPConfig
+	if c.option.KCPConfig != nil {
+		config = *c.option.KCPConfig
+	}
+
+	sess, err := kcp.DialWithOptions(address, block, config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	config.Apply(sess)
+	return sess, nil
+}
@@ -0,0 +1,13 @@
+//go:build !kcp
+// +build !kcp
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+func newDirectKCPConn(_ *Client, _, _ string) (net.Conn, error) {
+	return nil, errors.New("kcp unsupported, build with the kcp tag")
+}
@@ -0,0 +1,128 @@
+//go:build quic
+// +build quic
+
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/derekAHua/irpc/share"
+	"github.com/quic-go/quic-go"
+)
+
+// quicConns shares a QUIC connection among clients of the same address and TLS config,
+// and every client uses a stream of it. Connections are removed after their last stream is closed.
+var quicConns = struct {
+	sync.Mutex
+	m map[quicKey]*quicConn
+}{m: make(map[quicKey]*quicConn)}
+
+// quicSessionCache keeps session tickets for 0-RTT resumption after connections are closed,
+// if Option.TLSConfig has no ClientSessionCache.
+var quicSessionCache = tls.NewLRUClientSessionCache(0)
+
+type quicKey struct {
+	address   string
+	tlsConfig *tls.Config
+}
+
+type quicConn struct {
+	key       quicKey
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	conn    quic.EarlyConnection
+	streams int
+}
+
+func newDirectQuicConn(c *Client, _, address string) (net.Conn, error) {
+	if c.option.TLSConfig == nil {
+		return nil, errors.New("quic: Option.TLSConfig must be configured")
+	}
+	var config *quic.Config
+	if c.option.QUICConfig != nil {
+		qc, ok := c.option.QUICConfig.(*quic.Config)
+		if !ok {
+			return nil, errors.New("quic: Option.QUICConfig must be a *quic.Config")
+		}
+		config = qc
+	}
+
+	ctx := context.Background()
+	if c.option.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.option.ConnectTimeout)
+		defer cancel()
+	}
+
+	return getQUICConn(address, c.option.TLSConfig).openStream(ctx, address, config)
+}
+
+func getQUICConn(address string, tlsConfig *tls.Config) *quicConn {
+	quicConns.Lock()
+	defer quicConns.Unlock()
+
+	key := quicKey{address: address, tlsConfig: tlsConfig}
+	qc := quicConns.m[key]
+	if qc == nil {
+		config := tlsConfig.Clone()
+		if len(config.NextProtos) == 0 {
+			config.NextProtos = []string{share.QUICNextProto}
+		}
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = quicSessionCache
+		}
+		qc = &quicConn{key: key, tlsConfig: config}
+		quicConns.m[key] = qc
+	}
+	return qc
+}
+
+// openStream opens a stream of the connection, and dials the server if there is no live connection.
+// Requests can be sent in 0-RTT data if the server has been connected before and allows 0-RTT.
+func (qc *quicConn) openStream(ctx context.Context, address string, config *quic.Config) (net.Conn, error) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if qc.conn == nil || qc.conn.Context().Err() != nil {
+		conn, err := quic.DialAddrEarly(ctx, address, qc.tlsConfig, config)
+		if err != nil {
+			return nil, err
+		}
+		qc.conn = conn
+		qc.streams = 0
+	}
+
+	conn := qc.conn
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	qc.streams++
+	return share.NewQUICStreamConn(conn, stream, func() { qc.release(conn) }), nil
+}
+
+// release closes the connection and removes it from quicConns after its last stream is closed.
+func (qc *quicConn) release(conn quic.EarlyConnection) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if qc.conn != conn {
+		return
+	}
+	qc.streams--
+	if qc.streams == 0 {
+		_ = conn.CloseWithError(0, "")
+		qc.conn = nil
+
+		quicConns.Lock()
+		if quicConns.m[qc.key] == qc {
+			delete(quicConns.m, qc.key)
+		}
+		quicConns.Unlock()
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !quic
+// +build !quic
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+func newDirectQuicConn(_ *Client, _, _ string) (net.Conn, error) {
+	return nil, errors.New("quic unsupported, build with the quic tag")
+}
@@ -0,0 +1,21 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"context"
+	"net"
+
+	"github.com/derekAHua/irpc/share"
+)
+
+func newShmConn(c *Client, _, address string) (net.Conn, error) {
+	ctx := context.Background()
+	if c.option.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.option.ConnectTimeout)
+		defer cancel()
+	}
+	return share.DialShm(ctx, address)
+}
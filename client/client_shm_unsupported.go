@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"errors"
+	"net"
+)
+
+func newShmConn(_ *Client, _, _ string) (net.Conn, error) {
+	return nil, errors.New("shm unsupported on this platform")
+}
@@ -0,0 +1,308 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/derekAHua/irpc/codec"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+)
+
+// ErrStreamClosed is returned by ClientStream after the stream has been closed by Close.
+var ErrStreamClosed = errors.New("stream is closed")
+
+// StreamBufferSize is the number of server messages buffered for each stream.
+// It is the window granted to the server, which sends more messages as the stream consumes them,
+// so that a slow stream doesn't stop the connection reader. See protocol.StreamWindow.
+var StreamBufferSize = 64
+
+// ClientStream is the client side of a streaming call opened by NewStream.
+// Send and CloseSend may be called concurrently with Recv, but not concurrently with each other.
+type ClientStream interface {
+	// Context returns the context the stream was opened with.
+	Context() context.Context
+	// Send encodes v and sends it to the server.
+	Send(v interface{}) error
+	// Recv decodes the next message from the server into v.
+	// It returns io.EOF when the server method has returned without error.
+	Recv(v interface{}) error
+	// CloseSend closes the sending side of the stream. The server receives io.EOF.
+	CloseSend() error
+	// Close closes the stream and releases its resources.
+	// The server method is canceled if it is still running.
+	Close() error
+}
+
+type clientStream struct {
+	client        *Client
+	ctx           context.Context
+	seq           uint64
+	codec         codec.Codec
+	serializeType protocol.SerializeType
+	recvCh        chan *protocol.Message
+	// consumed is the number of messages received since the last grant of the window.
+	consumed int
+	// window is the number of messages the stream may send to the server.
+	window protocol.StreamWindow
+
+	mu         sync.Mutex
+	sendClosed bool
+	done       chan struct{}
+	err        error // set before done is closed
+}
+
+// NewStream opens a stream to a streaming method of the server.
+// args is encoded into the request that opens the stream.
+func (client *Client) NewStream(ctx context.Context, servicePath, serviceMethod string, args interface{}) (ClientStream, error) {
+	codec := share.Codecs[client.option.SerializeType]
+	if codec == nil {
+		return nil, ErrUnsupportedCodec
+	}
+	data, err := codec.Encode(args)
+	if err != nil {
+		return nil, err
+	}
+
+	client.mutex.Lock()
+	if client.shutdown || client.closing {
+		client.mutex.Unlock()
+		if client.goingAway {
+			return nil, ErrServerGoingAway
+		}
+		return nil, ErrShutdown
+	}
+	if client.streams == nil {
+		client.streams = make(map[uint64]*clientStream)
+	}
+	seq := client.seq
+	client.seq++
+	st := &clientStream{
+		client:        client,
+		ctx:           ctx,
+		seq:           seq,
+		codec:         codec,
+		serializeType: client.option.SerializeType,
+		recvCh:        make(chan *protocol.Message, StreamBufferSize),
+		done:          make(chan struct{}),
+	}
+	client.streams[seq] = st
+	client.mutex.Unlock()
+
+	req := st.newFrame(protocol.FrameStream)
+	req.ServicePath = servicePath
+	req.ServiceMethod = serviceMethod
+	if meta := ctx.Value(share.ReqMetaDataKey); meta != nil {
+		req.Metadata = meta.(map[string]string)
+	}
+	if exts, ok := ctx.Value(share.ReqExtensionsKey).([]protocol.Extension); ok {
+		req.Extensions = append(req.Extensions, exts...)
+	}
+	req.Payload = data
+	err = client.writeStreamFrame(req)
+	if err == nil {
+		err = st.grant(StreamBufferSize)
+	}
+	if err != nil {
+		client.removeStream(seq)
+		st.finish(err)
+		return nil, err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = st.Close()
+		case <-st.done:
+		}
+	}()
+
+	return st, nil
+}
+
+// writeStreamFrame encodes and writes a frame of a stream.
+func (client *Client) writeStreamFrame(req *protocol.Message) error {
+	if len(req.Payload) > client.compressThreshold() && client.option.CompressType != protocol.None {
+		req.SetCompressType(client.option.CompressType)
+	}
+	if client.Plugins != nil {
+		_ = client.Plugins.DoClientBeforeEncode(req)
+	}
+
+	err := client.write(req.EncodeSlicePointer())
+	protocol.FreeMsg(req)
+	return err
+}
+
+// deliverStream passes a response to its stream.
+// It returns false if the response does not belong to a stream.
+func (client *Client) deliverStream(res *protocol.Message) bool {
+	if res.MessageType() != protocol.Response {
+		return false
+	}
+
+	seq := res.Seq()
+	client.mutex.Lock()
+	st := client.streams[seq]
+	client.mutex.Unlock()
+	if st == nil {
+		return false
+	}
+
+	switch {
+	case res.MessageStatusType() == protocol.Error:
+		client.removeStream(seq)
+		st.finish(ServiceError(res.Metadata[protocol.ServiceError]))
+	case res.FrameType() == protocol.FrameStreamWindow:
+		st.window.Add(res.StreamWindowSize())
+		protocol.FreeMsg(res)
+	case res.FrameType() == protocol.FrameStream:
+		select {
+		case <-st.done:
+			protocol.FreeMsg(res)
+			return true
+		default:
+		}
+		select {
+		case st.recvCh <- res:
+		default:
+			// the server has sent more than its window
+			protocol.FreeMsg(res)
+			client.removeStream(seq)
+			if st.finish(protocol.ErrStreamOverflow) {
+				client.sendCancel(seq)
+			}
+		}
+	default:
+		client.removeStream(seq)
+		st.finish(io.EOF)
+	}
+	return true
+}
+
+func (client *Client) removeStream(seq uint64) {
+	client.mutex.Lock()
+	delete(client.streams, seq)
+	client.mutex.Unlock()
+}
+
+// closeStreams finishes all streams with err. The caller must hold client.mutex.
+func (client *Client) closeStreams(err error) {
+	for seq, st := range client.streams {
+		delete(client.streams, seq)
+		st.finish(err)
+	}
+}
+
+func (st *clientStream) newFrame(ft protocol.FrameType) *protocol.Message {
+	req := protocol.GetPooledMsg()
+	req.SetVersion(st.client.option.ProtocolVersion)
+	req.SetChecksum(st.client.option.Checksum)
+	req.SetMessageType(protocol.Request)
+	req.SetSeq(st.seq)
+	req.SetSerializeType(st.serializeType)
+	req.SetFrameType(ft)
+	return req
+}
+
+// finish marks the stream as finished with err.
+func (st *clientStream) finish(err error) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	select {
+	case <-st.done:
+		return false
+	default:
+	}
+	st.err = err
+	close(st.done)
+	return true
+}
+
+func (st *clientStream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *clientStream) Send(v interface{}) error {
+	st.mu.Lock()
+	sendClosed := st.sendClosed
+	st.mu.Unlock()
+	if sendClosed {
+		return ErrStreamClosed
+	}
+	select {
+	case <-st.done:
+		return st.err
+	default:
+	}
+
+	if !st.window.Take(st.done) {
+		return st.err
+	}
+
+	data, err := st.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+	req := st.newFrame(protocol.FrameStream)
+	req.Payload = data
+	return st.client.writeStreamFrame(req)
+}
+
+func (st *clientStream) Recv(v interface{}) error {
+	var res *protocol.Message
+	select {
+	case res = <-st.recvCh:
+	case <-st.done:
+		// deliver frames which arrived before the end of the stream first.
+		select {
+		case res = <-st.recvCh:
+		default:
+			return st.err
+		}
+	}
+
+	// grant the consumed messages in batches
+	st.consumed++
+	if st.consumed >= (StreamBufferSize+1)/2 {
+		// a failed write fails the next Send too
+		_ = st.grant(st.consumed)
+		st.consumed = 0
+	}
+	return st.codec.Decode(res.Payload, v)
+}
+
+// grant grants the server n more messages.
+func (st *clientStream) grant(n int) error {
+	req := st.newFrame(protocol.FrameStreamWindow)
+	req.SetStreamWindow(n)
+	return st.client.writeStreamFrame(req)
+}
+
+func (st *clientStream) CloseSend() error {
+	st.mu.Lock()
+	if st.sendClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.sendClosed = true
+	st.mu.Unlock()
+
+	select {
+	case <-st.done:
+		return nil
+	default:
+	}
+	return st.client.writeStreamFrame(st.newFrame(protocol.FrameStreamEnd))
+}
+
+func (st *clientStream) Close() error {
+	st.client.removeStream(st.seq)
+	if st.finish(ErrStreamClosed) {
+		st.client.sendCancel(st.seq)
+	}
+	return nil
+}
@@ -3,6 +3,8 @@ package client
 import (
 	"reflect"
 	"testing"
+
+	"github.com/derekAHua/irpc/protocol"
 )
 
 // @Author: Derek
@@ -29,3 +31,12 @@ func TestNewClient(t *testing.T) {
 		})
 	}
 }
+
+func TestCompressThreshold(t *testing.T) {
+	for threshold, want := range map[int]int{0: protocol.DefaultCompressThreshold, 10: 10, -1: -1} {
+		client := NewClient(Option{CompressThreshold: threshold})
+		if got := client.compressThreshold(); got != want {
+			t.Errorf("compressThreshold() of %d = %d, want %d", threshold, got, want)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"context"
 	"errors"
-	"fmt"
 	ex "github.com/derekAHua/irpc/errors"
 	"github.com/derekAHua/irpc/log"
 	"github.com/derekAHua/irpc/protocol"
@@ -17,6 +16,7 @@ import (
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -54,6 +54,8 @@ type (
 		SendFile(ctx context.Context, fileName string, rateInBytesPerSecond int64, meta map[string]string) error
 		DownloadFile(ctx context.Context, requestFileName string, saveTo io.Writer, meta map[string]string) error
 		Stream(ctx context.Context, meta map[string]string) (net.Conn, error)
+		NewStream(ctx context.Context, serviceMethod string, args interface{}) (ClientStream, error)
+		PoolStats() map[string]PoolStats
 		Close() error
 	}
 
@@ -68,7 +70,7 @@ type (
 type xClient struct {
 	failMode     FailMode
 	selectMode   SelectMode
-	cachedClient map[string]RPCClient
+	cachedClient map[string]*clientPool
 	breakers     sync.Map
 	servicePath  string
 	option       Option
@@ -80,6 +82,9 @@ type xClient struct {
 
 	slGroup singleflight.Group
 
+	// servers which have sent a GoAway, excluded from selection until the time.
+	goingAway map[string]time.Time
+
 	isShutdown bool
 
 	// auth is a string for Authentication, for example, "Bearer mF_9.B5f-4.1JqM"
@@ -130,17 +135,7 @@ func (c *xClient) Inform(ctx context.Context, serviceMethod string, args interfa
 		return nil, ErrXClientShutdown
 	}
 
-	if c.auth != "" {
-		metadata := ctx.Value(share.ReqMetaDataKey)
-		if metadata == nil {
-			metadata = map[string]string{}
-			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
-		}
-		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
-	}
-
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 	callPlugins := make([]RPCClient, 0, len(c.servers))
 	clients := make(map[string]RPCClient)
 	c.mu.Lock()
@@ -253,7 +248,7 @@ func (c *xClient) SendFile(ctx context.Context, fileName string, rateInBytesPerS
 		Meta:     meta,
 	}
 
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 
 	reply := &share.FileTransferReply{}
 	err = c.Call(ctx, "TransferFile", args, reply)
@@ -314,7 +309,7 @@ loop:
 }
 
 func (c *xClient) DownloadFile(ctx context.Context, requestFileName string, saveTo io.Writer, meta map[string]string) error {
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 
 	args := share.DownloadFileArgs{
 		FileName: requestFileName,
@@ -371,17 +366,7 @@ func (c *xClient) SendRaw(ctx context.Context, r *protocol.Message) (map[string]
 		return nil, nil, ErrXClientShutdown
 	}
 
-	if c.auth != "" {
-		metadata := ctx.Value(share.ReqMetaDataKey)
-		if metadata == nil {
-			metadata = map[string]string{}
-			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
-		}
-		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
-	}
-
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 
 	if share.Trace {
 		log.Debugf("select a client for %s.%s, failMode: %v, args: %+v in case of xclient SendRaw", r.ServicePath, r.ServiceMethod, c.failMode, r.Payload)
@@ -480,7 +465,7 @@ func (c *xClient) Stream(ctx context.Context, meta map[string]string) (net.Conn,
 		Meta: meta,
 	}
 
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 
 	reply := &share.StreamServiceReply{}
 	err := c.Call(ctx, "Stream", args, reply)
@@ -502,15 +487,40 @@ func (c *xClient) Stream(ctx context.Context, meta map[string]string) (net.Conn,
 	return conn, nil
 }
 
+// NewStream opens a stream to a streaming method on a selected server.
+// Streams are not retried, so FailMode is meaningless for this method.
+func (c *xClient) NewStream(ctx context.Context, serviceMethod string, args interface{}) (ClientStream, error) {
+	if c.isShutdown {
+		return nil, ErrXClientShutdown
+	}
+
+	ctx = c.requestContext(ctx)
+
+	k, client, err := c.selectClient(ctx, c.servicePath, serviceMethod, args)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := client.NewStream(ctx, c.servicePath, serviceMethod, args)
+	if err == ErrServerGoingAway {
+		c.handleGoAway(k, c.servicePath, serviceMethod, client)
+	} else if err != nil && uncoverError(err) {
+		c.removeClient(k, c.servicePath, serviceMethod, client)
+	}
+	return stream, err
+}
+
 // Close closes this client and its underlying connections to services.
 func (c *xClient) Close() error {
 	var errs []error
 	c.mu.Lock()
 	c.isShutdown = true
-	for k, v := range c.cachedClient {
-		e := v.Close()
-		if e != nil {
-			errs = append(errs, e)
+	for k, p := range c.cachedClient {
+		for _, v := range p.members {
+			e := v.Close()
+			if e != nil {
+				errs = append(errs, e)
+			}
 		}
 
 		delete(c.cachedClient, k)
@@ -540,7 +550,7 @@ func NewXClient(servicePath string, failMode FailMode, selectMode SelectMode, di
 		selectMode:   selectMode,
 		discovery:    discovery,
 		servicePath:  servicePath,
-		cachedClient: make(map[string]RPCClient),
+		cachedClient: make(map[string]*clientPool),
 		option:       option,
 	}
 
@@ -606,18 +616,29 @@ func filterByStateAndGroup(group string, servers map[string]string) {
 	}
 }
 
-func setServerTimeout(ctx context.Context) context.Context {
-	if deadline, ok := ctx.Deadline(); ok {
-		metadata := ctx.Value(share.ReqMetaDataKey)
-		if metadata == nil {
-			metadata = map[string]string{}
-			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
-		}
-		m := metadata.(map[string]string)
-		m[share.ServerTimeout] = fmt.Sprintf("%d", time.Until(deadline).Milliseconds())
+// requestContext sets the auth of c and, for v1 servers, the remaining time of ctx minus Option.DeadlineMargin
+// as share.ServerTimeout in the metadata of ctx. ctx may be the context of a request handled by a server,
+// so its metadata is copied instead of modified. v2 clients send the deadline in the extension block.
+func (c *xClient) requestContext(ctx context.Context) context.Context {
+	deadline, hasDeadline := ctx.Deadline()
+	hasDeadline = hasDeadline && c.option.ProtocolVersion < protocol.Version2
+	if c.auth == "" && !hasDeadline {
+		return ctx
 	}
 
-	return ctx
+	meta, _ := ctx.Value(share.ReqMetaDataKey).(map[string]string)
+	m := copyMetadata(meta, 2)
+	if c.auth != "" {
+		m[share.AuthKey] = c.auth
+	}
+	if hasDeadline {
+		timeout := time.Until(deadline) - c.option.DeadlineMargin
+		if timeout < 0 {
+			timeout = 0
+		}
+		m[share.ServerTimeout] = strconv.FormatInt(timeout.Milliseconds(), 10)
+	}
+	return context.WithValue(ctx, share.ReqMetaDataKey, m)
 }
 
 // wrapSendRaw wrap SendRaw to support client plugins
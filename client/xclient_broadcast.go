@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	ex "github.com/derekAHua/irpc/errors"
-	"github.com/derekAHua/irpc/share"
 	"reflect"
 	"time"
 )
@@ -17,17 +16,7 @@ func (c *xClient) Broadcast(ctx context.Context, serviceMethod string, args inte
 		return ErrXClientShutdown
 	}
 
-	if c.auth != "" {
-		metadata := ctx.Value(share.ReqMetaDataKey)
-		if metadata == nil {
-			metadata = map[string]string{}
-			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
-		}
-		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
-	}
-
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 	callPlugins := make([]RPCClient, 0, len(c.servers))
 	clients := make(map[string]RPCClient)
 	c.mu.Lock()
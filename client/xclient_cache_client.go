@@ -7,18 +7,37 @@ import (
 
 // selects a client from candidates base on c.selectMode
 func (c *xClient) selectClient(ctx context.Context, servicePath, serviceMethod string, args interface{}) (string, RPCClient, error) {
+	k := c.selectServer(ctx, servicePath, serviceMethod, args)
+	if k == "" {
+		return "", nil, ErrXClientNoServer
+	}
+	client, err := c.getCachedClient(k, servicePath, serviceMethod, args)
+	if err == ErrServerGoingAway {
+		// k is excluded now, so select another one
+		k = c.selectServer(ctx, servicePath, serviceMethod, args)
+		if k == "" {
+			return "", nil, ErrXClientNoServer
+		}
+		client, err = c.getCachedClient(k, servicePath, serviceMethod, args)
+	}
+	return k, client, err
+}
+
+// selectServer selects a server by the selector, skipping the servers which are going away.
+func (c *xClient) selectServer(ctx context.Context, servicePath, serviceMethod string, args interface{}) string {
 	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	fn := c.selector.Select
 	if c.Plugins != nil {
 		fn = c.Plugins.DoWrapSelect(fn)
 	}
 	k := fn(ctx, servicePath, serviceMethod, args)
-	c.mu.Unlock()
-	if k == "" {
-		return "", nil, ErrXClientNoServer
+	// still use the last one if all servers are going away.
+	for i := 0; i < len(c.servers) && k != "" && c.isExcludedLocked(k); i++ {
+		k = fn(ctx, servicePath, serviceMethod, args)
 	}
-	client, err := c.getCachedClient(k, servicePath, serviceMethod, args)
-	return k, client, err
+	return k
 }
 
 func (c *xClient) getCachedClient(k string, servicePath, serviceMethod string, _ interface{}) (RPCClient, error) {
@@ -49,6 +68,12 @@ func (c *xClient) getCachedClient(k string, servicePath, serviceMethod string, _
 			return client, nil
 		}
 		c.deleteCachedClient(client, k, servicePath, serviceMethod)
+		if isGoingAway(client) {
+			c.excludeLocked(k)
+			c.mu.Unlock()
+			client.UnregisterServerMessageChan()
+			return nil, ErrServerGoingAway
+		}
 	}
 
 	client = c.findCachedClient(k, servicePath, serviceMethod)
@@ -63,6 +88,12 @@ func (c *xClient) getCachedClient(k string, servicePath, serviceMethod string, _
 
 		c.slGroup.Forget(k)
 		if err != nil {
+			c.mu.Lock()
+			usePool := c.dialFailedLocked(k)
+			c.mu.Unlock()
+			if usePool {
+				return c.getCachedClient(k, servicePath, serviceMethod, nil)
+			}
 			return nil, err
 		}
 
@@ -81,25 +112,47 @@ func (c *xClient) getCachedClient(k string, servicePath, serviceMethod string, _
 	return client, nil
 }
 
+// findCachedClient returns a cached client for k, and grows the pool of k in the background if it is not full.
 func (c *xClient) findCachedClient(k, servicePath, serviceMethod string) RPCClient {
 	network, _ := splitNetworkAndAddress(k)
 	if builder, ok := getCacheClientBuilder(network); ok {
 		return builder.FindCachedClient(k, servicePath, serviceMethod)
 	}
 
-	return c.cachedClient[k]
+	if p := c.cachedClient[k]; p != nil {
+		if p.startGrow() {
+			go c.grow(p, k, servicePath, serviceMethod)
+		}
+		return p.pick()
+	}
+	return nil
+}
+
+// isCachedClient returns whether client is cached for k, so that it can be removed.
+func (c *xClient) isCachedClient(client RPCClient, k, servicePath, serviceMethod string) bool {
+	network, _ := splitNetworkAndAddress(k)
+	if builder, ok := getCacheClientBuilder(network); ok {
+		return builder.FindCachedClient(k, servicePath, serviceMethod) == client
+	}
+
+	p := c.cachedClient[k]
+	return p != nil && p.contains(client)
 }
 
 func (c *xClient) deleteCachedClient(client RPCClient, k, servicePath, serviceMethod string) {
 	network, _ := splitNetworkAndAddress(k)
 	if builder, ok := getCacheClientBuilder(network); ok && client != nil {
 		builder.DeleteCachedClient(client, k, servicePath, serviceMethod)
-		_ = client.Close()
+		if !isGoingAway(client) {
+			_ = client.Close()
+		}
 		return
 	}
 
-	delete(c.cachedClient, k)
-	if client != nil {
+	if p := c.cachedClient[k]; p != nil && client != nil {
+		p.remove(client)
+	}
+	if client != nil && !isGoingAway(client) {
 		_ = client.Close()
 	}
 }
@@ -110,8 +163,13 @@ func (c *xClient) generateClient(k, servicePath, serviceMethod string) (client R
 		return builder.GenerateClient(k, servicePath, serviceMethod)
 	}
 
+	option := c.option
+	if option.Auth == "" {
+		// authenticate the connection in the handshake if enabled
+		option.Auth = c.auth
+	}
 	client = &Client{
-		option:  c.option,
+		option:  option,
 		Plugins: c.Plugins,
 	}
 
@@ -137,20 +195,27 @@ func (c *xClient) setCachedClient(client RPCClient, k, servicePath, serviceMetho
 		return
 	}
 
-	c.cachedClient[k] = client
+	p := c.cachedClient[k]
+	if p == nil {
+		p = newClientPool(c.option)
+		c.cachedClient[k] = p
+	}
+	p.add(client)
 }
 
 func (c *xClient) removeClient(k, servicePath, serviceMethod string, client RPCClient) {
 	c.mu.Lock()
-	cl := c.findCachedClient(k, servicePath, serviceMethod)
-	if cl == client {
+	if c.isCachedClient(client, k, servicePath, serviceMethod) {
 		c.deleteCachedClient(client, k, servicePath, serviceMethod)
 	}
 	c.mu.Unlock()
 
 	if client != nil {
 		client.UnregisterServerMessageChan()
-		_ = client.Close()
+		// a client whose server is going away is closed by the server after its requests are finished.
+		if !isGoingAway(client) {
+			_ = client.Close()
+		}
 	}
 }
 
@@ -172,6 +237,9 @@ func (c *xClient) getCachedClientWithoutLock(k, servicePath, serviceMethod strin
 		})
 		c.slGroup.Forget(k)
 		if err != nil {
+			if c.dialFailedLocked(k) {
+				return c.getCachedClientWithoutLock(k, servicePath, serviceMethod)
+			}
 			return nil, needCallPlugin, err
 		}
 
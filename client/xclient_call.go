@@ -15,16 +15,7 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 		return ErrXClientShutdown
 	}
 
-	if c.auth != "" {
-		metadata := ctx.Value(share.ReqMetaDataKey)
-		if metadata == nil {
-			metadata = map[string]string{}
-			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
-		}
-		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
-	}
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 
 	if share.Trace {
 		log.Debugf("select a client for %s.%s, failMode: %v, args: %+v in case of xclient Call", c.servicePath, serviceMethod, c.failMode, args)
@@ -47,6 +38,7 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 	}
 
 	var e error
+	var goAways int // retries caused by GoAway, which are bounded by the number of servers
 	switch c.failMode {
 	case Failtry:
 		retries := c.option.Retries
@@ -64,6 +56,14 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 				if _, ok := err.(ServiceError); ok {
 					return err
 				}
+				// the request has not been handled, so retry it on another server without counting.
+				if err == ErrServerGoingAway && c.canRetryGoAway(goAways) {
+					goAways++
+					retries++
+					c.handleGoAway(k, c.servicePath, serviceMethod, client)
+					k, client, e = c.selectClient(ctx, c.servicePath, serviceMethod, args)
+					continue
+				}
 			}
 
 			if uncoverError(err) {
@@ -91,6 +91,13 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 				if _, ok := err.(ServiceError); ok {
 					return err
 				}
+				if err == ErrServerGoingAway && c.canRetryGoAway(goAways) {
+					goAways++
+					retries++
+					c.handleGoAway(k, c.servicePath, serviceMethod, client)
+					k, client, e = c.selectClient(ctx, c.servicePath, serviceMethod, args)
+					continue
+				}
 			}
 
 			if uncoverError(err) {
@@ -160,6 +167,14 @@ func (c *xClient) Call(ctx context.Context, serviceMethod string, args interface
 		return err
 	default: // FailFast
 		err = c.wrapCall(ctx, client, serviceMethod, args, reply)
+		if err == ErrServerGoingAway {
+			// the request has not been handled, so it is safe to send it to another server once.
+			c.handleGoAway(k, c.servicePath, serviceMethod, client)
+			k, client, err = c.selectClient(ctx, c.servicePath, serviceMethod, args)
+			if err == nil {
+				err = c.wrapCall(ctx, client, serviceMethod, args, reply)
+			}
+		}
 		if err != nil {
 			if uncoverError(err) {
 				c.removeClient(k, c.servicePath, serviceMethod, client)
@@ -201,17 +216,7 @@ func (c *xClient) Go(ctx context.Context, serviceMethod string, args interface{}
 		return nil, ErrXClientShutdown
 	}
 
-	if c.auth != "" {
-		metadata := ctx.Value(share.ReqMetaDataKey)
-		if metadata == nil {
-			metadata = map[string]string{}
-			ctx = context.WithValue(ctx, share.ReqMetaDataKey, metadata)
-		}
-		m := metadata.(map[string]string)
-		m[share.AuthKey] = c.auth
-	}
-
-	ctx = setServerTimeout(ctx)
+	ctx = c.requestContext(ctx)
 
 	if share.Trace {
 		log.Debugf("select a client for %s.%s, args: %+v in case of xclient Go", c.servicePath, serviceMethod, args)
@@ -239,5 +244,10 @@ func uncoverError(err error) bool {
 		return false
 	}
 
+	// the connection is fine, and the server is only busy
+	if err == ErrServerOverloaded {
+		return false
+	}
+
 	return true
 }
@@ -0,0 +1,53 @@
+package client
+
+import "time"
+
+// handleGoAway excludes the server k which has sent a GoAway from selection
+// and drops its client from the cache. The client is not closed so that the
+// requests the server has accepted can still finish.
+func (c *xClient) handleGoAway(k, servicePath, serviceMethod string, client RPCClient) {
+	c.mu.Lock()
+	c.excludeLocked(k)
+	c.mu.Unlock()
+
+	c.removeClient(k, servicePath, serviceMethod, client)
+}
+
+// excludeLocked excludes the server k from selection for option.GoAwayExclusion.
+// The caller must hold c.mu.
+func (c *xClient) excludeLocked(k string) {
+	if c.option.GoAwayExclusion <= 0 {
+		return
+	}
+	if c.goingAway == nil {
+		c.goingAway = make(map[string]time.Time)
+	}
+	c.goingAway[k] = time.Now().Add(c.option.GoAwayExclusion)
+}
+
+// isExcludedLocked returns whether the server k is excluded because of a GoAway.
+// The caller must hold c.mu.
+func (c *xClient) isExcludedLocked(k string) bool {
+	until, ok := c.goingAway[k]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(c.goingAway, k)
+		return false
+	}
+	return true
+}
+
+// canRetryGoAway returns whether a request can be retried after n GoAways without counting the retry.
+func (c *xClient) canRetryGoAway(n int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return n < len(c.servers)
+}
+
+// isGoingAway returns whether the server of client has sent a GoAway.
+func isGoingAway(client RPCClient) bool {
+	cl, ok := client.(*Client)
+	return ok && cl.isGoingAway()
+}
@@ -33,3 +33,13 @@ const (
 	// SelectByUser is selecting by implementation of users.
 	SelectByUser = 1000
 )
+
+// PoolStrategy defines the algorithm of choosing a connection from the pool of a server.
+type PoolStrategy int
+
+const (
+	// LeastPending chooses the connection with the fewest pending requests.
+	LeastPending PoolStrategy = iota
+	// RoundRobinConn chooses the connections in turn.
+	RoundRobinConn
+)
@@ -0,0 +1,192 @@
+package client
+
+import "time"
+
+// poolGrowBackoff is how long a pool uses its connections without dialing more after failing to dial one.
+const poolGrowBackoff = time.Second
+
+// PoolStats is the usage of the connections of XClient to a server.
+type PoolStats struct {
+	// Size is the max number of connections, and Conns is the number of connections in the pool.
+	Size  int
+	Conns int
+	// Pending is the number of requests waiting for responses on the connections.
+	Pending int
+	// Picks is the number of times a connection is chosen for a request.
+	Picks uint64
+	// Dials is the number of connections added to the pool, including the replacements of broken ones.
+	Dials uint64
+	// DialErrors is the number of failures to dial a connection.
+	DialErrors uint64
+	// Removed is the number of broken connections removed from the pool.
+	Removed uint64
+}
+
+// clientPool is the connections of XClient to a server. It is protected by xClient.mu.
+type clientPool struct {
+	size     int
+	strategy PoolStrategy
+	members  []RPCClient
+	next     uint64
+	// growRetry is the time before which the pool is not grown after failing to dial a connection.
+	growRetry time.Time
+	// growing is set while a connection is dialed in the background to grow the pool.
+	growing bool
+
+	picks, dials, dialErrors, removed uint64
+}
+
+func newClientPool(option Option) *clientPool {
+	size := option.PoolSize
+	if size < 1 {
+		size = 1
+	}
+	return &clientPool{size: size, strategy: option.PoolStrategy}
+}
+
+// pick chooses a connection for a request. It returns nil if the pool has no connections.
+func (p *clientPool) pick() RPCClient {
+	n := len(p.members)
+	if n == 0 {
+		return nil
+	}
+	p.picks++
+	p.next++
+	start := int(p.next % uint64(n))
+	if p.strategy == RoundRobinConn {
+		return p.members[start]
+	}
+
+	// the connections are scanned from start, so that idle ones are used in turn
+	var best RPCClient
+	least := -1
+	for i := 0; i < n; i++ {
+		m := p.members[(start+i)%n]
+		pending := pendingRequests(m)
+		if least < 0 || pending < least {
+			best, least = m, pending
+		}
+		if least == 0 {
+			break
+		}
+	}
+	return best
+}
+
+// startGrow reports whether a connection should be dialed to grow the pool, and marks the dial started.
+// The pool is grown one connection at a time while its connections are used, and an empty pool is
+// filled by the request which needs a connection.
+func (p *clientPool) startGrow() bool {
+	n := len(p.members)
+	if p.growing || n == 0 || n >= p.size || time.Now().Before(p.growRetry) {
+		return false
+	}
+	p.growing = true
+	return true
+}
+
+func (p *clientPool) contains(client RPCClient) bool {
+	for _, m := range p.members {
+		if m == client {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds a dialed connection. A connection shared by concurrent dials is added once.
+func (p *clientPool) add(client RPCClient) {
+	if p.contains(client) {
+		return
+	}
+	p.members = append(p.members, client)
+	p.dials++
+}
+
+func (p *clientPool) remove(client RPCClient) {
+	for i, m := range p.members {
+		if m == client {
+			p.members = append(p.members[:i], p.members[i+1:]...)
+			p.removed++
+			return
+		}
+	}
+}
+
+// dialFailed records a failure to dial, and returns whether the connections in the pool can be used instead.
+func (p *clientPool) dialFailed() bool {
+	p.dialErrors++
+	if len(p.members) == 0 {
+		return false
+	}
+	p.growRetry = time.Now().Add(poolGrowBackoff)
+	return true
+}
+
+func (p *clientPool) stats() PoolStats {
+	st := PoolStats{
+		Size:       p.size,
+		Conns:      len(p.members),
+		Picks:      p.picks,
+		Dials:      p.dials,
+		DialErrors: p.dialErrors,
+		Removed:    p.removed,
+	}
+	for _, m := range p.members {
+		st.Pending += pendingRequests(m)
+	}
+	return st
+}
+
+func pendingRequests(client RPCClient) int {
+	if cl, ok := client.(*Client); ok {
+		return cl.pendingRequests()
+	}
+	return 0
+}
+
+// PoolStats returns the usage of the connections to each server.
+func (c *xClient) PoolStats() map[string]PoolStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stats := make(map[string]PoolStats, len(c.cachedClient))
+	for k, p := range c.cachedClient {
+		stats[k] = p.stats()
+	}
+	return stats
+}
+
+// grow dials a connection to k for its pool p outside c.mu, so that requests keep using the connections
+// in the pool meanwhile.
+func (c *xClient) grow(p *clientPool, k, servicePath, serviceMethod string) {
+	client, err := c.generateClient(k, servicePath, serviceMethod)
+
+	c.mu.Lock()
+	p.growing = false
+	if err != nil {
+		p.dialFailed()
+		c.mu.Unlock()
+		return
+	}
+	if c.isShutdown || c.cachedClient[k] != p {
+		// the pool is closed meanwhile
+		c.mu.Unlock()
+		_ = client.Close()
+		return
+	}
+	client.RegisterServerMessageChan(c.serverMessageChan)
+	p.add(client)
+	c.mu.Unlock()
+
+	if c.Plugins != nil {
+		_, _ = c.Plugins.DoClientConnected(client.GetConn())
+	}
+}
+
+// dialFailedLocked records a failure to dial a connection to k, and returns whether its pool can be used instead.
+// The caller must hold c.mu.
+func (c *xClient) dialFailedLocked(k string) bool {
+	p := c.cachedClient[k]
+	return p != nil && p.dialFailed()
+}
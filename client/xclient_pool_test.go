@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/server"
+	"github.com/stretchr/testify/assert"
+)
+
+type PoolSleeper struct{}
+
+func (PoolSleeper) Sleep(_ context.Context, ms *int, reply *int) error {
+	time.Sleep(time.Duration(*ms) * time.Millisecond)
+	*reply = *ms
+	return nil
+}
+
+func startPoolServer(t *testing.T) (*server.Server, string) {
+	s := server.New()
+	assert.NoError(t, s.RegisterName("Sleeper", PoolSleeper{}, ""))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	t.Cleanup(func() { _ = s.Close() })
+	return s, "tcp@" + ln.Addr().String()
+}
+
+func newPoolXClient(t *testing.T, k string, failMode FailMode, option Option) XClient {
+	d, err := NewMultipleServersDiscovery([]*KVPair{{Key: k}})
+	assert.NoError(t, err)
+	xc := NewXClient("Sleeper", failMode, RoundRobin, d, option)
+	t.Cleanup(func() { _ = xc.Close() })
+	return xc
+}
+
+func sleep(t *testing.T, xc XClient, ms int) {
+	var reply int
+	assert.NoError(t, xc.Call(context.Background(), "Sleep", &ms, &reply))
+	assert.Equal(t, ms, reply)
+}
+
+func TestXClientPool(t *testing.T) {
+	s, k := startPoolServer(t)
+	option := DefaultOption
+	option.PoolSize = 3
+	xc := newPoolXClient(t, k, Failtry, option)
+
+	// concurrent requests are spread over the connections
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sleep(t, xc, 50)
+		}()
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+
+	st := xc.PoolStats()[k]
+	assert.Equal(t, 3, st.Size)
+	assert.Equal(t, 3, st.Conns)
+	assert.Equal(t, uint64(3), st.Dials)
+	assert.Equal(t, 0, st.Pending)
+	assert.Len(t, s.ActiveClientConn(), 3)
+
+	// a broken connection is replaced alone
+	_ = s.ActiveClientConn()[0].Close()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 6; i++ {
+		sleep(t, xc, 1)
+	}
+	assert.Eventually(t, func() bool { return xc.PoolStats()[k].Conns == 3 }, time.Second, 10*time.Millisecond)
+	st = xc.PoolStats()[k]
+	assert.Equal(t, uint64(4), st.Dials)
+	assert.Equal(t, uint64(1), st.Removed)
+	assert.Len(t, s.ActiveClientConn(), 3)
+}
+
+func TestXClientPoolRoundRobin(t *testing.T) {
+	s, k := startPoolServer(t)
+	option := DefaultOption
+	option.PoolSize = 2
+	option.PoolStrategy = RoundRobinConn
+	xc := newPoolXClient(t, k, Failfast, option)
+
+	// the first request dials a connection, and the second one grows the pool in the background
+	sleep(t, xc, 1)
+	sleep(t, xc, 1)
+	assert.Eventually(t, func() bool { return xc.PoolStats()[k].Conns == 2 }, time.Second, 10*time.Millisecond)
+
+	// sequential requests use both connections
+	for i := 0; i < 2; i++ {
+		sleep(t, xc, 1)
+	}
+	st := xc.PoolStats()[k]
+	assert.Equal(t, uint64(3), st.Picks)
+	assert.Len(t, s.ActiveClientConn(), 2)
+}
+
+func TestXClientPoolGrowsInBackground(t *testing.T) {
+	_, k := startPoolServer(t)
+
+	// dials after the first one are slow
+	var dials int32
+	option := DefaultOption
+	option.PoolSize = 2
+	option.Dialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			time.Sleep(500 * time.Millisecond)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+	xc := newPoolXClient(t, k, Failfast, option)
+	sleep(t, xc, 1)
+
+	// requests keep using the first connection while the second one is dialed
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		sleep(t, xc, 1)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(400*time.Millisecond))
+	assert.Equal(t, 1, xc.PoolStats()[k].Conns)
+	assert.Eventually(t, func() bool { return xc.PoolStats()[k].Conns == 2 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestContext(t *testing.T) {
+	c := &xClient{option: Option{DeadlineMargin: 200 * time.Millisecond}}
+
+	// a context without deadline sends no timeout
+	ctx := c.requestContext(context.Background())
+	assert.Nil(t, ctx.Value(share.ReqMetaDataKey))
+
+	// the metadata of the context is copied, with the remaining time minus the margin
+	meta := map[string]string{"k": "v", share.ServerTimeout: "10000"}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), share.ReqMetaDataKey, meta), time.Second)
+	defer cancel()
+	m := c.requestContext(ctx).Value(share.ReqMetaDataKey).(map[string]string)
+	assert.Equal(t, "v", m["k"])
+	timeout, err := strconv.Atoi(m[share.ServerTimeout])
+	assert.NoError(t, err)
+	assert.InDelta(t, 800, timeout, 50)
+	assert.Equal(t, "10000", meta[share.ServerTimeout])
+
+	// the auth is set in the copy too
+	c.auth = "token"
+	m = c.requestContext(context.WithValue(context.Background(), share.ReqMetaDataKey, meta)).Value(share.ReqMetaDataKey).(map[string]string)
+	assert.Equal(t, "token", m[share.AuthKey])
+	assert.NotContains(t, meta, share.AuthKey)
+
+	// the timeout is not negative
+	c.option.DeadlineMargin = 2 * time.Second
+	m = c.requestContext(ctx).Value(share.ReqMetaDataKey).(map[string]string)
+	assert.Equal(t, "0", m[share.ServerTimeout])
+
+	// v2 clients send the deadline in the extension block instead
+	c.option.ProtocolVersion = protocol.Version2
+	m = c.requestContext(ctx).Value(share.ReqMetaDataKey).(map[string]string)
+	assert.Equal(t, "token", m[share.AuthKey])
+	assert.Equal(t, "10000", m[share.ServerTimeout])
+	c.auth = ""
+	assert.Equal(t, ctx, c.requestContext(ctx))
+}
@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"net"
+	"time"
+)
+
+// BatchWriter writes encoded frames queued by concurrent goroutines to a connection.
+// Frames queued while a batch is being gathered or written are written together by one writev,
+// so that pipelined requests or responses don't cost a syscall each.
+type BatchWriter struct {
+	// MaxBatchBytes limits the bytes gathered into one batch.
+	// If it is zero every frame is written alone.
+	MaxBatchBytes int
+	// MaxDelay is how long a batch smaller than MaxBatchBytes waits for more frames.
+	// If it is zero only frames already queued are gathered.
+	MaxDelay time.Duration
+	// WriteTimeout sets the write deadline of each batch if it is not zero.
+	WriteTimeout time.Duration
+}
+
+// Serve writes frames received from queue to conn, and puts them back into the pool by PutData.
+// It returns after queue is closed or a nil frame is received, or after stop is closed and the frames
+// queued before have been written.
+// If a write fails, conn is closed and the following frames are dropped until then.
+func (w *BatchWriter) Serve(conn net.Conn, queue <-chan *[]byte, stop <-chan struct{}) error {
+	var (
+		err     error
+		batch   []*[]byte
+		vec     net.Buffers
+		timer   *time.Timer
+		stopped bool
+	)
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		var data *[]byte
+		if stopped {
+			select {
+			case data = <-queue:
+			default:
+				return err
+			}
+		} else {
+			select {
+			case data = <-queue:
+			case <-stop:
+				stopped = true
+				continue
+			}
+		}
+		if data == nil {
+			return err
+		}
+		if err != nil {
+			PutData(data)
+			continue
+		}
+
+		batch = append(batch[:0], data)
+		size := len(*data)
+
+		// gather frames queued meanwhile
+		var deadline <-chan time.Time
+		waiting := false
+		if w.MaxDelay > 0 && !stopped && size < w.MaxBatchBytes {
+			if timer == nil {
+				timer = time.NewTimer(w.MaxDelay)
+			} else {
+				timer.Reset(w.MaxDelay)
+			}
+			deadline = timer.C
+			waiting = true
+		}
+		closed := false
+	gather:
+		for size < w.MaxBatchBytes {
+			select {
+			case data = <-queue:
+			default:
+				if deadline == nil {
+					break gather
+				}
+				select {
+				case data = <-queue:
+				case <-deadline:
+					deadline = nil
+					waiting = false
+					continue
+				case <-stop:
+					stopped = true
+					deadline = nil
+					continue
+				}
+			}
+			if data == nil {
+				closed = true
+				break
+			}
+			batch = append(batch, data)
+			size += len(*data)
+		}
+		if waiting && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		vec, err = w.write(conn, batch, vec)
+		if err != nil {
+			_ = conn.Close()
+		}
+		if closed {
+			return err
+		}
+	}
+}
+
+// write writes batch to conn by writev, and returns vec to be reused.
+func (w *BatchWriter) write(conn net.Conn, batch []*[]byte, vec net.Buffers) (net.Buffers, error) {
+	if w.WriteTimeout != 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(w.WriteTimeout))
+	}
+
+	var err error
+	if len(batch) == 1 {
+		_, err = conn.Write(*batch[0])
+	} else {
+		vec = vec[:0]
+		for _, data := range batch {
+			vec = append(vec, *data)
+		}
+		// WriteTo consumes bufs, so vec keeps the backing array.
+		bufs := vec
+		_, err = bufs.WriteTo(conn)
+	}
+
+	for i, data := range batch {
+		PutData(data)
+		batch[i] = nil
+	}
+	return vec, err
+}
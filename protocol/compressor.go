@@ -3,9 +3,13 @@ package protocol
 import (
 	"bytes"
 	"io/ioutil"
+	"math"
+	"sync"
 
 	"github.com/derekAHua/irpc/util"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 )
 
 // Compressor defines a common compression interface.
@@ -36,7 +40,12 @@ func (c RawDataCompressor) Unzip(data []byte) ([]byte, error) {
 	return data, nil
 }
 
-// SnappyCompressor implements snappy compressor.
+var (
+	snappyWriters = sync.Pool{New: func() interface{} { return snappy.NewBufferedWriter(nil) }}
+	snappyReaders = sync.Pool{New: func() interface{} { return snappy.NewReader(nil) }}
+)
+
+// SnappyCompressor implements snappy compressor with the framing format.
 type SnappyCompressor struct{}
 
 func (c *SnappyCompressor) Zip(data []byte) ([]byte, error) {
@@ -45,7 +54,10 @@ func (c *SnappyCompressor) Zip(data []byte) ([]byte, error) {
 	}
 
 	var buffer bytes.Buffer
-	writer := snappy.NewBufferedWriter(&buffer)
+	writer := snappyWriters.Get().(*snappy.Writer)
+	defer snappyWriters.Put(writer)
+	writer.Reset(&buffer)
+
 	_, err := writer.Write(data)
 	if err != nil {
 		_ = writer.Close()
@@ -64,11 +76,117 @@ func (c *SnappyCompressor) Unzip(data []byte) ([]byte, error) {
 		return data, nil
 	}
 
-	reader := snappy.NewReader(bytes.NewReader(data))
-	out, err := ioutil.ReadAll(reader)
+	reader := snappyReaders.Get().(*snappy.Reader)
+	defer snappyReaders.Put(reader)
+	reader.Reset(bytes.NewReader(data))
+
+	return ioutil.ReadAll(reader)
+}
+
+// ZstdCompressor implements zstd compressor.
+// Its encoder and decoder are shared by concurrent calls and keep pools of their states.
+// Unzip fails for payloads longer than MaxMessageLength when it is first used, or 4 GiB if it is not limited.
+type ZstdCompressor struct {
+	// Dict is an optional dictionary trained by `zstd --train` on typical payloads.
+	// Both sides must use the same dictionary, see RegisterZstdDict.
+	Dict []byte
+
+	once sync.Once
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	err  error
+}
+
+func (c *ZstdCompressor) init() error {
+	c.once.Do(func() {
+		maxMemory := uint64(math.MaxUint32)
+		if MaxMessageLength > 0 {
+			maxMemory = uint64(MaxMessageLength)
+		}
+
+		var eopts []zstd.EOption
+		dopts := []zstd.DOption{zstd.WithDecoderMaxMemory(maxMemory)}
+		if len(c.Dict) > 0 {
+			eopts = append(eopts, zstd.WithEncoderDict(c.Dict))
+			dopts = append(dopts, zstd.WithDecoderDicts(c.Dict))
+		}
+
+		c.enc, c.err = zstd.NewWriter(nil, eopts...)
+		if c.err != nil {
+			return
+		}
+		c.dec, c.err = zstd.NewReader(nil, dopts...)
+	})
+	return c.err
+}
+
+func (c *ZstdCompressor) Zip(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.enc.EncodeAll(data, nil), nil
+}
+
+func (c *ZstdCompressor) Unzip(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c.dec.DecodeAll(data, nil)
+}
+
+// RegisterZstdDict uses dict for Zstd, which must be called with the same dictionary
+// by clients and servers before they send messages.
+func RegisterZstdDict(dict []byte) {
+	RegisterCompressor(Zstd, &ZstdCompressor{Dict: dict})
+}
+
+var (
+	lz4Writers = sync.Pool{New: func() interface{} { return lz4.NewWriter(nil) }}
+	lz4Readers = sync.Pool{New: func() interface{} { return lz4.NewReader(nil) }}
+)
+
+// LZ4Compressor implements lz4 compressor with the frame format.
+type LZ4Compressor struct{}
+
+func (c *LZ4Compressor) Zip(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	var buffer bytes.Buffer
+	writer := lz4Writers.Get().(*lz4.Writer)
+	defer lz4Writers.Put(writer)
+	writer.Reset(&buffer)
+
+	_, err := writer.Write(data)
 	if err != nil {
+		_ = writer.Close()
 		return nil, err
 	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (c *LZ4Compressor) Unzip(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+
+	reader := lz4Readers.Get().(*lz4.Reader)
+	defer lz4Readers.Put(reader)
+	reader.Reset(bytes.NewReader(data))
 
-	return out, err
+	return ioutil.ReadAll(reader)
 }
@@ -0,0 +1,65 @@
+package protocol
+
+import "sort"
+
+// Handshake is the payload of FrameHandshake messages, encoded in JSON.
+// A client which enables the handshake sends it right after connecting, and the server replies with its own,
+// so that the client can fall back to what both sides support.
+type Handshake struct {
+	Versions       []byte          `json:"versions,omitempty"`
+	SerializeTypes []SerializeType `json:"serialize_types,omitempty"`
+	CompressTypes  []CompressType  `json:"compress_types,omitempty"`
+	// MaxMessageLength is the max length of messages the side accepts. Zero means no limit.
+	MaxMessageLength int  `json:"max_message_length,omitempty"`
+	Checksum         bool `json:"checksum,omitempty"`
+}
+
+// NewHandshake returns the handshake of this process with the serialize types it supports.
+func NewHandshake(serializeTypes []SerializeType) *Handshake {
+	compressTypes := make([]CompressType, 0, len(Compressors))
+	for ct := range Compressors {
+		compressTypes = append(compressTypes, ct)
+	}
+	sort.Slice(compressTypes, func(i, j int) bool { return compressTypes[i] < compressTypes[j] })
+
+	return &Handshake{
+		Versions:         []byte{1, Version2},
+		SerializeTypes:   serializeTypes,
+		CompressTypes:    compressTypes,
+		MaxMessageLength: MaxMessageLength,
+		Checksum:         true,
+	}
+}
+
+// SupportsVersion returns whether v is in the versions of h. Versions below Version2 are all v1.
+func (h *Handshake) SupportsVersion(v byte) bool {
+	if v < Version2 {
+		v = 1
+	}
+	for _, version := range h.Versions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsSerializeType returns whether st is in the serialize types of h.
+func (h *Handshake) SupportsSerializeType(st SerializeType) bool {
+	for _, t := range h.SerializeTypes {
+		if t == st {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsCompressType returns whether ct is in the compress types of h.
+func (h *Handshake) SupportsCompressType(ct CompressType) bool {
+	for _, t := range h.CompressTypes {
+		if t == ct {
+			return true
+		}
+	}
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 
 	"github.com/derekAHua/irpc/util"
@@ -12,10 +13,21 @@ import (
 
 // Compressors are compressors supported by irpc. You can add customized compressor in Compressors.
 var Compressors = map[CompressType]Compressor{
-	None: &RawDataCompressor{},
-	Gzip: &GzipCompressor{},
+	None:   &RawDataCompressor{},
+	Gzip:   &GzipCompressor{},
+	Snappy: &SnappyCompressor{},
+	Zstd:   &ZstdCompressor{},
+	LZ4:    &LZ4Compressor{},
 }
 
+// RegisterCompressor register customized compressor.
+func RegisterCompressor(t CompressType, c Compressor) {
+	Compressors[t] = c
+}
+
+// DefaultCompressThreshold is the default payload size over which payloads are compressed.
+const DefaultCompressThreshold = 1024
+
 // MaxMessageLength is the max length of a message.
 // Default is 0 that means does not limit length of messages.
 // It is used to validate when read messages from io.Reader.
@@ -26,6 +38,8 @@ var (
 	ErrMetaKVMissing = errors.New("wrong metadata lines. some keys or values are missing")
 	// ErrMessageTooLong message is too long
 	ErrMessageTooLong = errors.New("message is too long")
+	// ErrMessageTruncated a field of the message is longer than the rest of the message.
+	ErrMessageTruncated = errors.New("message is truncated")
 
 	ErrUnsupportedCompressor = errors.New("unsupported compressor")
 )
@@ -33,16 +47,41 @@ var (
 const (
 	// ServiceError contains error info of service invocation
 	ServiceError = "__irpc_error__"
+	// ServerOverloaded is set in error responses to requests the server has rejected without handling them
+	// because it is overloaded, so that clients can retry the requests on other servers.
+	ServerOverloaded = "__irpc_overloaded__"
+	// DeadlineExceeded is set in error responses to requests the server has rejected without handling them
+	// because their deadlines have passed.
+	DeadlineExceeded = "__irpc_deadline_exceeded__"
 )
 
 // Message is the generic type of Request and Response.
+//
+// A v1 message is encoded as
+//
+//	header(12) | totalLen(4) | spLen(4) sp | smLen(4) sm | metaLen(4) meta | payloadLen(4) payload
+//
+// and a message with Version() >= Version2 has an extension block before servicePath:
+//
+//	header(12) | totalLen(4) | extLen(4) extensions | spLen(4) sp | ...
+//
+// If the checksum flag of the header is set, the message ends with the CRC32C of all bytes before it:
+//
+//	... | payloadLen(4) payload | checksum(4)
 type Message struct {
 	*Header
 	ServicePath   string
 	ServiceMethod string
 	Metadata      map[string]string
-	Payload       []byte
-	data          []byte
+	// Extensions are only encoded in v2 messages.
+	Extensions []Extension
+	Payload    []byte
+	data       []byte
+
+	// buf is the pooled frame buffer of DecodeZeroCopy.
+	buf *[]byte
+	// meta is the metadata map reused by DecodeZeroCopy.
+	meta map[string]string
 }
 
 // Clone clones from a message.
@@ -68,6 +107,15 @@ func (m Message) EncodeSlicePointer() *[]byte {
 	encodeMetadata(m.Metadata, bb)
 	meta := bb.Bytes()
 
+	var ext []byte
+	extL := 0
+	ebb := bytebufferpool.Get()
+	if m.Version() >= Version2 {
+		encodeExtensions(m.Extensions, ebb)
+		ext = ebb.Bytes()
+		extL = 4 + len(ext)
+	}
+
 	spL := len(m.ServicePath)
 	smL := len(m.ServiceMethod)
 
@@ -86,12 +134,16 @@ func (m Message) EncodeSlicePointer() *[]byte {
 		}
 	}
 
-	totalL := (4 + spL) + (4 + smL) + (4 + len(meta)) + (4 + len(payload))
+	totalL := extL + (4 + spL) + (4 + smL) + (4 + len(meta)) + (4 + len(payload))
+	if m.HasChecksum() {
+		totalL += 4
+	}
 
-	metaStart := 12 + 4 + (4 + spL) + (4 + smL)
+	spStart := 12 + 4 + extL
+	metaStart := spStart + (4 + spL) + (4 + smL)
 	payLoadStart := metaStart + (4 + len(meta))
 
-	// header + dataLen + spLen + sp + smLen + sm + metaL + meta + payloadLen + payload
+	// header + dataLen + [extL + ext] + spLen + sp + smLen + sm + metaL + meta + payloadLen + payload + [checksum]
 	l := 12 + 4 + totalL
 
 	data := bufferPool.Get(l)
@@ -102,13 +154,20 @@ func (m Message) EncodeSlicePointer() *[]byte {
 	// write totalLen
 	binary.BigEndian.PutUint32((*data)[12:16], uint32(totalL))
 
+	// write extensions
+	if extL > 0 {
+		binary.BigEndian.PutUint32((*data)[16:20], uint32(len(ext)))
+		copy((*data)[20:spStart], ext)
+	}
+	bytebufferpool.Put(ebb)
+
 	// write servicePath
-	binary.BigEndian.PutUint32((*data)[16:20], uint32(spL))
-	copy((*data)[20:20+spL], util.StringToSliceByte(m.ServicePath))
+	binary.BigEndian.PutUint32((*data)[spStart:spStart+4], uint32(spL))
+	copy((*data)[spStart+4:spStart+4+spL], util.StringToSliceByte(m.ServicePath))
 
 	// write serviceMethod
-	binary.BigEndian.PutUint32((*data)[20+spL:24+spL], uint32(smL))
-	copy((*data)[24+spL:metaStart], util.StringToSliceByte(m.ServiceMethod))
+	binary.BigEndian.PutUint32((*data)[spStart+4+spL:spStart+8+spL], uint32(smL))
+	copy((*data)[spStart+8+spL:metaStart], util.StringToSliceByte(m.ServiceMethod))
 
 	// write meta
 	binary.BigEndian.PutUint32((*data)[metaStart:metaStart+4], uint32(len(meta)))
@@ -120,11 +179,23 @@ func (m Message) EncodeSlicePointer() *[]byte {
 	binary.BigEndian.PutUint32((*data)[payLoadStart:payLoadStart+4], uint32(len(payload)))
 	copy((*data)[payLoadStart+4:], payload)
 
+	// write checksum
+	if m.HasChecksum() {
+		crc := crc32.Checksum((*data)[:l-4], crc32cTable)
+		binary.BigEndian.PutUint32((*data)[l-4:], crc)
+	}
+
 	return data
 }
 
 // WriteTo writes message to writers.
 func (m Message) WriteTo(w io.Writer) (int64, error) {
+	var cw *crcWriter
+	if m.HasChecksum() {
+		cw = &crcWriter{w: w}
+		w = cw
+	}
+
 	nn, err := w.Write(m.Header[:])
 	n := int64(nn)
 	if err != nil {
@@ -150,12 +221,37 @@ func (m Message) WriteTo(w io.Writer) (int64, error) {
 		}
 	}
 
-	totalL := (4 + spL) + (4 + smL) + (4 + len(meta)) + (4 + len(payload))
+	var ext []byte
+	extL := 0
+	ebb := bytebufferpool.Get()
+	defer bytebufferpool.Put(ebb)
+	if m.Version() >= Version2 {
+		encodeExtensions(m.Extensions, ebb)
+		ext = ebb.Bytes()
+		extL = 4 + len(ext)
+	}
+
+	totalL := extL + (4 + spL) + (4 + smL) + (4 + len(meta)) + (4 + len(payload))
+	if cw != nil {
+		totalL += 4
+	}
 	err = binary.Write(w, binary.BigEndian, uint32(totalL))
 	if err != nil {
 		return n, err
 	}
 
+	// write extensions
+	if extL > 0 {
+		err = binary.Write(w, binary.BigEndian, uint32(len(ext)))
+		if err != nil {
+			return n, err
+		}
+		_, err = w.Write(ext)
+		if err != nil {
+			return n, err
+		}
+	}
+
 	// write servicePath and serviceMethod
 	err = binary.Write(w, binary.BigEndian, uint32(len(m.ServicePath)))
 	if err != nil {
@@ -193,11 +289,42 @@ func (m Message) WriteTo(w io.Writer) (int64, error) {
 	}
 
 	nn, err = w.Write(payload)
+	if err != nil || cw == nil {
+		return int64(nn), err
+	}
+
+	// write checksum
+	err = binary.Write(cw.w, binary.BigEndian, cw.crc)
 	return int64(nn), err
 }
 
+// FrameSize returns the size of the frame at the beginning of data,
+// or 0 if data is too short to tell it, so that frames can be split from bytes read without blocking.
+func FrameSize(data []byte) (int, error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if data[0] != magicNumber {
+		return 0, fmt.Errorf("wrong magic number: %v", data[0])
+	}
+	// the header is followed by the total length of the rest of the frame
+	const prefixLen = len(Header{}) + 4
+	if len(data) < prefixLen {
+		return 0, nil
+	}
+	l := binary.BigEndian.Uint32(data[len(Header{}):])
+	if MaxMessageLength > 0 && int(l) > MaxMessageLength {
+		return 0, ErrMessageTooLong
+	}
+	return prefixLen + int(l), nil
+}
+
 // Decode decodes a message from a reader.
-func (m *Message) Decode(r io.Reader) (err error) {
+func (m *Message) Decode(r io.Reader) error {
+	return m.decode(r, false)
+}
+
+func (m *Message) decode(r io.Reader, zeroCopy bool) (err error) {
 	// validate rest length for each step?
 
 	// parse header
@@ -230,48 +357,88 @@ func (m *Message) Decode(r io.Reader) (err error) {
 
 	// parse data
 	totalL := int(l)
-	if cap(m.data) >= totalL {
-		m.data = m.data[:totalL]
+	var data []byte
+	if zeroCopy {
+		data = m.getBuffer(totalL)
 	} else {
-		m.data = make([]byte, totalL)
+		if cap(m.data) >= totalL {
+			m.data = m.data[:totalL]
+		} else {
+			m.data = make([]byte, totalL)
+		}
+		data = m.data
 	}
-	data := m.data
 	_, err = io.ReadFull(r, data)
 	if err != nil {
 		return
 	}
 
+	// verify checksum
+	if m.HasChecksum() {
+		if len(data) < 4 {
+			return ErrChecksumMismatch
+		}
+		sum := binary.BigEndian.Uint32(data[len(data)-4:])
+		data = data[:len(data)-4]
+		if checksum(m.Header, l, data) != sum {
+			return ErrChecksumMismatch
+		}
+	}
+
 	n := 0
 
+	// parse extensions
+	if m.Version() >= Version2 {
+		if len(data) < 4 {
+			return ErrExtensionMissing
+		}
+		l = binary.BigEndian.Uint32(data[:4])
+		n = 4
+		if uint64(l) > uint64(len(data)-n) {
+			return ErrExtensionMissing
+		}
+		nEnd := n + int(l)
+		m.Extensions, err = decodeExtensions(m.Extensions[:0], data[n:nEnd])
+		if err != nil {
+			return
+		}
+		n = nEnd
+	}
+
 	// parse servicePath
-	l = binary.BigEndian.Uint32(data[n:4])
-	n = n + 4
-	nEnd := n + int(l)
-	m.ServicePath = util.SliceByteToString(data[n:nEnd])
-	n = nEnd
+	field, n, ok := nextField(data, n)
+	if !ok {
+		return ErrMessageTruncated
+	}
+	m.ServicePath = util.SliceByteToString(field)
 
 	// parse serviceMethod
-	l = binary.BigEndian.Uint32(data[n : n+4])
-	n = n + 4
-	nEnd = n + int(l)
-	m.ServiceMethod = util.SliceByteToString(data[n:nEnd])
-	n = nEnd
+	field, n, ok = nextField(data, n)
+	if !ok {
+		return ErrMessageTruncated
+	}
+	m.ServiceMethod = util.SliceByteToString(field)
 
 	// parse meta
-	l = binary.BigEndian.Uint32(data[n : n+4])
-	n = n + 4
-	nEnd = n + int(l)
-	if l > 0 {
-		m.Metadata, err = decodeMetadata(l, data[n:nEnd])
+	field, n, ok = nextField(data, n)
+	if !ok {
+		return ErrMessageTruncated
+	}
+	if len(field) > 0 {
+		if zeroCopy {
+			err = decodeMetadataZeroCopy(m.getMetadata(), field)
+		} else {
+			m.Metadata, err = decodeMetadata(field)
+		}
 		if err != nil {
 			return
 		}
 	}
-	n = nEnd
 
-	// parse payload
-	l = binary.BigEndian.Uint32(data[n : n+4])
-	_ = l
+	// parse payload, which is the rest of the message after its length
+	if len(data)-n < 4 {
+		return ErrMessageTruncated
+	}
 	n = n + 4
 	m.Payload = data[n:]
 	if m.CompressType() != None {
@@ -291,7 +458,9 @@ func (m *Message) Decode(r io.Reader) (err error) {
 // Reset clean data of this message but keep allocated data.
 func (m *Message) Reset() {
 	resetHeader(m.Header)
+	m.releaseBuffer()
 	m.Metadata = nil
+	m.Extensions = m.Extensions[:0]
 	m.Payload = []byte{}
 	m.data = m.data[:0]
 	m.ServicePath = ""
@@ -337,37 +506,38 @@ func encodeMetadata(m map[string]string, bb *bytebufferpool.ByteBuffer) {
 	}
 }
 
-func decodeMetadata(l uint32, data []byte) (m map[string]string, err error) {
+func decodeMetadata(data []byte) (m map[string]string, err error) {
 	m = make(map[string]string, 10)
-	n := uint32(0)
-	for n < l {
+	var k, v []byte
+	for n, ok := 0, true; n < len(data); {
 		// parse one key and value
-
-		// key
-		sl := binary.BigEndian.Uint32(data[n : n+4])
-		n = n + 4
-		if n+sl > l-4 {
-			err = ErrMetaKVMissing
-			return
+		if k, n, ok = nextField(data, n); !ok {
+			return nil, ErrMetaKVMissing
 		}
-		k := string(data[n : n+sl])
-		n = n + sl
-
-		// value
-		sl = binary.BigEndian.Uint32(data[n : n+4])
-		n = n + 4
-		if n+sl > l {
-			err = ErrMetaKVMissing
-			return
+		if v, n, ok = nextField(data, n); !ok {
+			return nil, ErrMetaKVMissing
 		}
-		v := string(data[n : n+sl])
-		n = n + sl
-		m[k] = v
+		m[string(k)] = string(v)
 	}
 
 	return
 }
 
+// nextField returns the field at n of data prefixed by its length, and the offset after it.
+// It returns false if data is too short for the field.
+func nextField(data []byte, n int) (field []byte, next int, ok bool) {
+	if len(data)-n < 4 {
+		return nil, n, false
+	}
+	l := binary.BigEndian.Uint32(data[n:])
+	n += 4
+	if uint64(l) > uint64(len(data)-n) {
+		return nil, n, false
+	}
+	next = n + int(l)
+	return data[n:next], next, true
+}
+
 var (
 	zeroHeaderArray Header
 	zeroHeader      = zeroHeaderArray[1:]
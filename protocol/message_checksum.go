@@ -0,0 +1,35 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrChecksumMismatch the checksum of the message doesn't match its content.
+// The message has been read completely, so the connection can still be used.
+var ErrChecksumMismatch = errors.New("message checksum mismatch")
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum returns the CRC32C of the header, totalLen and the body of a message.
+func checksum(h *Header, totalL uint32, body []byte) uint32 {
+	var l [4]byte
+	binary.BigEndian.PutUint32(l[:], totalL)
+
+	crc := crc32.Update(0, crc32cTable, h[:])
+	crc = crc32.Update(crc, crc32cTable, l[:])
+	return crc32.Update(crc, crc32cTable, body)
+}
+
+// crcWriter computes the CRC32C of the data written through it.
+type crcWriter struct {
+	w   io.Writer
+	crc uint32
+}
+
+func (cw *crcWriter) Write(p []byte) (int, error) {
+	cw.crc = crc32.Update(cw.crc, crc32cTable, p)
+	return cw.w.Write(p)
+}
@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	// ErrPayloadTooLarge the reassembled payload is larger than the limit.
+	ErrPayloadTooLarge = errors.New("payload is too large")
+	// ErrMessageDropped the message has failed while its chunk frames were reassembled, and the failure has been reported.
+	ErrMessageDropped = errors.New("message is dropped")
+	// ErrTooManyAssemblies the sender has started more chunked calls than Assembler.MaxAssemblies without finishing them.
+	ErrTooManyAssemblies = errors.New("too many chunked messages")
+)
+
+// EncodeChunks encodes m and passes the encoded data to write, which must put data back by PutData.
+// If m is a v2 call whose payload is longer than chunkSize, the payload is split into FrameChunk frames
+// followed by m carrying the last part, so that other messages can be written between the frames.
+// Each part is compressed separately.
+func (m *Message) EncodeChunks(chunkSize int, write func(data *[]byte) error) error {
+	payload := m.Payload
+	if chunkSize <= 0 || len(payload) <= chunkSize || m.Version() < Version2 || m.FrameType() != FrameCall {
+		return write(m.EncodeSlicePointer())
+	}
+
+	chunk := GetPooledMsg()
+	defer FreeMsg(chunk)
+	for first := true; len(payload) > chunkSize; first = false {
+		*chunk.Header = *m.Header
+		chunk.SetFrameType(FrameChunk)
+		if first {
+			// the first chunk tells the receiver which service the message is for.
+			chunk.ServicePath = m.ServicePath
+			chunk.ServiceMethod = m.ServiceMethod
+		} else {
+			chunk.ServicePath = ""
+			chunk.ServiceMethod = ""
+		}
+		chunk.Payload = payload[:chunkSize]
+		payload = payload[chunkSize:]
+
+		if err := write(chunk.EncodeSlicePointer()); err != nil {
+			return err
+		}
+	}
+
+	whole := m.Payload
+	m.Payload = payload
+	err := write(m.EncodeSlicePointer())
+	m.Payload = whole
+	return err
+}
+
+// Assembler reassembles the payloads of calls which are sent as chunk frames on one connection.
+// It is used by the reader of the connection and is not safe for concurrent use.
+type Assembler struct {
+	// MaxSize returns the max payload size of the call whose first chunk is m. Zero means no limit.
+	MaxSize func(m *Message) int
+	// Writer returns the writer which the payload of the call whose first chunk is m is written to
+	// instead of being buffered. It may return nil.
+	Writer func(m *Message) io.Writer
+	// MaxAssemblies is the max number of calls reassembled at the same time, including canceled calls
+	// whose last frames have not arrived. Zero means no limit.
+	MaxAssemblies int
+
+	parts map[uint64]*assembly
+}
+
+type assembly struct {
+	buf   []byte
+	w     io.Writer
+	size  int
+	limit int
+	err   error
+}
+
+// Add adds the chunk frame m.
+// It returns an error the first time the call fails, and the following frames of the call are dropped.
+func (a *Assembler) Add(m *Message) error {
+	if a.parts == nil {
+		a.parts = make(map[uint64]*assembly)
+	}
+
+	p := a.parts[m.Seq()]
+	if p == nil {
+		if a.MaxAssemblies > 0 && len(a.parts) >= a.MaxAssemblies {
+			return ErrTooManyAssemblies
+		}
+		p = &assembly{}
+		if a.MaxSize != nil {
+			p.limit = a.MaxSize(m)
+		}
+		if a.Writer != nil {
+			p.w = a.Writer(m)
+		}
+		a.parts[m.Seq()] = p
+	}
+	if p.err != nil {
+		return nil
+	}
+	return p.add(m.Payload)
+}
+
+// Complete sets the whole payload to the call m which follows its chunk frames.
+// If the payload has been written to a writer, m.Payload is empty.
+// It returns ErrMessageDropped if the call has failed or been canceled before, and m should be dropped.
+// Calls without chunk frames and other frames are not changed.
+func (a *Assembler) Complete(m *Message) error {
+	if m.FrameType() != FrameCall {
+		return nil
+	}
+	p := a.parts[m.Seq()]
+	if p == nil {
+		return nil
+	}
+	delete(a.parts, m.Seq())
+
+	if p.err != nil {
+		return ErrMessageDropped
+	}
+	if err := p.add(m.Payload); err != nil {
+		return err
+	}
+	if p.w != nil {
+		m.Payload = m.Payload[:0:0]
+		return nil
+	}
+	m.Payload = p.buf
+	return nil
+}
+
+// Cancel drops the payload of the call of seq canceled by the sender.
+// The call is kept without its payload until its last frame arrives, so that its following frames are dropped too.
+func (a *Assembler) Cancel(seq uint64) {
+	if p := a.parts[seq]; p != nil {
+		p.buf = nil
+		p.err = ErrMessageDropped
+	}
+}
+
+// Discard drops the call of m which can't be decoded, for example because of ErrChecksumMismatch.
+// If m is a chunk frame, the following frames of the call are dropped too.
+func (a *Assembler) Discard(m *Message) {
+	if m.FrameType() != FrameChunk {
+		delete(a.parts, m.Seq())
+		return
+	}
+
+	if a.parts == nil {
+		a.parts = make(map[uint64]*assembly)
+	}
+	a.parts[m.Seq()] = &assembly{err: ErrMessageDropped}
+}
+
+func (p *assembly) add(data []byte) error {
+	p.size += len(data)
+	if p.limit > 0 && p.size > p.limit {
+		p.err = ErrPayloadTooLarge
+		p.buf = nil
+		return p.err
+	}
+
+	if p.w != nil {
+		if _, err := p.w.Write(data); err != nil {
+			p.err = err
+			return err
+		}
+		return nil
+	}
+	p.buf = append(p.buf, data...)
+	return nil
+}
@@ -0,0 +1,159 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+// Version2 is the protocol version whose messages carry an extension block.
+// Messages with a lower version are encoded in the v1 format, and their extensions are dropped.
+const Version2 byte = 2
+
+// ExtensionType identifies an extension field.
+// Extensions with unknown types are kept in Message.Extensions and ignored.
+// Types below 128 are defined by irpc, and the others are left to applications.
+type ExtensionType byte
+
+// The extension types defined by irpc.
+const (
+	// ExtDeadline is the time left to handle a request in milliseconds, as an 8-byte big endian integer.
+	// It is relative, so that the clocks of clients and servers don't need to agree. See Message.SetDeadline.
+	ExtDeadline ExtensionType = iota + 1
+	// ExtPriority is the priority of a request as a signed byte. See Message.SetPriority.
+	ExtPriority
+)
+
+// MaxExtensionLength is the max length of the value of an extension.
+const MaxExtensionLength = 1<<16 - 1
+
+var (
+	// ErrExtensionTooLong the value of an extension is longer than MaxExtensionLength.
+	ErrExtensionTooLong = errors.New("extension is too long")
+	// ErrExtensionMissing the extension block is truncated.
+	ErrExtensionMissing = errors.New("wrong extension block. some types or values are missing")
+)
+
+// Extension is a typed field in the extension block of a v2 message.
+// It is encoded as type(1 byte), length(2 bytes) and value.
+type Extension struct {
+	Type  ExtensionType
+	Value []byte
+}
+
+// Extension returns the value of the extension t.
+// The value of a decoded message refers to the message buffer, so copy it to keep it after the message is freed.
+func (m *Message) Extension(t ExtensionType) ([]byte, bool) {
+	for _, ext := range m.Extensions {
+		if ext.Type == t {
+			return ext.Value, true
+		}
+	}
+	return nil, false
+}
+
+// SetExtension sets the value of the extension t, replacing the old one.
+func (m *Message) SetExtension(t ExtensionType, v []byte) error {
+	if len(v) > MaxExtensionLength {
+		return ErrExtensionTooLong
+	}
+
+	for i := range m.Extensions {
+		if m.Extensions[i].Type == t {
+			m.Extensions[i].Value = v
+			return nil
+		}
+	}
+	m.Extensions = append(m.Extensions, Extension{Type: t, Value: v})
+	return nil
+}
+
+// DelExtension deletes the extension t.
+func (m *Message) DelExtension(t ExtensionType) {
+	for i := range m.Extensions {
+		if m.Extensions[i].Type == t {
+			m.Extensions = append(m.Extensions[:i], m.Extensions[i+1:]...)
+			return
+		}
+	}
+}
+
+// SetDeadline sets the ExtDeadline extension to the time left to handle the request, which is at least 0.
+func (m *Message) SetDeadline(left time.Duration) {
+	if left < 0 {
+		left = 0
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(left.Milliseconds()))
+	_ = m.SetExtension(ExtDeadline, v)
+}
+
+// Deadline returns the time left to handle the request in the ExtDeadline extension.
+func (m *Message) Deadline() (time.Duration, bool) {
+	v, ok := m.Extension(ExtDeadline)
+	if !ok || len(v) != 8 {
+		return 0, false
+	}
+	ms := binary.BigEndian.Uint64(v)
+	if ms > uint64(1<<63-1)/uint64(time.Millisecond) {
+		ms = uint64(1<<63-1) / uint64(time.Millisecond)
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// SetPriority sets the ExtPriority extension, which is clamped to the range of a signed byte.
+func (m *Message) SetPriority(priority int) {
+	if priority < -128 {
+		priority = -128
+	} else if priority > 127 {
+		priority = 127
+	}
+	_ = m.SetExtension(ExtPriority, []byte{byte(int8(priority))})
+}
+
+// Priority returns the priority in the ExtPriority extension.
+func (m *Message) Priority() (int, bool) {
+	v, ok := m.Extension(ExtPriority)
+	if !ok || len(v) != 1 {
+		return 0, false
+	}
+	return int(int8(v[0])), true
+}
+
+// type,len,value,type,len,value......
+// Extensions longer than MaxExtensionLength are skipped.
+func encodeExtensions(exts []Extension, bb *bytebufferpool.ByteBuffer) {
+	var d [3]byte
+	for _, ext := range exts {
+		if len(ext.Value) > MaxExtensionLength {
+			continue
+		}
+		d[0] = byte(ext.Type)
+		binary.BigEndian.PutUint16(d[1:], uint16(len(ext.Value)))
+		_, _ = bb.Write(d[:])
+		_, _ = bb.Write(ext.Value)
+	}
+}
+
+// decodeExtensions appends the extensions in data to exts.
+// The values refer to data.
+func decodeExtensions(exts []Extension, data []byte) ([]Extension, error) {
+	n := 0
+	for n < len(data) {
+		if n+3 > len(data) {
+			return exts, ErrExtensionMissing
+		}
+		t := ExtensionType(data[n])
+		l := int(binary.BigEndian.Uint16(data[n+1 : n+3]))
+		n = n + 3
+		if n+l > len(data) {
+			return exts, ErrExtensionMissing
+		}
+		exts = append(exts, Extension{Type: t, Value: data[n : n+l : n+l]})
+		n = n + l
+	}
+
+	return exts, nil
+}
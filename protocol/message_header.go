@@ -89,6 +89,30 @@ func (h *Header) SetSerializeType(st SerializeType) {
 	h[3] = (h[3] &^ 0xF0) | (byte(st) << 4)
 }
 
+// HasChecksum returns whether the message ends with a CRC32C checksum.
+func (h Header) HasChecksum() bool {
+	return h[3]&0x08 == 0x08
+}
+
+// SetChecksum sets the checksum flag.
+func (h *Header) SetChecksum(checksum bool) {
+	if checksum {
+		h[3] = h[3] | 0x08
+	} else {
+		h[3] = h[3] &^ 0x08
+	}
+}
+
+// FrameType returns the frame type of this message.
+func (h Header) FrameType() FrameType {
+	return FrameType(h[3] & 0x07)
+}
+
+// SetFrameType sets the frame type.
+func (h *Header) SetFrameType(ft FrameType) {
+	h[3] = (h[3] &^ 0x07) | (byte(ft) & 0x07)
+}
+
 // Seq returns sequence number of messages.
 func (h Header) Seq() uint64 {
 	return binary.BigEndian.Uint64(h[4:])
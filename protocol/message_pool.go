@@ -19,8 +19,13 @@ func GetPooledMsg() *Message {
 }
 
 // FreeMsg puts a msg into the pool.
+// The buffer of a message decoded by DecodeZeroCopy is put back into its pool too.
 func FreeMsg(msg *Message) {
-	if msg != nil && cap(msg.data) < 1024 {
+	if msg == nil {
+		return
+	}
+	msg.releaseBuffer()
+	if cap(msg.data) < 1024 {
 		msg.Reset()
 		msgPool.Put(msg)
 	}
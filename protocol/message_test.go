@@ -1,6 +1,14 @@
 package protocol
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
 
 // @Author: Derek
 // @Description:
@@ -8,5 +16,458 @@ import "testing"
 // @Version 1.0
 
 func Test_MaxMessageLength(t *testing.T) {
+	defer func(l int) { MaxMessageLength = l }(MaxMessageLength)
 	MaxMessageLength = 1
 }
+
+func newTestMessage(version byte) *Message {
+	req := NewMessage()
+	req.SetVersion(version)
+	req.SetMessageType(Request)
+	req.SetSerializeType(JSON)
+	req.SetSeq(1234567890)
+	req.ServicePath = "Arith"
+	req.ServiceMethod = "Add"
+	req.Metadata = map[string]string{"__ID": "6ba7b810-9dad-11d1-80b4-00c04fd430c9"}
+	req.Payload = []byte(`{"A":1,"B":2}`)
+	_ = req.SetExtension(128, []byte{0, 0, 0, 1})
+	_ = req.SetExtension(200, []byte("unknown"))
+	return req
+}
+
+func TestMessageV2Extensions(t *testing.T) {
+	req := newTestMessage(Version2)
+
+	for _, data := range [][]byte{req.Encode(), writeToBytes(t, req)} {
+		res := NewMessage()
+		if err := res.Decode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+		if res.ServicePath != "Arith" || res.ServiceMethod != "Add" || res.Metadata["__ID"] != req.Metadata["__ID"] || string(res.Payload) != string(req.Payload) {
+			t.Fatalf("decoded wrong message: %+v", res)
+		}
+		if v, ok := res.Extension(128); !ok || !bytes.Equal(v, []byte{0, 0, 0, 1}) {
+			t.Fatalf("expect extension 128, got %v", v)
+		}
+		if v, ok := res.Extension(200); !ok || string(v) != "unknown" {
+			t.Fatalf("expect extension 200, got %v", v)
+		}
+	}
+}
+
+func TestMessageTypedExtensions(t *testing.T) {
+	req := newTestMessage(Version2)
+	req.SetDeadline(1500 * time.Millisecond)
+	req.SetPriority(-3)
+
+	res := NewMessage()
+	if err := res.Decode(bytes.NewReader(req.Encode())); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if left, ok := res.Deadline(); !ok || left != 1500*time.Millisecond {
+		t.Fatalf("expect deadline 1.5s, got %v", left)
+	}
+	if priority, ok := res.Priority(); !ok || priority != -3 {
+		t.Fatalf("expect priority -3, got %d", priority)
+	}
+
+	// a passed deadline is sent as no time left, and priorities are bounded
+	req.SetDeadline(-time.Second)
+	req.SetPriority(1000)
+	if left, _ := req.Deadline(); left != 0 {
+		t.Fatalf("expect no time left, got %v", left)
+	}
+	if priority, _ := req.Priority(); priority != 127 {
+		t.Fatalf("expect priority 127, got %d", priority)
+	}
+
+	// malformed values are ignored
+	_ = req.SetExtension(ExtDeadline, []byte{1})
+	if _, ok := req.Deadline(); ok {
+		t.Fatal("expect no deadline")
+	}
+}
+
+func TestMessageV1Compatible(t *testing.T) {
+	req := newTestMessage(0)
+	data := req.Encode()
+
+	// the v1 layout: servicePath follows totalLen directly
+	if l := binary.BigEndian.Uint32(data[16:20]); l != uint32(len("Arith")) {
+		t.Fatalf("expect v1 layout, servicePath length is %d", l)
+	}
+
+	res := NewMessage()
+	if err := res.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if res.ServiceMethod != "Add" || string(res.Payload) != string(req.Payload) {
+		t.Fatalf("decoded wrong message: %+v", res)
+	}
+	if len(res.Extensions) != 0 {
+		t.Fatalf("expect no extensions in v1 message, got %v", res.Extensions)
+	}
+}
+
+func TestMessageV2TruncatedExtensions(t *testing.T) {
+	data := newTestMessage(Version2).Encode()
+	// claim an extension longer than the block
+	binary.BigEndian.PutUint16(data[21:23], 1000)
+
+	res := NewMessage()
+	if err := res.Decode(bytes.NewReader(data)); err != ErrExtensionMissing {
+		t.Fatalf("expect ErrExtensionMissing, got %v", err)
+	}
+}
+
+func TestMessageTruncatedFields(t *testing.T) {
+	for _, version := range []byte{0, Version2} {
+		data := newTestMessage(version).Encode()
+		const prefixLen = 16
+		body := data[prefixLen:]
+		// the payload is the rest of the message, so only cuts before it are errors
+		payloadAt := len(body) - len(`{"A":1,"B":2}`)
+
+		for cut := 0; cut < len(body); cut++ {
+			frame := append([]byte{}, data[:prefixLen]...)
+			binary.BigEndian.PutUint32(frame[12:], uint32(cut))
+			frame = append(frame, body[:cut]...)
+
+			for _, zeroCopy := range []bool{false, true} {
+				res := NewMessage()
+				err := res.decode(bytes.NewReader(frame), zeroCopy)
+				if cut < payloadAt && err == nil {
+					t.Fatalf("v%d: expect an error for a frame cut at %d", version, cut)
+				}
+				FreeMsg(res)
+			}
+		}
+	}
+
+	// a servicePath longer than the message
+	data := newTestMessage(0).Encode()
+	binary.BigEndian.PutUint32(data[16:], 1000)
+	if err := NewMessage().Decode(bytes.NewReader(data)); err != ErrMessageTruncated {
+		t.Fatalf("expect ErrMessageTruncated, got %v", err)
+	}
+
+	// a metadata key longer than the metadata
+	if _, err := decodeMetadata([]byte{0, 0, 0, 9, 'k', 0, 0, 0, 0}); err != ErrMetaKVMissing {
+		t.Fatalf("expect ErrMetaKVMissing, got %v", err)
+	}
+	if err := decodeMetadataZeroCopy(map[string]string{}, []byte{0, 0, 0, 1, 'k', 0, 0}); err != ErrMetaKVMissing {
+		t.Fatalf("expect ErrMetaKVMissing, got %v", err)
+	}
+}
+
+func writeToBytes(t *testing.T, m *Message) []byte {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFrameSize(t *testing.T) {
+	data := newTestMessage(Version2).Encode()
+
+	for i := 0; i < 16; i++ {
+		if n, err := FrameSize(data[:i]); n != 0 || err != nil {
+			t.Fatalf("expect an unknown size of %d bytes, got %d, %v", i, n, err)
+		}
+	}
+	if n, err := FrameSize(append(data, data...)); n != len(data) || err != nil {
+		t.Fatalf("expect %d, got %d, %v", len(data), n, err)
+	}
+	if _, err := FrameSize([]byte{0}); err == nil {
+		t.Fatal("expect an error of the wrong magic number")
+	}
+
+	defer func(l int) { MaxMessageLength = l }(MaxMessageLength)
+	MaxMessageLength = 8
+	if _, err := FrameSize(data); err != ErrMessageTooLong {
+		t.Fatalf("expect ErrMessageTooLong, got %v", err)
+	}
+}
+
+func TestMessageChunks(t *testing.T) {
+	req := newTestMessage(Version2)
+	req.SetCompressType(Gzip)
+	req.Payload = bytes.Repeat([]byte("0123456789"), 1000)
+
+	var frames [][]byte
+	err := req.EncodeChunks(3000, func(data *[]byte) error {
+		frames = append(frames, append([]byte(nil), *data...))
+		PutData(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to encode chunks: %v", err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("expect 4 frames, got %d", len(frames))
+	}
+
+	decode := func(a *Assembler) (*Message, error) {
+		for _, frame := range frames {
+			m := NewMessage()
+			if err := m.Decode(bytes.NewReader(frame)); err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if m.FrameType() == FrameChunk {
+				if err := a.Add(m); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return m, a.Complete(m)
+		}
+		return nil, nil
+	}
+
+	res, err := decode(&Assembler{})
+	if err != nil {
+		t.Fatalf("failed to reassemble: %v", err)
+	}
+	if res.ServiceMethod != "Add" || !bytes.Equal(res.Payload, req.Payload) {
+		t.Fatalf("reassembled wrong message: %s.%s with %d bytes", res.ServicePath, res.ServiceMethod, len(res.Payload))
+	}
+
+	var buf bytes.Buffer
+	res, err = decode(&Assembler{Writer: func(m *Message) io.Writer { return &buf }})
+	if err != nil || len(res.Payload) != 0 || !bytes.Equal(buf.Bytes(), req.Payload) {
+		t.Fatalf("failed to write the payload to the writer: %v", err)
+	}
+
+	a := &Assembler{MaxSize: func(m *Message) int { return 5000 }}
+	if _, err = decode(a); err != ErrPayloadTooLarge {
+		t.Fatalf("expect ErrPayloadTooLarge, got %v", err)
+	}
+	last := NewMessage()
+	_ = last.Decode(bytes.NewReader(frames[len(frames)-1]))
+	if err = a.Complete(last); err != ErrMessageDropped {
+		t.Fatalf("expect ErrMessageDropped, got %v", err)
+	}
+
+	// a canceled call drops its chunks and its last frame
+	a = &Assembler{MaxAssemblies: 1}
+	first := NewMessage()
+	_ = first.Decode(bytes.NewReader(frames[0]))
+	if err = a.Add(first); err != nil {
+		t.Fatalf("failed to add a chunk: %v", err)
+	}
+	a.Cancel(first.Seq())
+	if len(a.parts[first.Seq()].buf) != 0 {
+		t.Fatal("expect the payload of the canceled call to be dropped")
+	}
+	if err = a.Add(first); err != nil {
+		t.Fatalf("expect the chunks of the canceled call to be dropped, got %v", err)
+	}
+
+	// and it counts until its last frame arrives
+	other := NewMessage()
+	_ = other.Decode(bytes.NewReader(frames[0]))
+	other.SetSeq(first.Seq() + 1)
+	if err = a.Add(other); err != ErrTooManyAssemblies {
+		t.Fatalf("expect ErrTooManyAssemblies, got %v", err)
+	}
+	if err = a.Complete(last); err != ErrMessageDropped {
+		t.Fatalf("expect ErrMessageDropped, got %v", err)
+	}
+	if err = a.Add(other); err != nil {
+		t.Fatalf("failed to add a chunk: %v", err)
+	}
+}
+
+func TestMessageChecksum(t *testing.T) {
+	req := newTestMessage(Version2)
+	req.SetChecksum(true)
+
+	for _, data := range [][]byte{req.Encode(), writeToBytes(t, req)} {
+		corrupted := append([]byte(nil), data...)
+		corrupted[len(corrupted)-10] ^= 0x01
+
+		// the corrupted message is read completely, so the next one can still be decoded.
+		r := bytes.NewReader(append(corrupted, data...))
+		res := NewMessage()
+		if err := res.Decode(r); err != ErrChecksumMismatch {
+			t.Fatalf("expect ErrChecksumMismatch, got %v", err)
+		}
+		if res.Seq() != req.Seq() {
+			t.Fatalf("expect seq %d, got %d", req.Seq(), res.Seq())
+		}
+
+		res = NewMessage()
+		if err := res.Decode(r); err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+		if !res.HasChecksum() || string(res.Payload) != string(req.Payload) {
+			t.Fatalf("decoded wrong message: %+v", res)
+		}
+	}
+}
+
+func TestCompressors(t *testing.T) {
+	data := bytes.Repeat([]byte(`{"A":1,"B":2,"C":"compressible"}`), 100)
+	// trained by zstd --train on small JSON objects
+	dict, err := ioutil.ReadFile("testdata/zstd.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, c := range map[string]Compressor{
+		"gzip":      Compressors[Gzip],
+		"snappy":    Compressors[Snappy],
+		"zstd":      Compressors[Zstd],
+		"lz4":       Compressors[LZ4],
+		"zstd-dict": &ZstdCompressor{Dict: dict},
+	} {
+		zipped, err := c.Zip(data)
+		if err != nil {
+			t.Fatalf("%s: failed to zip: %v", name, err)
+		}
+		if len(zipped) >= len(data) {
+			t.Errorf("%s: expect compressed data, got %d bytes from %d bytes", name, len(zipped), len(data))
+		}
+
+		// make sure pooled state doesn't leak into later calls
+		for i := 0; i < 3; i++ {
+			unzipped, err := c.Unzip(zipped)
+			if err != nil {
+				t.Fatalf("%s: failed to unzip: %v", name, err)
+			}
+			if !bytes.Equal(unzipped, data) {
+				t.Fatalf("%s: unzipped data mismatch", name)
+			}
+		}
+	}
+}
+
+func TestZstdMaxMemory(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 4096)
+	zipped, err := Compressors[Zstd].Zip(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	MaxMessageLength = 1024
+	defer func() { MaxMessageLength = 0 }()
+	if _, err := (&ZstdCompressor{}).Unzip(zipped); err == nil {
+		t.Fatal("expect payloads longer than MaxMessageLength to fail")
+	}
+
+}
+
+func TestRegisterZstdDict(t *testing.T) {
+	dict, err := ioutil.ReadFile("testdata/zstd.dict")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstd := Compressors[Zstd]
+	defer RegisterCompressor(Zstd, zstd)
+
+	RegisterZstdDict(dict)
+	if c, ok := Compressors[Zstd].(*ZstdCompressor); !ok || !bytes.Equal(c.Dict, dict) {
+		t.Fatalf("expect a zstd compressor with the dictionary, got %v", Compressors[Zstd])
+	}
+}
+
+func TestMessageDecodeZeroCopy(t *testing.T) {
+	for _, version := range []byte{0, Version2} {
+		req := newTestMessage(version)
+		req.SetChecksum(true)
+		data := req.Encode()
+
+		res := GetPooledMsg()
+		for i := 0; i < 3; i++ {
+			if err := res.DecodeZeroCopy(bytes.NewReader(data)); err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			if res.ServicePath != req.ServicePath || res.ServiceMethod != req.ServiceMethod ||
+				string(res.Payload) != string(req.Payload) || len(res.Metadata) != 1 ||
+				res.Metadata["__ID"] != req.Metadata["__ID"] {
+				t.Fatalf("decoded wrong message: %+v", res)
+			}
+			if res.buf == nil {
+				t.Fatal("expect a pooled buffer")
+			}
+			meta := res.Metadata
+
+			FreeMsg(res)
+			if res.buf != nil || len(meta) != 0 {
+				t.Fatal("expect the buffer to be released")
+			}
+			res = GetPooledMsg()
+		}
+		FreeMsg(res)
+	}
+}
+
+func benchmarkDecode(b *testing.B, decode func(m *Message, r io.Reader) error) {
+	data := newTestMessage(Version2).Encode()
+	r := bytes.NewReader(data)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		m := GetPooledMsg()
+		if err := decode(m, r); err != nil {
+			b.Fatal(err)
+		}
+		FreeMsg(m)
+	}
+}
+
+func BenchmarkMessage_Decode(b *testing.B) {
+	benchmarkDecode(b, (*Message).Decode)
+}
+
+func BenchmarkMessage_DecodeZeroCopy(b *testing.B) {
+	benchmarkDecode(b, (*Message).DecodeZeroCopy)
+}
+
+func TestBatchWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	queue := make(chan *[]byte, 100)
+	w := BatchWriter{MaxBatchBytes: 1024, MaxDelay: time.Millisecond, WriteTimeout: time.Second}
+	done := make(chan error, 1)
+	go func() { done <- w.Serve(conn, queue, nil) }()
+
+	var want []byte
+	for i := 0; i < 100; i++ {
+		req := newTestMessage(Version2)
+		req.SetSeq(uint64(i))
+		data := req.EncodeSlicePointer()
+		want = append(want, *data...)
+		queue <- data
+	}
+	close(queue)
+	if err = <-done; err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	_ = conn.Close()
+
+	got, err := ioutil.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("expect %d bytes in order, got %d bytes", len(want), len(got))
+	}
+}
@@ -12,6 +12,9 @@ type (
 
 	// SerializeType defines serialization type of payload.
 	SerializeType byte
+
+	// FrameType defines what a message carries on a multiplexed connection.
+	FrameType byte
 )
 
 // MessageType's constant.
@@ -36,6 +39,12 @@ const (
 	None CompressType = iota
 	// Gzip uses gzip compression.
 	Gzip
+	// Snappy uses snappy compression.
+	Snappy
+	// Zstd uses zstd compression.
+	Zstd
+	// LZ4 uses lz4 compression.
+	LZ4
 )
 
 // SerializeType's constant.
@@ -55,3 +64,26 @@ const (
 	// Thrift for payload.
 	Thrift
 )
+
+// FrameType's constant.
+const (
+	// FrameCall is a plain request or response.
+	FrameCall FrameType = iota
+	// FrameStream carries one message of a stream. The first FrameStream request of a seq opens the stream.
+	FrameStream
+	// FrameStreamEnd closes the sending side of a stream. It carries the error of the stream if any.
+	FrameStreamEnd
+	// FrameStreamWindow grants the peer of the stream with the same seq more FrameStream messages, see StreamWindow.
+	FrameStreamWindow
+	// FrameCancel is sent by clients to cancel the request or stream with the same seq.
+	FrameCancel
+	// FrameGoAway is sent by servers that are shutting down after they stop reading requests.
+	// Its payload lists the seqs of the requests and streams in flight as 8-byte big endian integers,
+	// which will still be answered. Other requests will not be handled and can be retried on another server.
+	FrameGoAway
+	// FrameChunk carries a part of the payload of the call with the same seq.
+	// The call itself carries the last part and follows its chunk frames.
+	FrameChunk
+	// FrameHandshake is exchanged right after a client connects, see Handshake.
+	FrameHandshake
+)
@@ -0,0 +1,64 @@
+package protocol
+
+import (
+	"io"
+
+	"github.com/derekAHua/irpc/util"
+)
+
+// frameBufferPool pools the frame buffers of DecodeZeroCopy. Larger frames are not pooled.
+var frameBufferPool = util.NewLimitedPool(512, 1<<20)
+
+// DecodeZeroCopy decodes a message from a reader like Decode, but reads the frame into a pooled buffer
+// and references servicePath, serviceMethod, metadata, extensions and payload in it without copying.
+// The metadata map is reused by the message too.
+//
+// They are only valid until the message is freed by FreeMsg, which puts the buffer back into the pool,
+// so nothing of the message can be retained after that.
+func (m *Message) DecodeZeroCopy(r io.Reader) error {
+	return m.decode(r, true)
+}
+
+// getBuffer gets a pooled buffer of n bytes for the frame.
+func (m *Message) getBuffer(n int) []byte {
+	m.releaseBuffer()
+	m.buf = frameBufferPool.Get(n)
+	return *m.buf
+}
+
+// releaseBuffer puts the frame buffer back into the pool and clears the metadata referencing it.
+func (m *Message) releaseBuffer() {
+	if m.buf == nil {
+		return
+	}
+	frameBufferPool.Put(m.buf)
+	m.buf = nil
+	for k := range m.meta {
+		delete(m.meta, k)
+	}
+}
+
+// getMetadata returns the reused metadata map.
+func (m *Message) getMetadata() map[string]string {
+	if m.meta == nil {
+		m.meta = make(map[string]string, 10)
+	}
+	m.Metadata = m.meta
+	return m.meta
+}
+
+// decodeMetadataZeroCopy decodes metadata into m, and keys and values reference data.
+func decodeMetadataZeroCopy(m map[string]string, data []byte) error {
+	var k, v []byte
+	for n, ok := 0, true; n < len(data); {
+		if k, n, ok = nextField(data, n); !ok {
+			return ErrMetaKVMissing
+		}
+		if v, n, ok = nextField(data, n); !ok {
+			return ErrMetaKVMissing
+		}
+		m[util.SliceByteToString(k)] = util.SliceByteToString(v)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// ErrStreamOverflow the peer of a stream has sent more messages than it was granted.
+var ErrStreamOverflow = errors.New("stream window is exceeded")
+
+// StreamWindow is the number of FrameStream messages one side of a stream may still send.
+// A stream starts with an empty window in each direction, and the receiving side grants its buffer size
+// by a FrameStreamWindow frame when the stream opens and more as it consumes the messages,
+// so that the reader of a connection never waits for a slow stream.
+type StreamWindow struct {
+	mu   sync.Mutex
+	n    int
+	wait chan struct{}
+}
+
+// Add grants n more messages.
+func (w *StreamWindow) Add(n int) {
+	w.mu.Lock()
+	w.n += n
+	if w.wait != nil {
+		close(w.wait)
+		w.wait = nil
+	}
+	w.mu.Unlock()
+}
+
+// Take takes a message from the window, waiting until one is granted.
+// It returns false if done is closed first.
+func (w *StreamWindow) Take(done <-chan struct{}) bool {
+	for {
+		w.mu.Lock()
+		if w.n > 0 {
+			w.n--
+			w.mu.Unlock()
+			return true
+		}
+		if w.wait == nil {
+			w.wait = make(chan struct{})
+		}
+		wait := w.wait
+		w.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// SetStreamWindow makes m a FrameStreamWindow frame granting n messages.
+func (m *Message) SetStreamWindow(n int) {
+	m.SetFrameType(FrameStreamWindow)
+	m.Payload = make([]byte, 4)
+	binary.BigEndian.PutUint32(m.Payload, uint32(n))
+}
+
+// StreamWindowSize returns the number of messages granted by the FrameStreamWindow frame m.
+func (m *Message) StreamWindowSize() int {
+	if len(m.Payload) < 4 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint32(m.Payload))
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AdaptiveLimitConfig configures the adaptive limits of in-flight requests set by WithAdaptiveLimit.
+// Zero fields use the defaults.
+type AdaptiveLimitConfig struct {
+	// InitialLimit is the limit of a method before its latency is measured. The default is 20.
+	InitialLimit int
+	// MinLimit and MaxLimit bound the limit. The defaults are 1 and 1000.
+	MinLimit int
+	MaxLimit int
+	// Tolerance is how many times of the long-term latency the recent latency can be
+	// before the limit is decreased. The default is 1.5.
+	Tolerance float64
+	// Smoothing is the weight of a new estimate of the limit, from 0 to 1. The default is 0.2.
+	Smoothing float64
+	// LongWindow is the number of requests the long-term latency is averaged over. The default is 600.
+	LongWindow int
+}
+
+func (c AdaptiveLimitConfig) withDefaults() AdaptiveLimitConfig {
+	if c.InitialLimit <= 0 {
+		c.InitialLimit = 20
+	}
+	if c.MinLimit <= 0 {
+		c.MinLimit = 1
+	}
+	if c.MaxLimit <= 0 {
+		c.MaxLimit = 1000
+	}
+	if c.MaxLimit < c.MinLimit {
+		c.MaxLimit = c.MinLimit
+	}
+	if c.Tolerance < 1 {
+		c.Tolerance = 1.5
+	}
+	if c.Smoothing <= 0 || c.Smoothing > 1 {
+		c.Smoothing = 0.2
+	}
+	if c.LongWindow <= 0 {
+		c.LongWindow = 600
+	}
+	return c
+}
+
+// AdaptiveLimitStats is the state of the adaptive limit of a method.
+type AdaptiveLimitStats struct {
+	Limit    int
+	InFlight int
+	// Rejected is the number of requests rejected because the limit was reached.
+	Rejected uint64
+}
+
+// adaptiveLimiter keeps an adaptive limit per service method.
+type adaptiveLimiter struct {
+	config AdaptiveLimitConfig
+	limits sync.Map // "Service.Method" -> *adaptiveLimit
+}
+
+func newAdaptiveLimiter(config AdaptiveLimitConfig) *adaptiveLimiter {
+	return &adaptiveLimiter{config: config.withDefaults()}
+}
+
+func (l *adaptiveLimiter) get(serviceMethod string) *adaptiveLimit {
+	if v, ok := l.limits.Load(serviceMethod); ok {
+		return v.(*adaptiveLimit)
+	}
+	v, _ := l.limits.LoadOrStore(serviceMethod, &adaptiveLimit{
+		config: &l.config,
+		limit:  float64(l.config.InitialLimit),
+	})
+	return v.(*adaptiveLimit)
+}
+
+// adaptiveLimit is a gradient concurrency limit, which compares the latency of each request
+// with the long-term average latency. The limit grows while the latency stays near the average,
+// and it shrinks when requests queue up somewhere and the latency rises.
+type adaptiveLimit struct {
+	config *AdaptiveLimitConfig
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// longRTT is the exponential moving average of the latency in nanoseconds.
+	longRTT  float64
+	rejected uint64
+}
+
+// acquire admits a request, and returns false if the in-flight requests have reached the limit.
+func (a *adaptiveLimit) acquire() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.inFlight >= int(a.limit) {
+		a.rejected++
+		return false
+	}
+	a.inFlight++
+	return true
+}
+
+// release finishes an admitted request, and adapts the limit to its latency rtt.
+func (a *adaptiveLimit) release(rtt time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// the requests in flight when this one was handled, including itself
+	inFlight := a.inFlight
+	a.inFlight--
+	if rtt <= 0 {
+		return
+	}
+
+	c := a.config
+	shortRTT := float64(rtt)
+	if a.longRTT == 0 {
+		a.longRTT = shortRTT
+		return
+	}
+	a.longRTT += (shortRTT - a.longRTT) / float64(c.LongWindow)
+	// recover fast after the latency drops, so that the old latency doesn't allow too much queueing
+	if a.longRTT/shortRTT > 2 {
+		a.longRTT *= 0.95
+	}
+
+	// the limit is not grown if it is not used
+	if float64(inFlight) < a.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, c.Tolerance*a.longRTT/shortRTT))
+	// allow a few queued requests to probe for a higher limit
+	queueSize := math.Sqrt(a.limit)
+	limit := a.limit*gradient + queueSize
+	limit = a.limit*(1-c.Smoothing) + limit*c.Smoothing
+	a.limit = math.Max(float64(c.MinLimit), math.Min(float64(c.MaxLimit), limit))
+}
+
+func (a *adaptiveLimit) stats() AdaptiveLimitStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return AdaptiveLimitStats{Limit: int(a.limit), InFlight: a.inFlight, Rejected: a.rejected}
+}
+
+// AdaptiveLimits returns the adaptive limits of the registered methods which have been called,
+// keyed by "Service.Method". It returns nil if WithAdaptiveLimit is not set.
+func (s *Server) AdaptiveLimits() map[string]AdaptiveLimitStats {
+	if s.adaptiveLimiter == nil {
+		return nil
+	}
+	stats := make(map[string]AdaptiveLimitStats)
+	s.adaptiveLimiter.limits.Range(func(k, v interface{}) bool {
+		stats[k.(string)] = v.(*adaptiveLimit).stats()
+		return true
+	})
+	return stats
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// saturate keeps the limit full and releases the requests with latency rtt.
+func saturate(a *adaptiveLimit, rtt time.Duration, rounds int) {
+	for i := 0; i < rounds; i++ {
+		n := 0
+		for a.acquire() {
+			n++
+		}
+		for ; n > 0; n-- {
+			a.release(rtt)
+		}
+	}
+}
+
+func TestAdaptiveLimit(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveLimitConfig{InitialLimit: 10, MaxLimit: 200, LongWindow: 1000})
+	a := l.get("Arith.Mul")
+	assert.Same(t, a, l.get("Arith.Mul"))
+
+	// the limit grows while the latency is steady
+	saturate(a, 10*time.Millisecond, 20)
+	grown := a.stats().Limit
+	assert.Greater(t, grown, 10)
+
+	// and shrinks when the latency rises, until the long-term latency catches up
+	saturate(a, 50*time.Millisecond, 2)
+	assert.Less(t, a.stats().Limit, grown/2)
+	assert.GreaterOrEqual(t, a.stats().Limit, 1)
+	assert.Equal(t, 0, a.stats().InFlight)
+	assert.Equal(t, uint64(22), a.stats().Rejected)
+
+	// an idle limit doesn't grow
+	limit := a.stats().Limit
+	for i := 0; i < 100; i++ {
+		assert.True(t, a.acquire())
+		a.release(time.Millisecond)
+	}
+	if limit > 2 {
+		assert.Equal(t, limit, a.stats().Limit)
+	}
+}
+
+func TestAdaptiveLimitRejects(t *testing.T) {
+	s, addr := startSleeperServer(t, "s", WithAdaptiveLimit(AdaptiveLimitConfig{InitialLimit: 2, MaxLimit: 2}))
+	defer func() { _ = s.Close() }()
+
+	errs := callSleepers(t, addr, 5, 200)
+	assert.Equal(t, 2, countErrors(errs, nil))
+	assert.Equal(t, 3, countErrors(errs, client.ErrServerOverloaded))
+
+	stats := s.AdaptiveLimits()["Sleeper.Sleep"]
+	assert.Equal(t, AdaptiveLimitStats{Limit: 2, InFlight: 0, Rejected: 3}, stats)
+
+	// unknown methods don't get limits
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr))
+	defer func() { _ = cli.Close() }()
+	for _, method := range []string{"Unknown1", "Unknown2"} {
+		assert.Error(t, cli.Call(context.Background(), "Sleeper", method, &Args{}, &Reply{}))
+	}
+	assert.Len(t, s.AdaptiveLimits(), 1)
+}
+
+func TestAdaptiveLimitBeforeHandlerPool(t *testing.T) {
+	recorder := &handlerQueueRecorder{}
+	s, addr := startSleeperServer(t, "s", WithHandlerPool(1, 10, 0),
+		WithAdaptiveLimit(AdaptiveLimitConfig{InitialLimit: 2, MaxLimit: 2}), func(s *Server) { s.Plugins.Add(recorder) })
+	defer func() { _ = s.Close() }()
+
+	// the requests over the limit are rejected before they are queued
+	errs := callSleepers(t, addr, 5, 100)
+	assert.Equal(t, 2, countErrors(errs, nil))
+	assert.Equal(t, 3, countErrors(errs, client.ErrServerOverloaded))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&recorder.queued))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&recorder.rejected))
+}
@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimit is a bulkhead of a service or a service method, which bounds how many of its requests
+// are handled concurrently, so that a slow method can't occupy all the resources of the server.
+type ConcurrencyLimit struct {
+	// MaxConcurrent is the number of requests handled concurrently. Zero or negative removes the limit.
+	MaxConcurrent int
+	// MaxQueue is the number of requests waiting for others to finish when MaxConcurrent is reached.
+	// Requests arriving when the queue is full are rejected with ErrServerOverloaded.
+	MaxQueue int
+	// MaxQueueWait is how long a request waits in the queue before it is rejected with ErrServerOverloaded.
+	// If it is zero, requests wait until they time out.
+	MaxQueueWait time.Duration
+}
+
+// ConcurrencyLimitStats is the state of a concurrency limit.
+type ConcurrencyLimitStats struct {
+	ConcurrencyLimit
+	InFlight int
+	Queued   int
+	// Rejected is the number of requests rejected because the queue was full or they waited too long.
+	Rejected uint64
+}
+
+// bulkhead admits at most limit.MaxConcurrent requests, and queues the others in FIFO order.
+type bulkhead struct {
+	mu       sync.Mutex
+	limit    ConcurrencyLimit
+	inFlight int
+	waiters  []chan struct{}
+	rejected uint64
+}
+
+// acquire admits a request, waiting in the queue until ctx is done or limit.MaxQueueWait passes.
+// It returns ErrServerOverloaded if the request is not admitted.
+func (b *bulkhead) acquire(ctx context.Context) error {
+	ready, err := b.enqueue()
+	if err != nil || ready == nil {
+		return err
+	}
+	return b.wait(ctx, ready)
+}
+
+// enqueue admits a request if there is room. Otherwise it queues the request and returns the channel
+// closed when the request is admitted, or ErrServerOverloaded if the queue is full.
+func (b *bulkhead) enqueue() (ready chan struct{}, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.inFlight < b.limit.MaxConcurrent && len(b.waiters) == 0 {
+		b.inFlight++
+		return nil, nil
+	}
+	if len(b.waiters) >= b.limit.MaxQueue {
+		b.rejected++
+		return nil, ErrServerOverloaded
+	}
+	ready = make(chan struct{})
+	b.waiters = append(b.waiters, ready)
+	return ready, nil
+}
+
+// wait waits for the request queued by enqueue until ctx is done or limit.MaxQueueWait passes.
+// It returns ErrServerOverloaded if the request is not admitted.
+func (b *bulkhead) wait(ctx context.Context, ready chan struct{}) error {
+	b.mu.Lock()
+	maxWait := b.limit.MaxQueueWait
+	b.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+	case <-timeout:
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, w := range b.waiters {
+		if w == ready {
+			b.waiters = append(b.waiters[:i], b.waiters[i+1:]...)
+			b.rejected++
+			return ErrServerOverloaded
+		}
+	}
+	// admitted while giving up
+	return nil
+}
+
+func (b *bulkhead) release() {
+	b.mu.Lock()
+	b.inFlight--
+	b.admit()
+	b.mu.Unlock()
+}
+
+// admit admits the queued requests while there is room. The caller must hold b.mu.
+func (b *bulkhead) admit() {
+	for len(b.waiters) > 0 && (b.limit.MaxConcurrent <= 0 || b.inFlight < b.limit.MaxConcurrent) {
+		close(b.waiters[0])
+		b.waiters[0] = nil
+		b.waiters = b.waiters[1:]
+		b.inFlight++
+	}
+}
+
+func (b *bulkhead) setLimit(limit ConcurrencyLimit) {
+	b.mu.Lock()
+	b.limit = limit
+	b.admit()
+	b.mu.Unlock()
+}
+
+func (b *bulkhead) stats() ConcurrencyLimitStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return ConcurrencyLimitStats{ConcurrencyLimit: b.limit, InFlight: b.inFlight, Queued: len(b.waiters), Rejected: b.rejected}
+}
+
+// concurrencyLimiter keeps the bulkheads of services and service methods.
+type concurrencyLimiter struct {
+	mu        sync.RWMutex
+	bulkheads map[string]*bulkhead // "Service" or "Service.Method" -> *bulkhead
+}
+
+func (l *concurrencyLimiter) set(name string, limit ConcurrencyLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bulkheads[name]
+	if limit.MaxConcurrent <= 0 {
+		if b != nil {
+			// admit the queued requests, and let the in-flight ones release the removed bulkhead
+			b.setLimit(limit)
+			delete(l.bulkheads, name)
+		}
+		return
+	}
+	if b == nil {
+		if l.bulkheads == nil {
+			l.bulkheads = make(map[string]*bulkhead)
+		}
+		l.bulkheads[name] = &bulkhead{limit: limit}
+		return
+	}
+	b.setLimit(limit)
+}
+
+func (l *concurrencyLimiter) get(servicePath, serviceMethod string) (service, method *bulkhead) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if len(l.bulkheads) == 0 {
+		return nil, nil
+	}
+	return l.bulkheads[servicePath], l.bulkheads[servicePath+"."+serviceMethod]
+}
+
+// admit admits a request to the bulkheads of its method and its service in this order, and then calls done
+// with the function releasing them, which is nil if there are no bulkheads, or with the error rejecting the request. A request queued by a bulkhead
+// waits in a goroutine of its own, so that it doesn't hold a handler or a worker meanwhile.
+func (l *concurrencyLimiter) admit(ctx context.Context, servicePath, serviceMethod string, done func(release func(), err error)) {
+	service, method := l.get(servicePath, serviceMethod)
+	if service == nil && method == nil {
+		done(nil, nil)
+		return
+	}
+	bulkheads := make([]*bulkhead, 0, 2)
+	if method != nil {
+		bulkheads = append(bulkheads, method)
+	}
+	if service != nil {
+		bulkheads = append(bulkheads, service)
+	}
+	release := func() { releaseAll(bulkheads) }
+
+	for i, b := range bulkheads {
+		ready, err := b.enqueue()
+		if err != nil {
+			releaseAll(bulkheads[:i])
+			done(nil, err)
+			return
+		}
+		if ready == nil {
+			continue
+		}
+
+		go func(i int) {
+			err := b.wait(ctx, ready)
+			admitted := i
+			if err == nil {
+				admitted++
+				for _, next := range bulkheads[admitted:] {
+					if err = next.acquire(ctx); err != nil {
+						break
+					}
+					admitted++
+				}
+			}
+			if err != nil {
+				releaseAll(bulkheads[:admitted])
+				done(nil, err)
+				return
+			}
+			done(release, nil)
+		}(i)
+		return
+	}
+	done(release, nil)
+}
+
+// releaseAll releases the admitted bulkheads in reverse order.
+func releaseAll(bulkheads []*bulkhead) {
+	for i := len(bulkheads) - 1; i >= 0; i-- {
+		bulkheads[i].release()
+	}
+}
+
+// SetConcurrencyLimit sets the concurrency limit of a service by its name, or of a service method by "Service.Method".
+// A request of a limited method in a limited service needs a place in both.
+// Limits can be set before or after the service is registered, and changed while the server is running:
+// a raised limit admits queued requests at once, and a lowered limit is reached as in-flight requests finish.
+// A limit with zero MaxConcurrent removes the limit.
+// Requests are admitted before they are queued by WithHandlerPool, and queued requests wait without holding workers.
+// Heartbeats and streams are not limited.
+func (s *Server) SetConcurrencyLimit(name string, limit ConcurrencyLimit) {
+	s.concurrencyLimiter.set(name, limit)
+}
+
+// ConcurrencyLimits returns the state of the concurrency limits by the names they are set with.
+func (s *Server) ConcurrencyLimits() map[string]ConcurrencyLimitStats {
+	l := &s.concurrencyLimiter
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := make(map[string]ConcurrencyLimitStats, len(l.bulkheads))
+	for name, b := range l.bulkheads {
+		stats[name] = b.stats()
+	}
+	return stats
+}
+
+// RegisterWithLimits is like Register but also sets the concurrency limits of the service by SetConcurrencyLimit,
+// before the service is advertised by the register plugins.
+// The keys of methodLimits are method names, and "" is the limit of the whole service.
+func (s *Server) RegisterWithLimits(receiver interface{}, metadata string, methodLimits map[string]ConcurrencyLimit) error {
+	serviceName, err := s.register(receiver, "", false)
+	if err != nil {
+		return err
+	}
+	s.setServiceLimits(serviceName, methodLimits)
+	return s.Plugins.DoRegister(serviceName, receiver, metadata)
+}
+
+// RegisterNameWithLimits is like RegisterName but also sets the concurrency limits of the service
+// as RegisterWithLimits does.
+func (s *Server) RegisterNameWithLimits(name string, receiver interface{}, metadata string, methodLimits map[string]ConcurrencyLimit) error {
+	if _, err := s.register(receiver, name, true); err != nil {
+		return err
+	}
+	s.setServiceLimits(name, methodLimits)
+	if s.Plugins == nil {
+		s.Plugins = &pluginContainer{}
+	}
+	return s.Plugins.DoRegister(name, receiver, metadata)
+}
+
+func (s *Server) setServiceLimits(serviceName string, methodLimits map[string]ConcurrencyLimit) {
+	for method, limit := range methodLimits {
+		name := serviceName
+		if method != "" {
+			name += "." + method
+		}
+		s.SetConcurrencyLimit(name, limit)
+	}
+}
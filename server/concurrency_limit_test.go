@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkhead(t *testing.T) {
+	b := &bulkhead{limit: ConcurrencyLimit{MaxConcurrent: 1, MaxQueue: 1, MaxQueueWait: 50 * time.Millisecond}}
+	ctx := context.Background()
+	assert.NoError(t, b.acquire(ctx))
+
+	// the queued request times out, and the queue is full meanwhile
+	done := make(chan error)
+	go func() { done <- b.acquire(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, ErrServerOverloaded, b.acquire(ctx))
+	assert.Equal(t, ErrServerOverloaded, <-done)
+
+	// the queued request is admitted when the in-flight one finishes
+	go func() { done <- b.acquire(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	b.release()
+	assert.NoError(t, <-done)
+
+	// and when the limit is raised
+	go func() { done <- b.acquire(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	b.setLimit(ConcurrencyLimit{MaxConcurrent: 2, MaxQueue: 1})
+	assert.NoError(t, <-done)
+
+	stats := b.stats()
+	assert.Equal(t, 2, stats.InFlight)
+	assert.Equal(t, 0, stats.Queued)
+	assert.Equal(t, uint64(2), stats.Rejected)
+
+	// a canceled request leaves the queue
+	cctx, cancel := context.WithCancel(ctx)
+	go func() { done <- b.acquire(cctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	assert.Equal(t, ErrServerOverloaded, <-done)
+	assert.Equal(t, 0, b.stats().Queued)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	s, addr := startSleeperServer(t, "s", WithConcurrencyLimits(map[string]ConcurrencyLimit{
+		"Sleeper.Sleep": {MaxConcurrent: 1, MaxQueue: 1},
+	}))
+	defer func() { _ = s.Close() }()
+
+	// one request is handled, one waits and the others are rejected
+	errs := callSleepers(t, addr, 4, 200)
+	assert.Equal(t, 2, countErrors(errs, nil))
+	assert.Equal(t, 2, countErrors(errs, client.ErrServerOverloaded))
+	// the bulkhead is released after the response is sent
+	assert.Eventually(t, func() bool { return s.ConcurrencyLimits()["Sleeper.Sleep"].InFlight == 0 }, time.Second, time.Millisecond)
+	assert.Equal(t, uint64(2), s.ConcurrencyLimits()["Sleeper.Sleep"].Rejected)
+
+	// limits are adjustable at runtime, and the service limit applies too
+	s.SetConcurrencyLimit("Sleeper.Sleep", ConcurrencyLimit{MaxConcurrent: 4})
+	s.SetConcurrencyLimit("Sleeper", ConcurrencyLimit{MaxConcurrent: 3})
+	errs = callSleepers(t, addr, 4, 200)
+	assert.Equal(t, 3, countErrors(errs, nil))
+	assert.Equal(t, 1, countErrors(errs, client.ErrServerOverloaded))
+
+	s.SetConcurrencyLimit("Sleeper", ConcurrencyLimit{})
+	errs = callSleepers(t, addr, 4, 100)
+	assert.Equal(t, 4, countErrors(errs, nil))
+	assert.Len(t, s.ConcurrencyLimits(), 1)
+}
+
+func TestConcurrencyLimitWithHandlerPool(t *testing.T) {
+	s, addr := startSleeperServer(t, "s", WithHandlerPool(2, 0, 0), WithConcurrencyLimits(map[string]ConcurrencyLimit{
+		"Sleeper.Sleep": {MaxConcurrent: 1, MaxQueue: 4},
+	}))
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr))
+	defer func() { _ = cli.Close() }()
+
+	// one slow request takes a worker, and the queued ones don't
+	calls := make([]*client.Call, 3)
+	for i := range calls {
+		calls[i] = cli.Go(context.Background(), "Sleeper", "Sleep", &Args{A: 100}, &Reply{}, nil)
+	}
+	assert.Eventually(t, func() bool { return s.ConcurrencyLimits()["Sleeper.Sleep"].Queued == 2 }, time.Second, time.Millisecond)
+
+	// so other methods still get the other worker
+	var name string
+	assert.NoError(t, cli.Call(context.Background(), "Sleeper", "Name", &Args{}, &name))
+	assert.Equal(t, "s", name)
+	for _, call := range calls {
+		assert.NoError(t, (<-call.Done).Error)
+	}
+}
+
+// limitsRecorder records the concurrency limits when services are registered.
+type limitsRecorder struct {
+	s      *Server
+	limits map[string]map[string]ConcurrencyLimitStats
+}
+
+func (r *limitsRecorder) Register(name string, _ interface{}, _ string) error {
+	r.limits[name] = r.s.ConcurrencyLimits()
+	return nil
+}
+
+func (r *limitsRecorder) Unregister(string) error { return nil }
+
+func TestRegisterWithLimits(t *testing.T) {
+	s := New()
+	recorder := &limitsRecorder{s: s, limits: make(map[string]map[string]ConcurrencyLimitStats)}
+	s.Plugins.Add(recorder)
+	assert.NoError(t, s.RegisterWithLimits(&Sleeper{}, "", map[string]ConcurrencyLimit{
+		"":      {MaxConcurrent: 8},
+		"Sleep": {MaxConcurrent: 2, MaxQueue: 4},
+	}))
+	assert.NoError(t, s.RegisterNameWithLimits("Report", &Sleeper{}, "", map[string]ConcurrencyLimit{
+		"Sleep": {MaxConcurrent: 1},
+	}))
+
+	limits := s.ConcurrencyLimits()
+	assert.Len(t, limits, 3)
+	assert.Equal(t, 8, limits["Sleeper"].MaxConcurrent)
+	assert.Equal(t, 4, limits["Sleeper.Sleep"].MaxQueue)
+	assert.Equal(t, 1, limits["Report.Sleep"].MaxConcurrent)
+
+	// services are advertised with their limits
+	assert.Contains(t, recorder.limits["Sleeper"], "Sleeper.Sleep")
+	assert.Contains(t, recorder.limits["Report"], "Report.Sleep")
+}
@@ -15,6 +15,8 @@ type Context struct {
 	ctx  *share.Context
 
 	writeCh chan *[]byte
+	// s is the server serving the connection, which is nil if the context is created by NewContext.
+	s *Server
 }
 
 // NewContext creates a server.Context for Handler.
@@ -118,9 +120,22 @@ func (ctx *Context) Write(v interface{}) error {
 		}
 	}
 
-	if len(res.Payload) > 1024 && req.CompressType() != protocol.None {
+	threshold := protocol.DefaultCompressThreshold
+	if ctx.s != nil {
+		threshold = ctx.s.compressThreshold
+	}
+	if len(res.Payload) > threshold && req.CompressType() != protocol.None {
 		res.SetCompressType(req.CompressType())
 	}
+	return ctx.writeResponse(res)
+}
+
+// writeResponse writes res by the server so that its chunk size and checksum apply.
+func (ctx *Context) writeResponse(res *protocol.Message) error {
+	if ctx.s != nil {
+		return ctx.s.writeResponse(ctx.conn, ctx.writeCh, res)
+	}
+
 	respData := res.EncodeSlicePointer()
 
 	var err error
@@ -167,9 +182,7 @@ func (ctx *Context) WriteError(err error) error {
 	res.SetMessageStatusType(protocol.Error)
 	res.Metadata[protocol.ServiceError] = err.Error()
 
-	respData := res.EncodeSlicePointer()
-	_, _ = ctx.conn.Write(*respData)
-	protocol.PutData(respData)
+	_ = ctx.writeResponse(res)
 
 	return nil
 }
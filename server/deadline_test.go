@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+	"github.com/stretchr/testify/assert"
+)
+
+// Deadline reports the remaining time of the requests it handles, directly or through next.
+type Deadline struct {
+	next  client.XClient
+	calls int32
+}
+
+// Remaining sleeps args.A milliseconds, and replies the remaining milliseconds of ctx.
+func (d *Deadline) Remaining(ctx context.Context, args *Args, reply *Reply) error {
+	atomic.AddInt32(&d.calls, 1)
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	if d.next != nil {
+		return d.next.Call(ctx, "Remaining", &Args{}, reply)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		reply.C = int(time.Until(deadline).Milliseconds())
+	} else {
+		reply.C = -1
+	}
+	return nil
+}
+
+func startDeadlineServer(t *testing.T, d *Deadline, options ...Option) (*Server, string) {
+	s := New(options...)
+	assert.NoError(t, s.RegisterName("Deadline", d, ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+
+	return s, ln.Addr().String()
+}
+
+func TestDeadlinePropagation(t *testing.T) {
+	for _, version := range []byte{0, protocol.Version2} {
+		testDeadlinePropagation(t, version)
+	}
+}
+
+func testDeadlinePropagation(t *testing.T, version byte) {
+	s1, addr1 := startDeadlineServer(t, &Deadline{})
+	defer func() { _ = s1.Close() }()
+
+	d, err := client.NewPeer2PeerDiscovery("tcp@"+addr1, "")
+	assert.NoError(t, err)
+	opt := client.DefaultOption
+	opt.ProtocolVersion = version
+	opt.DeadlineMargin = 50 * time.Millisecond
+	next := client.NewXClient("Deadline", client.Failtry, client.RoundRobin, d, opt)
+	defer func() { _ = next.Close() }()
+
+	s2, addr2 := startDeadlineServer(t, &Deadline{next: next})
+	defer func() { _ = s2.Close() }()
+
+	d, err = client.NewPeer2PeerDiscovery("tcp@"+addr2, "")
+	assert.NoError(t, err)
+	opt.DeadlineMargin = 0
+	xc := client.NewXClient("Deadline", client.Failtry, client.RoundRobin, d, opt)
+	defer func() { _ = xc.Close() }()
+
+	// the second hop gets what the first hop has left, minus the margin
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reply := &Reply{}
+	assert.NoError(t, xc.Call(ctx, "Remaining", &Args{A: 100}, reply))
+	assert.Greater(t, reply.C, 700)
+	assert.LessOrEqual(t, reply.C, 850)
+
+	// without a deadline there is no timeout
+	assert.NoError(t, xc.Call(context.Background(), "Remaining", &Args{}, reply))
+	assert.Equal(t, -1, reply.C)
+}
+
+func TestDeadlineExpired(t *testing.T) {
+	d := &Deadline{}
+	s, addr := startDeadlineServer(t, d, WithHandlerPool(1, 4, 0))
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr))
+	defer func() { _ = cli.Close() }()
+
+	// a request arriving expired is not handled
+	ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{share.ServerTimeout: "0"})
+	err := cli.Call(ctx, "Deadline", "Remaining", &Args{}, &Reply{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&d.calls))
+
+	// the time waiting for a worker counts
+	call := cli.Go(context.Background(), "Deadline", "Remaining", &Args{A: 200}, &Reply{}, nil)
+	time.Sleep(20 * time.Millisecond)
+	ctx = context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{share.ServerTimeout: "100"})
+	err = cli.Call(ctx, "Deadline", "Remaining", &Args{}, &Reply{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.NoError(t, (<-call.Done).Error)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.calls))
+
+	// v2 clients send the deadline in the extension block
+	opt := client.DefaultOption
+	opt.ProtocolVersion = protocol.Version2
+	opt.DeadlineMargin = time.Second
+	cli2 := client.NewClient(opt)
+	assert.NoError(t, cli2.Connect("tcp", addr))
+	defer func() { _ = cli2.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err = cli2.Call(ctx, "Deadline", "Remaining", &Args{}, &Reply{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&d.calls))
+}
@@ -57,20 +57,17 @@ func (s *Server) startHTTP1APIGateway(ln net.Listener) {
 	router.GET("/*servicePath", s.handleGatewayRequest)
 	router.PUT("/*servicePath", s.handleGatewayRequest)
 
+	srv := &http.Server{Handler: router}
 	if s.corsOptions != nil {
 		opt := cors.Options(*s.corsOptions)
 		c := cors.New(opt)
-		mux := c.Handler(router)
-		s.mu.Lock()
-		s.gatewayHTTPServer = &http.Server{Handler: mux}
-		s.mu.Unlock()
-	} else {
-		s.mu.Lock()
-		s.gatewayHTTPServer = &http.Server{Handler: router}
-		s.mu.Unlock()
+		srv.Handler = c.Handler(router)
 	}
+	s.mu.Lock()
+	s.gatewayHTTPServers = append(s.gatewayHTTPServers, srv)
+	s.mu.Unlock()
 
-	if err := s.gatewayHTTPServer.Serve(ln); err != nil {
+	if err := srv.Serve(ln); err != nil {
 		if err == ErrServerClosed || errors.Is(err, cmux.ErrListenerClosed) {
 			log.Info("gateway server closed")
 		} else {
@@ -195,14 +192,22 @@ func (s *Server) handleGatewayRequest(w http.ResponseWriter, r *http.Request, pa
 	_ = s.Plugins.DoPostWriteResponse(ctx, req, res, err)
 }
 
-func (s *Server) closeHTTP1APIGateway(ctx context.Context) error {
+// closeHTTP1APIGateway shuts down the gateways of all listeners and returns the first error.
+func (s *Server) closeHTTP1APIGateway(ctx context.Context) (err error) {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-	if s.gatewayHTTPServer != nil {
-		return s.gatewayHTTPServer.Shutdown(ctx)
-	}
+	servers := s.gatewayHTTPServers
+	s.gatewayHTTPServers = nil
+	s.mu.Unlock()
 
-	return nil
+	for _, srv := range servers {
+		if e := srv.Shutdown(ctx); e != nil && err == nil {
+			err = e
+		}
+	}
+	if len(servers) > 0 && err == nil {
+		log.Info("closed gateway")
+	}
+	return
 }
 
 func irpcPrefixByteMatcher() cmux.Matcher {
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+)
+
+// HandlerQueueStats is the usage of the handler pool by the requests of a priority.
+type HandlerQueueStats struct {
+	// Queued is the number of requests waiting for workers.
+	Queued int
+	// Handled is the number of requests started by workers.
+	Handled uint64
+	// Rejected is the number of requests rejected with ErrServerOverloaded, because the queue was full,
+	// they were shed for requests of higher priorities, or they waited too long.
+	Rejected uint64
+}
+
+// handlerTask is a request queued in the handler pool.
+type handlerTask struct {
+	priority int
+	queued   time.Time
+	handle   func()
+	// reject rejects the request without handling it.
+	reject func()
+}
+
+// priorityLevel is the FIFO queue of the requests of a priority.
+type priorityLevel struct {
+	priority int
+	tasks    []*handlerTask
+	handled  uint64
+	rejected uint64
+}
+
+// handlerPool handles requests by a fixed number of workers. Queued requests of higher priorities are
+// handled first, and when the queue is full, requests of the lowest priority are rejected first.
+type handlerPool struct {
+	workers   int
+	queueSize int
+	maxWait   time.Duration
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	queued  int
+	// levels are the queues of all the priorities from share.MaxPriority to share.MinPriority.
+	levels [share.MaxPriority - share.MinPriority + 1]priorityLevel
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newHandlerPool(workers, queueSize int, maxWait time.Duration) *handlerPool {
+	p := &handlerPool{workers: workers, queueSize: queueSize, maxWait: maxWait}
+	p.cond = sync.NewCond(&p.mu)
+	for i := range p.levels {
+		p.levels[i].priority = share.MaxPriority - i
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// level returns the queue of priority, which must be clamped by clampPriority.
+func (p *handlerPool) level(priority int) *priorityLevel {
+	return &p.levels[share.MaxPriority-priority]
+}
+
+// submit queues t and returns the number of queued requests. If the queue is full, it returns the task to reject,
+// which is either t or the latest queued task of the lowest priority if that is lower than the priority of t.
+func (p *handlerPool) submit(t *handlerTask) (queueLen int, rejected *handlerTask) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l := p.level(t.priority)
+	if p.closed {
+		l.rejected++
+		return p.queued, t
+	}
+	// idle workers take requests without queueing them
+	if p.running+p.queued >= p.workers+p.queueSize {
+		lowest := p.lowestQueued()
+		if lowest == nil || lowest.priority >= t.priority {
+			l.rejected++
+			return p.queued, t
+		}
+		rejected = lowest.tasks[len(lowest.tasks)-1]
+		lowest.tasks[len(lowest.tasks)-1] = nil
+		lowest.tasks = lowest.tasks[:len(lowest.tasks)-1]
+		lowest.rejected++
+		p.queued--
+	}
+
+	l.tasks = append(l.tasks, t)
+	p.queued++
+	p.cond.Signal()
+	return p.queued, rejected
+}
+
+// lowestQueued returns the level of the lowest priority with queued requests. The caller must hold p.mu.
+func (p *handlerPool) lowestQueued() *priorityLevel {
+	for i := len(p.levels) - 1; i >= 0; i-- {
+		if len(p.levels[i].tasks) > 0 {
+			return &p.levels[i]
+		}
+	}
+	return nil
+}
+
+// next waits for the queued request of the highest priority, and returns nil if the pool is closed.
+func (p *handlerPool) next() (*handlerTask, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.queued == 0 && !p.closed {
+		p.cond.Wait()
+	}
+	if p.closed {
+		return nil, false
+	}
+
+	for i := range p.levels {
+		l := &p.levels[i]
+		if len(l.tasks) == 0 {
+			continue
+		}
+		t := l.tasks[0]
+		l.tasks[0] = nil
+		l.tasks = l.tasks[1:]
+		p.queued--
+
+		if p.maxWait > 0 && time.Since(t.queued) > p.maxWait {
+			l.rejected++
+			return t, false
+		}
+		l.handled++
+		p.running++
+		return t, true
+	}
+	return nil, false
+}
+
+func (p *handlerPool) work() {
+	defer p.wg.Done()
+	for {
+		t, ok := p.next()
+		if t == nil {
+			return
+		}
+		if !ok {
+			t.reject()
+			continue
+		}
+
+		t.handle()
+		p.mu.Lock()
+		p.running--
+		p.mu.Unlock()
+	}
+}
+
+// close rejects the queued requests, so that their clients get responses and they are not counted as handling,
+// and stops the workers after their running requests.
+func (p *handlerPool) close() {
+	p.mu.Lock()
+	p.closed = true
+	var rejected []*handlerTask
+	for i := range p.levels {
+		l := &p.levels[i]
+		rejected = append(rejected, l.tasks...)
+		l.rejected += uint64(len(l.tasks))
+		l.tasks = nil
+	}
+	p.queued = 0
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	for _, t := range rejected {
+		t.reject()
+	}
+	p.wg.Wait()
+}
+
+func (p *handlerPool) stats() map[int]HandlerQueueStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make(map[int]HandlerQueueStats, len(p.levels))
+	for _, l := range p.levels {
+		if l.handled == 0 && l.rejected == 0 && len(l.tasks) == 0 {
+			continue
+		}
+		stats[l.priority] = HandlerQueueStats{Queued: len(l.tasks), Handled: l.handled, Rejected: l.rejected}
+	}
+	return stats
+}
+
+// requestPriority returns the priority of req set by the client, which is 0 by default.
+// v2 clients send it in the protocol.ExtPriority extension, and v1 clients in share.Priority.
+func requestPriority(req *protocol.Message) int {
+	priority, ok := req.Priority()
+	if !ok {
+		priority, _ = strconv.Atoi(req.Metadata[share.Priority])
+	}
+	return clampPriority(priority)
+}
+
+// clampPriority bounds priority by share.MinPriority and share.MaxPriority,
+// so that clients can't jump ahead of all the others.
+func clampPriority(priority int) int {
+	if priority < share.MinPriority {
+		return share.MinPriority
+	}
+	if priority > share.MaxPriority {
+		return share.MaxPriority
+	}
+	return priority
+}
+
+// queueHandler queues handle of req in the handler pool by the priority of req, and calls reject
+// if it doesn't get a place in the queue or waits longer than handlerQueueWait.
+func (s *Server) queueHandler(ctx *share.Context, req *protocol.Message, handle, reject func()) {
+	pool := s.getHandlerPool()
+	t := &handlerTask{priority: requestPriority(req), queued: time.Now(), handle: handle}
+	t.reject = func() {
+		s.Plugins.DoHandlerRejected(ctx, req, s.handlerQueueLen())
+		reject()
+	}
+
+	queueLen, rejected := pool.submit(t)
+	if rejected != nil {
+		rejected.reject()
+	}
+	if rejected != t {
+		// req may have been handled and freed already
+		s.Plugins.DoHandlerQueued(ctx, queueLen)
+	}
+}
+
+// getHandlerPool starts the handler pool on first use, which is closed when the server is closed.
+func (s *Server) getHandlerPool() *handlerPool {
+	s.handlerPoolOnce.Do(func() {
+		s.handlerPool = newHandlerPool(s.handlerWorkers, s.handlerQueueSize, s.handlerQueueWait)
+		go func() {
+			<-s.doneChan
+			s.handlerPool.close()
+		}()
+	})
+	return s.handlerPool
+}
+
+func (s *Server) handlerQueueLen() int {
+	p := s.getHandlerPool()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queued
+}
+
+// HandlerQueueStats returns the usage of the handler pool set by WithHandlerPool by the priorities which have been used.
+// It returns nil if the handler pool is not set.
+func (s *Server) HandlerQueueStats() map[int]HandlerQueueStats {
+	if s.handlerWorkers <= 0 {
+		return nil
+	}
+	return s.getHandlerPool().stats()
+}
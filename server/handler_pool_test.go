@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+	"github.com/stretchr/testify/assert"
+)
+
+type handlerQueueRecorder struct {
+	queued, rejected int32
+	maxQueueLen      int32
+}
+
+func (r *handlerQueueRecorder) HandlerQueued(_ context.Context, queueLen int) {
+	atomic.AddInt32(&r.queued, 1)
+	for {
+		n := atomic.LoadInt32(&r.maxQueueLen)
+		if int32(queueLen) <= n || atomic.CompareAndSwapInt32(&r.maxQueueLen, n, int32(queueLen)) {
+			return
+		}
+	}
+}
+
+func (r *handlerQueueRecorder) HandlerRejected(_ context.Context, _ *protocol.Message, _ int) {
+	atomic.AddInt32(&r.rejected, 1)
+}
+
+func callSleepers(t *testing.T, addr string, n int, ms int) (errs []error) {
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr))
+	defer func() { _ = cli.Close() }()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cli.Call(context.Background(), "Sleeper", "Sleep", &Args{A: ms}, &Reply{})
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		}()
+		time.Sleep(5 * time.Millisecond)
+	}
+	wg.Wait()
+	return errs
+}
+
+func countErrors(errs []error, target error) (n int) {
+	for _, err := range errs {
+		if err == target {
+			n++
+		}
+	}
+	return n
+}
+
+func TestHandlerPoolQueueFull(t *testing.T) {
+	recorder := &handlerQueueRecorder{}
+	s, addr := startSleeperServer(t, "s", WithHandlerPool(1, 2, 0), func(s *Server) { s.Plugins.Add(recorder) })
+	defer func() { _ = s.Close() }()
+
+	// one request is handled, two are queued and the others are rejected
+	errs := callSleepers(t, addr, 6, 200)
+	assert.Equal(t, 3, countErrors(errs, nil))
+	assert.Equal(t, 3, countErrors(errs, client.ErrServerOverloaded))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&recorder.queued))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&recorder.rejected))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&recorder.maxQueueLen))
+	// handlers are counted until after their responses are sent
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&s.handlerMsgNum) == 0 }, time.Second, time.Millisecond)
+
+	// heartbeats are not queued
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr))
+	defer func() { _ = cli.Close() }()
+	assert.NoError(t, cli.Call(context.Background(), "", "", nil, nil))
+}
+
+func TestHandlerPoolQueueWait(t *testing.T) {
+	s, addr := startSleeperServer(t, "s", WithHandlerPool(1, 10, 50*time.Millisecond))
+	defer func() { _ = s.Close() }()
+
+	// the queued requests wait longer than 50ms for the first one
+	errs := callSleepers(t, addr, 3, 200)
+	assert.Equal(t, 1, countErrors(errs, nil))
+	assert.Equal(t, 2, countErrors(errs, client.ErrServerOverloaded))
+}
+
+func TestXClientFailoverOverloaded(t *testing.T) {
+	s1, addr1 := startSleeperServer(t, "s1", WithHandlerPool(1, 0, 0))
+	defer func() { _ = s1.Close() }()
+	s2, addr2 := startSleeperServer(t, "s2")
+	defer func() { _ = s2.Close() }()
+
+	// keep the only worker of s1 busy
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr1))
+	defer func() { _ = cli.Close() }()
+	call := cli.Go(context.Background(), "Sleeper", "Sleep", &Args{A: 300}, &Reply{}, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	d, err := client.NewMultipleServersDiscovery([]*client.KVPair{{Key: "tcp@" + addr1}, {Key: "tcp@" + addr2}})
+	assert.NoError(t, err)
+	xc := client.NewXClient("Sleeper", client.Failover, client.RoundRobin, d, client.DefaultOption)
+	defer func() { _ = xc.Close() }()
+	for i := 0; i < 4; i++ {
+		var name string
+		assert.NoError(t, xc.Call(context.Background(), "Name", &Args{}, &name))
+		assert.Equal(t, "s2", name)
+	}
+
+	// the connection to the overloaded server is kept
+	assert.Equal(t, uint64(0), xc.PoolStats()["tcp@"+addr1].Removed)
+	assert.NoError(t, (<-call.Done).Error)
+}
+
+func TestHandlerPoolPriority(t *testing.T) {
+	p := newHandlerPool(1, 4, 0)
+	defer p.close()
+
+	var mu sync.Mutex
+	var handled, rejected []int
+	submit := func(priority int, handle func()) {
+		task := &handlerTask{priority: priority, queued: time.Now()}
+		task.handle = func() {
+			mu.Lock()
+			handled = append(handled, priority)
+			mu.Unlock()
+			if handle != nil {
+				handle()
+			}
+		}
+		task.reject = func() {
+			mu.Lock()
+			rejected = append(rejected, priority)
+			mu.Unlock()
+		}
+		if _, r := p.submit(task); r != nil {
+			r.reject()
+		}
+	}
+
+	// block the worker, so that the others are queued
+	block := make(chan struct{})
+	submit(0, func() { <-block })
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.running == 1
+	}, time.Second, time.Millisecond)
+
+	for _, priority := range []int{-1, 0, -1, 3} {
+		submit(priority, nil)
+	}
+	// the queue is full, so the latest request of the lowest priority is shed for a higher one
+	submit(1, nil)
+	// and a request of the lowest priority is rejected
+	submit(-1, nil)
+	close(block)
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(handled) == 5
+	}, time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []int{0, 3, 1, 0, -1}, handled)
+	assert.Equal(t, []int{-1, -1}, rejected)
+	mu.Unlock()
+
+	stats := p.stats()
+	assert.Equal(t, HandlerQueueStats{Handled: 1, Rejected: 2}, stats[-1])
+	assert.Equal(t, HandlerQueueStats{Handled: 2}, stats[0])
+	assert.Equal(t, HandlerQueueStats{Handled: 1}, stats[3])
+	assert.Len(t, stats, 4)
+}
+
+func TestRequestPriority(t *testing.T) {
+	s, addr := startSleeperServer(t, "s", WithHandlerPool(1, 1, 0))
+	defer func() { _ = s.Close() }()
+
+	option := client.DefaultOption
+	option.Priority = -1
+	batch := client.NewClient(option)
+	assert.NoError(t, batch.Connect("tcp", addr))
+	defer func() { _ = batch.Close() }()
+
+	// the batch requests take the worker and the queue
+	calls := make([]*client.Call, 2)
+	for i := range calls {
+		calls[i] = batch.Go(context.Background(), "Sleeper", "Sleep", &Args{A: 200}, &Reply{}, nil)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// an interactive request sheds the queued batch request, and its priority is clamped
+	option = client.DefaultOption
+	option.ProtocolVersion = protocol.Version2
+	interactive := client.NewClient(option)
+	assert.NoError(t, interactive.Connect("tcp", addr))
+	defer func() { _ = interactive.Close() }()
+	ctx := client.WithPriority(context.Background(), 10)
+	assert.NoError(t, interactive.Call(ctx, "Sleeper", "Sleep", &Args{A: 1}, &Reply{}))
+
+	assert.NoError(t, (<-calls[0].Done).Error)
+	assert.Equal(t, client.ErrServerOverloaded, (<-calls[1].Done).Error)
+
+	stats := s.HandlerQueueStats()
+	assert.Equal(t, HandlerQueueStats{Handled: 1, Rejected: 1}, stats[-1])
+	assert.Equal(t, HandlerQueueStats{Handled: 1}, stats[share.MaxPriority])
+	assert.NotContains(t, stats, 10)
+}
+
+func TestHandlerPoolClose(t *testing.T) {
+	p := newHandlerPool(1, 4, 0)
+
+	var rejected int32
+	block := make(chan struct{})
+	submit := func(handle func()) {
+		task := &handlerTask{queued: time.Now(), handle: handle}
+		task.reject = func() { atomic.AddInt32(&rejected, 1) }
+		_, _ = p.submit(task)
+	}
+	submit(func() { <-block })
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.running == 1
+	}, time.Second, time.Millisecond)
+	submit(func() { t.Error("a queued request is handled after close") })
+	submit(func() { t.Error("a queued request is handled after close") })
+
+	// the queued requests are rejected at once, and the running one is waited for
+	closed := make(chan struct{})
+	go func() {
+		p.close()
+		close(closed)
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&rejected) == 2 }, time.Second, time.Millisecond)
+	select {
+	case <-closed:
+		t.Error("close returns before the running request")
+	default:
+	}
+	close(block)
+	<-closed
+	assert.Equal(t, HandlerQueueStats{Handled: 1, Rejected: 2}, p.stats()[0])
+}
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"net"
 
+	"github.com/derekAHua/irpc/share"
 	kcp "github.com/xtaci/kcp-go"
 )
 
@@ -19,7 +20,31 @@ func kcpMakeListener(s *Server, address string) (ln net.Listener, err error) {
 		return nil, errors.New("KCP BlockCrypt must be configured in server.Options")
 	}
 
-	return kcp.ListenWithOptions(address, s.options["BlockCrypt"].(kcp.BlockCrypt), 10, 3)
+	config := share.DefaultKCPConfig
+	if c, ok := s.options["KCPConfig"].(share.KCPConfig); ok {
+		config = c
+	}
+
+	l, err := kcp.ListenWithOptions(address, s.options["BlockCrypt"].(kcp.BlockCrypt), config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &kcpListener{Listener: l, config: config}, nil
+}
+
+// kcpListener applies KCPConfig to accepted sessions.
+type kcpListener struct {
+	*kcp.Listener
+	config share.KCPConfig
+}
+
+func (ln *kcpListener) Accept() (net.Conn, error) {
+	sess, err := ln.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	ln.config.Apply(sess)
+	return sess, nil
 }
 
 // WithBlockCrypt sets kcp.BlockCrypt.
@@ -28,3 +53,11 @@ func WithBlockCrypt(bc kcp.BlockCrypt) Option {
 		s.options["BlockCrypt"] = bc
 	}
 }
+
+// WithKCPConfig tunes KCP sessions. FEC shards must be the same as clients.
+// If it is not set, share.DefaultKCPConfig is used.
+func WithKCPConfig(config share.KCPConfig) Option {
+	return func(s *Server) {
+		s.options["KCPConfig"] = config
+	}
+}
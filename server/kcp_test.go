@@ -0,0 +1,50 @@
+//go:build kcp
+// +build kcp
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/share"
+	"github.com/stretchr/testify/assert"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+func TestKCP(t *testing.T) {
+	block, err := kcp.NewAESBlockCrypt([]byte("0123456789abcdef0123456789abcdef"))
+	assert.NoError(t, err)
+
+	config := share.KCPConfig{
+		NoDelay:      true,
+		Interval:     10,
+		Resend:       2,
+		NoCongestion: true,
+		SndWnd:       256,
+		RcvWnd:       256,
+		DataShards:   4,
+		ParityShards: 2,
+	}
+
+	s := New(WithBlockCrypt(block), WithKCPConfig(config))
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	ln, err := s.makeListener("kcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	opt := client.DefaultOption
+	opt.Block = block
+	opt.KCPConfig = &config
+	cli := client.NewClient(opt)
+	assert.NoError(t, cli.Connect("kcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+
+	for i := 0; i < 10; i++ {
+		reply := &Reply{}
+		assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: i, B: 20}, reply))
+		assert.Equal(t, i*20, reply.C)
+	}
+}
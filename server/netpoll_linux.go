@@ -0,0 +1,361 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/derekAHua/irpc/log"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+	"github.com/soheilhy/cmux"
+)
+
+const (
+	// eventLoopBufferSize is the size of the read buffer of a loop, which is shared by its connections.
+	eventLoopBufferSize = 64 << 10
+	// eventLoopQueueSize is the number of requests queued for the workers of the event loop per worker.
+	eventLoopQueueSize = 64
+	// maxPendingPrealloc bounds the capacity allocated for the rest of an incomplete frame before it arrives.
+	maxPendingPrealloc = 64 << 10
+	// pollEvents are one-shot, so that a connection is read by one loop at a time and its frames stay in order.
+	pollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+)
+
+// netpoller serves connections by epoll. Connections don't have their goroutines or buffers while they are idle.
+type netpoller struct {
+	s    *Server
+	epfd int
+	pool *workerPool
+
+	mu    sync.Mutex
+	conns map[int]*pollConn
+	loops sync.WaitGroup
+}
+
+// pollConn is a connection served by the netpoller.
+type pollConn struct {
+	// mu orders the reads of the connection by different loops for the Go memory model,
+	// which doesn't know that one-shot events already serialize them.
+	mu sync.Mutex
+	cs *connState
+	// sock is the socket of cs.conn, which wraps it if the connection is matched by the gateway.
+	sock net.Conn
+	raw  syscall.RawConn
+	fd   int
+	// pending holds the bytes of an incomplete frame, and it is nil while the connection is idle.
+	pending []byte
+	// lastRead is the unix nano time of the last read, used to close connections idle longer than readTimeout.
+	lastRead int64
+}
+
+// serveEventLoop serves conn by the event loop, and returns false if conn can't be served by it.
+func (s *Server) serveEventLoop(conn net.Conn) bool {
+	s.eventLoopOnce.Do(func() {
+		s.eventLoop, s.eventLoopErr = newNetpoller(s)
+		if s.eventLoopErr != nil {
+			log.Errorf("irpc: failed to start the event loop: %v", s.eventLoopErr)
+		}
+	})
+	if s.eventLoopErr != nil {
+		return false
+	}
+	return s.eventLoop.register(conn)
+}
+
+func newNetpoller(s *Server) (*netpoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &netpoller{
+		s:     s,
+		epfd:  epfd,
+		pool:  newWorkerPool(s.eventLoopWorkers, s.eventLoopWorkers*eventLoopQueueSize),
+		conns: make(map[int]*pollConn),
+	}
+	loops := runtime.GOMAXPROCS(0)
+	p.loops.Add(loops)
+	for i := 0; i < loops; i++ {
+		go p.loop()
+	}
+	if s.readTimeout > 0 {
+		go p.closeIdleConns()
+	}
+
+	go func() {
+		<-s.doneChan
+		p.loops.Wait()
+		p.pool.stop()
+		_ = syscall.Close(p.epfd)
+	}()
+	return p, nil
+}
+
+// register adds conn to the netpoller, and returns false if conn is not a socket.
+func (p *netpoller) register(conn net.Conn) bool {
+	sock, sniffed := conn, 0
+	if mc, ok := conn.(*cmux.MuxConn); ok {
+		// the gateway of Serve read the magic number to match conn, which it replays before the socket
+		sock, sniffed = mc.Conn, 1
+	}
+	sc, ok := sock.(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	fd := -1
+	if err = raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return false
+	}
+
+	pc := &pollConn{cs: p.s.newConnState(conn), sock: sock, raw: raw, fd: fd, lastRead: time.Now().UnixNano()}
+	if sniffed > 0 {
+		// the replayed bytes are read from the buffer of the gateway without blocking
+		pc.pending = make([]byte, sniffed)
+		n, _ := conn.Read(pc.pending)
+		pc.pending = pc.pending[:n]
+	}
+	p.mu.Lock()
+	stale := p.conns[fd]
+	p.conns[fd] = pc
+	p.mu.Unlock()
+	if stale != nil {
+		// the fd of a connection closed by the server is reused
+		p.s.closeConnState(stale.cs)
+	}
+
+	err = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: pollEvents, Fd: int32(fd)})
+	if err != nil {
+		log.Warnf("irpc: failed to add %s to the event loop: %v", conn.RemoteAddr().String(), err)
+		p.remove(pc)
+		p.s.closeConnState(pc.cs)
+		return false
+	}
+	return true
+}
+
+func (p *netpoller) remove(pc *pollConn) {
+	p.mu.Lock()
+	if p.conns[pc.fd] == pc {
+		delete(p.conns, pc.fd)
+	}
+	p.mu.Unlock()
+}
+
+func (p *netpoller) loop() {
+	defer p.loops.Done()
+
+	events := make([]syscall.EpollEvent, 128)
+	buf := make([]byte, eventLoopBufferSize)
+	r := bytes.NewReader(nil)
+	for {
+		// wake up every second to exit after the server is closed
+		n, err := syscall.EpollWait(p.epfd, events, 1000)
+		select {
+		case <-p.s.doneChan:
+			return
+		default:
+		}
+		if err != nil {
+			if err != syscall.EINTR {
+				log.Errorf("irpc: event loop failed to wait: %v", err)
+				return
+			}
+			continue
+		}
+
+		for i := 0; i < n; i++ {
+			p.mu.Lock()
+			pc := p.conns[int(events[i].Fd)]
+			p.mu.Unlock()
+			if pc == nil {
+				continue
+			}
+
+			pc.mu.Lock()
+			ok := p.serve(pc, buf, r)
+			pc.mu.Unlock()
+			if !ok {
+				p.close(pc)
+				continue
+			}
+			p.rearm(pc)
+		}
+	}
+}
+
+// rearm waits for the next event of the connection.
+// Bytes left in the socket trigger it again, so that busy connections take turns.
+func (p *netpoller) rearm(pc *pollConn) {
+	ev := syscall.EpollEvent{Events: pollEvents, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_MOD, pc.fd, &ev); err != nil {
+		p.close(pc)
+	}
+}
+
+// serve reads the readable connection once and handles the complete frames.
+// It returns false if the connection should be closed, including if serving it panics.
+func (p *netpoller) serve(pc *pollConn, buf []byte, r *bytes.Reader) (ok bool) {
+	s, cs := p.s, pc.cs
+	defer recoverConn(pc, &ok)
+
+	if s.isShutdown() {
+		s.goAway(cs)
+		return false
+	}
+
+	var n int
+	var rerr error
+	err := pc.raw.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), buf)
+		// never wait for the connection to be readable in the loop
+		return true
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err == syscall.EAGAIN {
+		return true
+	}
+	if err != nil || n <= 0 {
+		if s.isShutdown() {
+			s.goAway(cs)
+		} else if err == nil {
+			log.Infof("client has closed this connection: %s", cs.conn.RemoteAddr().String())
+		} else {
+			log.Warnf("irpc: failed to read request: %v", err)
+		}
+		return false
+	}
+	atomic.StoreInt64(&pc.lastRead, time.Now().UnixNano())
+
+	data := buf[:n]
+	if len(pc.pending) > 0 {
+		data = append(pc.pending, data...)
+	}
+	return p.handleFrames(pc, data, r)
+}
+
+// handleFrames handles the complete frames of data, and keeps the rest in pc.pending.
+// It returns false if the connection should be closed.
+func (p *netpoller) handleFrames(pc *pollConn, data []byte, r *bytes.Reader) bool {
+	s, cs := p.s, pc.cs
+	consumed := false
+	for {
+		size, err := protocol.FrameSize(data)
+		if err != nil {
+			log.Warnf("irpc: failed to read request: %v", err)
+			return false
+		}
+		if size == 0 || size > len(data) {
+			break
+		}
+
+		ctx := cs.newContext()
+		r.Reset(data[:size])
+		data = data[size:]
+		consumed = true
+		req, err := s.readRequest(ctx, r)
+		if !s.handleFrame(ctx, cs, req, err, p.pool.submit) {
+			return false
+		}
+	}
+
+	switch {
+	case len(data) == 0:
+		pc.pending = nil
+	case len(pc.pending) > 0 && !consumed:
+		// the frame is still incomplete
+		pc.pending = data
+	default:
+		// keep the incomplete frame out of the shared buffer. The capacity is bounded, because the frame size
+		// is sent by the peer, and the buffer grows as the rest of the frame arrives.
+		size, _ := protocol.FrameSize(data)
+		if limit := len(data) + maxPendingPrealloc; size > limit {
+			size = limit
+		}
+		if size < len(data) {
+			size = len(data)
+		}
+		pc.pending = append(make([]byte, 0, size), data...)
+	}
+	return true
+}
+
+// recoverConn recovers a panic of serving the connection, so that it is closed
+// instead of stopping the loop serving other connections.
+func recoverConn(pc *pollConn, ok *bool) {
+	if err := recover(); err != nil {
+		const size = 64 << 10
+		stack := make([]byte, size)
+		stack = stack[:runtime.Stack(stack, false)]
+		log.Errorf("serving %s panic error: %s, stack:\n %s", pc.cs.conn.RemoteAddr(), err, stack)
+		*ok = false
+	}
+}
+
+// close closes the connection after no more frames are read from it.
+func (p *netpoller) close(pc *pollConn) {
+	p.remove(pc)
+	// remove the fd before it is closed and reused
+	_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	p.s.closeConnState(pc.cs)
+
+	conn := pc.cs.conn
+	if share.Trace {
+		log.Debugf("server closed conn: %v", conn.RemoteAddr().String())
+	}
+	if p.s.isShutdown() {
+		// make sure all inflight requests are handled and all drained
+		go func() {
+			<-p.s.doneChan
+			p.s.closeConn(conn)
+		}()
+		return
+	}
+	p.s.closeConn(conn)
+}
+
+// closeIdleConns closes the read side of connections idle longer than readTimeout,
+// so that the loops read io.EOF from them and close them.
+func (p *netpoller) closeIdleConns() {
+	ticker := time.NewTicker(p.s.readTimeout / 2)
+	defer ticker.Stop()
+
+	var idle []*pollConn
+	for {
+		select {
+		case <-p.s.doneChan:
+			return
+		case now := <-ticker.C:
+			deadline := now.Add(-p.s.readTimeout).UnixNano()
+			p.mu.Lock()
+			for _, pc := range p.conns {
+				if atomic.LoadInt64(&pc.lastRead) < deadline {
+					idle = append(idle, pc)
+				}
+			}
+			p.mu.Unlock()
+
+			for i, pc := range idle {
+				if cr, ok := pc.sock.(closeReader); ok {
+					_ = cr.CloseRead()
+				}
+				idle[i] = nil
+			}
+			idle = idle[:0]
+		}
+	}
+}
@@ -0,0 +1,337 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventLoop(t *testing.T) {
+	s := New(WithEventLoop(4))
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	assert.NoError(t, s.RegisterName("BlobEcho", new(BlobEcho), ""))
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	unixLn, err := net.Listen("unix", filepath.Join(t.TempDir(), "irpc.sock"))
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(tcpLn) }()
+	go func() { _ = s.ServeListener(unixLn) }()
+	defer func() { _ = s.Close() }()
+
+	// a large payload is read in several events
+	data := bytes.Repeat([]byte("irpc event loop "), 20000)
+
+	var wg sync.WaitGroup
+	for i, addr := range []net.Addr{tcpLn.Addr(), tcpLn.Addr(), unixLn.Addr(), unixLn.Addr()} {
+		cli := client.NewClient(client.DefaultOption)
+		assert.NoError(t, cli.Connect(addr.Network(), addr.String()))
+		defer func() { _ = cli.Close() }()
+
+		for j := 0; j < 10; j++ {
+			wg.Add(1)
+			go func(a int) {
+				defer wg.Done()
+				reply := &Reply{}
+				assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: a, B: 10}, reply))
+				assert.Equal(t, a*10, reply.C)
+
+				blob := &Blob{}
+				assert.NoError(t, cli.Call(context.Background(), "BlobEcho", "Echo", &Blob{Data: data}, blob))
+				assert.Equal(t, data, blob.Data)
+			}(i*10 + j)
+		}
+	}
+	wg.Wait()
+
+	s.eventLoop.mu.Lock()
+	assert.Len(t, s.eventLoop.conns, 4)
+	s.eventLoop.mu.Unlock()
+}
+
+func TestEventLoopGateway(t *testing.T) {
+	s := New(WithEventLoop(2))
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	go func() { _ = s.Serve("tcp", "127.0.0.1:0") }()
+	defer func() { _ = s.Close() }()
+	assert.Eventually(t, func() bool { return s.Address() != nil }, time.Second, 10*time.Millisecond)
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", s.Address().String()))
+	defer func() { _ = cli.Close() }()
+
+	for i := 0; i < 3; i++ {
+		reply := &Reply{}
+		assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: i, B: 10}, reply))
+		assert.Equal(t, i*10, reply.C)
+	}
+
+	// the connection matched by the gateway is served by the event loop
+	s.eventLoop.mu.Lock()
+	assert.Len(t, s.eventLoop.conns, 1)
+	s.eventLoop.mu.Unlock()
+}
+
+type Gate struct {
+	open chan struct{}
+}
+
+func (g *Gate) Wait(_ context.Context, args *Args, reply *Reply) error {
+	<-g.open
+	reply.C = args.A
+	return nil
+}
+
+func (g *Gate) Sum(_ context.Context, _ *Args, stream ServerStream) error {
+	<-g.open
+	sum := 0
+	for {
+		args := &Args{}
+		err := stream.Recv(args)
+		if err == io.EOF {
+			return stream.Send(&Reply{C: sum})
+		}
+		if err != nil {
+			return err
+		}
+		sum += args.A
+	}
+}
+
+func TestEventLoopOverloaded(t *testing.T) {
+	gate := &Gate{open: make(chan struct{})}
+	s := New(WithEventLoop(1))
+	assert.NoError(t, s.RegisterName("Gate", gate, ""))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+
+	// the requests beyond the worker and its queue are rejected instead of blocking the loop
+	const n = 1 + eventLoopQueueSize + 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(a int) {
+			reply := &Reply{}
+			errs <- cli.Call(context.Background(), "Gate", "Wait", &Args{A: a}, reply)
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		assert.EqualError(t, <-errs, ErrServerOverloaded.Error())
+	}
+	close(gate.open)
+	for i := 10; i < n; i++ {
+		assert.NoError(t, <-errs)
+	}
+}
+
+func TestEventLoopSlowStream(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	defer func(size int) { StreamBufferSize = size }(StreamBufferSize)
+	StreamBufferSize = 2
+
+	gate := &Gate{open: make(chan struct{})}
+	s := New(WithEventLoop(2))
+	assert.NoError(t, s.RegisterName("Gate", gate, ""))
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+	stream, err := cli.NewStream(context.Background(), "Gate", "Sum", &Args{})
+	assert.NoError(t, err)
+	sent := make(chan error, 1)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			if err := stream.Send(&Args{A: i}); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- stream.CloseSend()
+	}()
+
+	// the only loop still serves other connections while the client waits for the window of the stream
+	other := client.NewClient(client.DefaultOption)
+	assert.NoError(t, other.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = other.Close() }()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	reply := &Reply{}
+	assert.NoError(t, other.Call(ctx, "Arith", "Mul", &Args{A: 2, B: 3}, reply))
+	assert.Equal(t, 6, reply.C)
+
+	// and the messages are delivered in order after the stream catches up
+	close(gate.open)
+	assert.NoError(t, <-sent)
+	assert.NoError(t, stream.Recv(reply))
+	assert.Equal(t, 55, reply.C)
+}
+
+type panicReadPlugin struct{}
+
+func (panicReadPlugin) PostReadRequest(_ context.Context, r *protocol.Message, _ error) error {
+	if r.ServicePath == "Panic" {
+		panic("panic in the event loop")
+	}
+	return nil
+}
+
+func TestEventLoopPanic(t *testing.T) {
+	s := New(WithEventLoop(1))
+	s.Plugins.Add(panicReadPlugin{})
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	// the panicking connection is closed
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.Error(t, cli.Call(ctx, "Panic", "Mul", &Args{A: 1, B: 2}, &Reply{}))
+	_ = cli.Close()
+
+	// and the others are still served
+	cli = client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+	reply := &Reply{}
+	assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: 2, B: 3}, reply))
+	assert.Equal(t, 6, reply.C)
+}
+
+func TestEventLoopLargeFrameSize(t *testing.T) {
+	s := New(WithEventLoop(1))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// the frame claims 4 GiB, but only the bytes which have arrived are buffered
+	msg := protocol.NewMessage()
+	frame := append(msg.Header[:], 0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4)
+	_, err = conn.Write(frame)
+	assert.NoError(t, err)
+
+	pending := func() []byte {
+		s.eventLoop.mu.Lock()
+		defer s.eventLoop.mu.Unlock()
+		for _, pc := range s.eventLoop.conns {
+			pc.mu.Lock()
+			defer pc.mu.Unlock()
+			return pc.pending
+		}
+		return nil
+	}
+	assert.Eventually(t, func() bool { return len(pending()) == len(frame) }, time.Second, time.Millisecond)
+	assert.LessOrEqual(t, cap(pending()), len(frame)+maxPendingPrealloc)
+}
+
+func TestEventLoopReadTimeout(t *testing.T) {
+	s := New(WithEventLoop(1), WithReadTimeout(200*time.Millisecond))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// the idle connection is closed by the server
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// BenchmarkIdleConns reports the memory of idle connections, including the client side of
+// the connections in the same process, and the latency of a heartbeat on an idle connection.
+func BenchmarkIdleConns(b *testing.B) {
+	for _, c := range []struct {
+		name    string
+		options []Option
+	}{
+		{"goroutine", nil},
+		{"eventloop", []Option{WithEventLoop(runtime.GOMAXPROCS(0))}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			benchmarkIdleConns(b, 5000, c.options...)
+		})
+	}
+}
+
+func benchmarkIdleConns(b *testing.B, n int, options ...Option) {
+	s := New(options...)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	before := inuseMemory()
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		if conns[i], err = net.Dial("tcp", ln.Addr().String()); err != nil {
+			b.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+	for len(s.ActiveClientConn()) < n {
+		time.Sleep(10 * time.Millisecond)
+	}
+	perConn := float64(inuseMemory()-before) / float64(n)
+
+	heartbeat := protocol.NewMessage()
+	heartbeat.SetMessageType(protocol.Request)
+	heartbeat.SetHeartbeat(true)
+	data := heartbeat.Encode()
+	res := protocol.NewMessage()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn := conns[i%n]
+		if _, err = conn.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err = res.Decode(conn); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(perConn, "B/conn")
+}
+
+func inuseMemory() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse + ms.StackInuse
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "net"
+
+// netpoller is only implemented on Linux.
+type netpoller struct{}
+
+// serveEventLoop returns false, so that connections are served by goroutines on other platforms.
+func (s *Server) serveEventLoop(net.Conn) bool {
+	return false
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"crypto/tls"
+	"net"
 	"time"
 )
 
@@ -29,6 +30,127 @@ func WithWriteTimeout(writeTimeout time.Duration) Option {
 	}
 }
 
+// WithChunkSize splits payloads of responses longer than size into chunk frames,
+// so that a large response doesn't block other responses on the connection.
+// Only responses to v2 requests are split.
+func WithChunkSize(size int) Option {
+	return func(s *Server) {
+		s.chunkSize = size
+	}
+}
+
+// WithMaxPayloadSize limits the payload size of requests to the service servicePath.
+// The limit is checked while chunk frames are reassembled, so a large request is rejected before it is received completely.
+// If servicePath is empty, it sets the limit of services without their own limits.
+func WithMaxPayloadSize(servicePath string, size int) Option {
+	return func(s *Server) {
+		if s.maxPayloadSizes == nil {
+			s.maxPayloadSizes = make(map[string]int)
+		}
+		s.maxPayloadSizes[servicePath] = size
+	}
+}
+
+// WithCompressThreshold sets the payload size over which responses are compressed
+// by the compress type of requests. The default is protocol.DefaultCompressThreshold.
+func WithCompressThreshold(threshold int) Option {
+	return func(s *Server) {
+		s.compressThreshold = threshold
+	}
+}
+
+// WithWriteCoalescing writes responses of a connection by its write loop, which gathers responses
+// queued meanwhile into one writev of at most maxBatchBytes, and waits up to maxDelay for more responses
+// before writing a smaller batch. It enables AsyncWrite.
+func WithWriteCoalescing(maxBatchBytes int, maxDelay time.Duration) Option {
+	return func(s *Server) {
+		s.AsyncWrite = true
+		s.writeBatchBytes = maxBatchBytes
+		s.writeBatchDelay = maxDelay
+	}
+}
+
+// WithProxyProtocol parses HAProxy PROXY protocol v1 and v2 headers of connections from trusted upstreams
+// before plugins see them, so that RemoteAddr of the connections is the address of clients.
+// Connections of other peers are served as they are, so that clients can't spoof their addresses.
+// Only peers in trusted are trusted, and 0.0.0.0/0 and ::/0 trust all peers.
+// Headers are read before the connections are matched by the gateway of Serve.
+// The address of the proxy is returned by ProxyAddr() net.Addr of the connection.
+func WithProxyProtocol(trusted []*net.IPNet) Option {
+	return func(s *Server) {
+		s.proxyProtocol = &proxyProtocol{trusted: trusted}
+	}
+}
+
+// WithZeroCopyDecode decodes requests into pooled buffers without copying servicePath, serviceMethod,
+// metadata and payload, which reduces allocations of busy servers.
+// The request is released after its response is written, so services and plugins must not retain
+// metadata, extensions or args referencing the payload, such as []byte args of the raw codec, after returning.
+func WithZeroCopyDecode() Option {
+	return func(s *Server) {
+		s.zeroCopyDecode = true
+	}
+}
+
+// WithEventLoop serves connections by an epoll event loop on Linux instead of a goroutine per connection,
+// which reads requests only when connections are readable into buffers shared by connections,
+// and handles them by a pool of workers goroutines. It saves the memory of many mostly idle connections.
+// TLS connections, connections with PROXY protocol headers, connections wrapped by plugins and other platforms
+// are served by goroutines as usual.
+// AsyncWrite starts a goroutine per connection, so it should not be used together.
+func WithEventLoop(workers int) Option {
+	return func(s *Server) {
+		s.eventLoopWorkers = workers
+	}
+}
+
+// WithHandlerPool handles requests by a pool of workers goroutines instead of a goroutine per request,
+// so that a burst of requests is rejected fast instead of growing memory without bound.
+// At most queueSize requests wait for workers, and requests arriving when the queue is full
+// or waiting longer than maxQueueWait are rejected with ErrServerOverloaded, which clients retry on other servers.
+// If maxQueueWait is zero, queued requests wait as long as they need.
+// Queued requests of higher priorities set by clients in protocol.ExtPriority or share.Priority are handled first, and when the queue is full,
+// queued requests of lower priorities are rejected for them. Priorities are clamped to share.MinPriority..share.MaxPriority.
+// See HandlerQueueStats.
+// Heartbeats and streams are not handled by the pool.
+func WithHandlerPool(workers, queueSize int, maxQueueWait time.Duration) Option {
+	return func(s *Server) {
+		s.handlerWorkers = workers
+		s.handlerQueueSize = queueSize
+		s.handlerQueueWait = maxQueueWait
+	}
+}
+
+// WithAdaptiveLimit limits the in-flight requests of each service method by a limit adapted to their latency,
+// measured from StartRequestContextKey to writing the response. The limit grows while the latency is steady,
+// and it shrinks when the latency rises, for example because a dependency slows down.
+// Requests over the limit are rejected with ErrServerOverloaded as soon as they are read, before they wait
+// in the queue of WithHandlerPool, and requests waiting there count as in flight.
+// Heartbeats and streams are not limited.
+func WithAdaptiveLimit(config AdaptiveLimitConfig) Option {
+	return func(s *Server) {
+		s.adaptiveLimiter = newAdaptiveLimiter(config)
+	}
+}
+
+// WithConcurrencyLimits sets the concurrency limits of services and service methods by SetConcurrencyLimit,
+// keyed by "Service" or "Service.Method".
+func WithConcurrencyLimits(limits map[string]ConcurrencyLimit) Option {
+	return func(s *Server) {
+		for name, limit := range limits {
+			s.SetConcurrencyLimit(name, limit)
+		}
+	}
+}
+
+// WithChecksum adds CRC32C checksums to responses to v2 requests.
+// Responses to requests with checksums always have checksums.
+func WithChecksum() Option {
+	return func(s *Server) {
+		s.checksum = true
+	}
+}
+
 //// WithTCPKeepAlivePeriod sets tcp keepalive period.
 //func WithTCPKeepAlivePeriod(period time.Duration) Option {
 //	return func(s *Server) {
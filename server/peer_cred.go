@@ -0,0 +1,15 @@
+package server
+
+import "errors"
+
+// ErrNoPeerCred is returned by GetPeerCred if the connection has no peer credentials.
+var ErrNoPeerCred = errors.New("irpc: connection has no peer credentials")
+
+// PeerCred is the credentials of the process of a client connected by a unix socket, read from SO_PEERCRED.
+// They are the credentials of the client when it connected.
+// Service methods and plugins get it by ctx.Value(PeerCredContextKey).
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
@@ -0,0 +1,53 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type PeerCredReply struct {
+	Cred *PeerCred
+}
+
+type PeerCredEcho struct{}
+
+func (PeerCredEcho) Echo(ctx context.Context, _ *Args, reply *PeerCredReply) error {
+	reply.Cred, _ = ctx.Value(PeerCredContextKey).(*PeerCred)
+	return nil
+}
+
+func TestPeerCred(t *testing.T) {
+	s := New()
+	assert.NoError(t, s.RegisterName("PeerCredEcho", new(PeerCredEcho), ""))
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "irpc.sock"))
+	assert.NoError(t, err)
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	go func() { _ = s.ServeListener(tcpLn) }()
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("unix", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+	reply := &PeerCredReply{}
+	assert.NoError(t, cli.Call(context.Background(), "PeerCredEcho", "Echo", &Args{}, reply))
+	assert.Equal(t, &PeerCred{PID: int32(os.Getpid()), UID: uint32(os.Getuid()), GID: uint32(os.Getgid())}, reply.Cred)
+
+	// TCP connections have no peer credentials
+	tcpCli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, tcpCli.Connect("tcp", tcpLn.Addr().String()))
+	defer func() { _ = tcpCli.Close() }()
+	reply = &PeerCredReply{}
+	assert.NoError(t, tcpCli.Call(context.Background(), "PeerCredEcho", "Echo", &Args{}, reply))
+	assert.Nil(t, reply.Cred)
+}
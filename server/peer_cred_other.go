@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "net"
+
+// GetPeerCred returns ErrNoPeerCred, because peer credentials are only read on linux.
+func GetPeerCred(_ net.Conn) (*PeerCred, error) {
+	return nil, ErrNoPeerCred
+}
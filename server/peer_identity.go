@@ -0,0 +1,62 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+)
+
+// PeerIdentity is the identity of a client authenticated by its TLS certificate.
+// Service methods and AuthFunc get it by ctx.Value(PeerIdentityContextKey).
+// The identity fields are only set if the server verified the certificate, such as by tls.RequireAndVerifyClientCert.
+type PeerIdentity struct {
+	// Chain is the verified certificate chain of the client, which starts with the client certificate.
+	Chain    []*x509.Certificate
+	Verified bool
+	// PeerCertificates are the certificates sent by the client, which are set even if they are not verified.
+	PeerCertificates []*x509.Certificate
+
+	Subject pkix.Name
+	// SPIFFEID is the first spiffe:// URI in the SAN of the client certificate.
+	SPIFFEID       string
+	DNSNames       []string
+	URIs           []*url.URL
+	EmailAddresses []string
+	IPAddresses    []net.IP
+}
+
+// newPeerIdentity returns the identity of the client of a TLS conn, or nil if the client has no certificate.
+// A certificate not verified by the server is only kept in PeerCertificates, since anyone can make one with any name.
+func newPeerIdentity(conn net.Conn) *PeerIdentity {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	peer := &PeerIdentity{PeerCertificates: state.PeerCertificates}
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return peer
+	}
+	peer.Chain = state.VerifiedChains[0]
+	peer.Verified = true
+
+	cert := peer.Chain[0]
+	peer.Subject = cert.Subject
+	peer.DNSNames = cert.DNSNames
+	peer.URIs = cert.URIs
+	peer.EmailAddresses = cert.EmailAddresses
+	peer.IPAddresses = cert.IPAddresses
+	for _, u := range cert.URIs {
+		if u.Scheme == "spiffe" {
+			peer.SPIFFEID = u.String()
+			break
+		}
+	}
+	return peer
+}
@@ -83,6 +83,16 @@ type (
 		HeartbeatRequest(ctx context.Context, req *protocol.Message) error
 	}
 
+	// HandlerQueuePlugin observes the queue of the handler pool set by WithHandlerPool.
+	HandlerQueuePlugin interface {
+		// HandlerQueued is called after a request is queued, with the number of queued requests.
+		// The request may have been handled already, so only its context is passed.
+		HandlerQueued(ctx context.Context, queueLen int)
+		// HandlerRejected is called when a request is rejected with ErrServerOverloaded,
+		// because the queue is full or the request has waited longer than the max queue wait.
+		HandlerRejected(ctx context.Context, r *protocol.Message, queueLen int)
+	}
+
 	CMuxPlugin interface {
 		MuxMatch(m cmux.CMux)
 	}
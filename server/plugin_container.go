@@ -39,6 +39,9 @@ type PluginContainer interface {
 
 	DoHeartbeatRequest(ctx context.Context, req *protocol.Message) error
 
+	DoHandlerQueued(ctx context.Context, queueLen int)
+	DoHandlerRejected(ctx context.Context, r *protocol.Message, queueLen int)
+
 	MuxMatch(m cmux.CMux)
 }
 
@@ -295,6 +298,24 @@ func (p *pluginContainer) DoHeartbeatRequest(ctx context.Context, r *protocol.Me
 	return nil
 }
 
+// DoHandlerQueued invokes HandlerQueuePlugin.
+func (p *pluginContainer) DoHandlerQueued(ctx context.Context, queueLen int) {
+	for i := range p.plugins {
+		if plugin, ok := p.plugins[i].(HandlerQueuePlugin); ok {
+			plugin.HandlerQueued(ctx, queueLen)
+		}
+	}
+}
+
+// DoHandlerRejected invokes HandlerQueuePlugin.
+func (p *pluginContainer) DoHandlerRejected(ctx context.Context, r *protocol.Message, queueLen int) {
+	for i := range p.plugins {
+		if plugin, ok := p.plugins[i].(HandlerQueuePlugin); ok {
+			plugin.HandlerRejected(ctx, r, queueLen)
+		}
+	}
+}
+
 // MuxMatch adds cmux.CMux Match.
 func (p *pluginContainer) MuxMatch(m cmux.CMux) {
 	for i := range p.plugins {
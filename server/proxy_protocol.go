@@ -0,0 +1,315 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/derekAHua/irpc/log"
+)
+
+// ProxyHeaderTimeout limits the time to read the PROXY protocol header of a connection.
+var ProxyHeaderTimeout = 5 * time.Second
+
+var (
+	// ErrInvalidProxyHeader the PROXY protocol header is malformed or missing.
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// proxyV1MaxLength is the max length of a v1 header including CRLF.
+	proxyV1MaxLength = 107
+	proxyV2HeaderLen = 16
+)
+
+// proxyProtocol parses PROXY protocol headers of connections from trusted upstreams.
+type proxyProtocol struct {
+	// trusted are networks of upstreams whose headers are accepted.
+	trusted []*net.IPNet
+}
+
+// isTrusted reports whether addr is an upstream allowed to send PROXY protocol headers.
+func (p *proxyProtocol) isTrusted(addr net.Addr) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// accept reads the PROXY protocol header of conn from a trusted upstream, and returns a connection
+// whose RemoteAddr is the address of the client. Connections of other peers are returned as they are.
+// The header of a TLS connection precedes the TLS handshake.
+func (p *proxyProtocol) accept(conn net.Conn, tlsConfig *tls.Config) (net.Conn, error) {
+	if !p.isTrusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	raw := conn
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS {
+		raw = tlsConn.NetConn()
+	}
+
+	_ = raw.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	pc, err := readProxyHeader(raw)
+	_ = raw.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	if isTLS {
+		return tls.Server(pc, tlsConfig), nil
+	}
+	return pc, nil
+}
+
+// proxyListener returns connections of ln after their PROXY protocol headers are read.
+// Headers are read in goroutines of the connections, so that a slow peer doesn't block accepting.
+type proxyListener struct {
+	net.Listener
+	p         *proxyProtocol
+	tlsConfig *tls.Config
+
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *proxyProtocol) listener(ln net.Listener, tlsConfig *tls.Config) *proxyListener {
+	l := &proxyListener{
+		Listener:  ln,
+		p:         p,
+		tlsConfig: tlsConfig,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+
+		go l.accept(conn)
+	}
+}
+
+func (l *proxyListener) accept(conn net.Conn) {
+	pc, err := l.p.accept(conn, l.tlsConfig)
+	if err != nil {
+		log.Warnf("irpc: failed to read PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+
+	select {
+	case l.conns <- pc:
+	case <-l.done:
+		_ = pc.Close()
+	}
+}
+
+// Accept returns the next connection whose header is read.
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// proxyConn is a connection from a proxy, and RemoteAddr and LocalAddr are addresses in the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the address of the client.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// LocalAddr returns the address the client connected to.
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+// ProxyAddr returns the address of the proxy.
+func (c *proxyConn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header from conn.
+// The addresses of conn are kept for LOCAL and UNKNOWN headers, such as health checks of the proxy.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{
+		Conn:       conn,
+		r:          bufio.NewReaderSize(conn, 256),
+		remoteAddr: conn.RemoteAddr(),
+		localAddr:  conn.LocalAddr(),
+	}
+
+	sig, err := pc.r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV1Prefix) {
+		return pc, pc.readV1()
+	}
+
+	sig, err = pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return pc, pc.readV2()
+	}
+	return nil, ErrInvalidProxyHeader
+}
+
+// readV1 reads a header like "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidProxyHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrInvalidProxyHeader
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remoteAddr, c.localAddr = src, dst
+	return nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// readV2 reads a binary header: signature(12) | ver_cmd(1) | fam(1) | len(2) | addresses and TLVs.
+func (c *proxyConn) readV2() error {
+	var header [proxyV2HeaderLen]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return err
+	}
+	if header[12]>>4 != 2 {
+		return ErrInvalidProxyHeader
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+
+	switch header[12] & 0x0f {
+	case 0: // LOCAL
+		return nil
+	case 1: // PROXY
+	default:
+		return ErrInvalidProxyHeader
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC and AF_UNIX keep the addresses of the connection
+		return nil
+	}
+	if len(data) < 2*ipLen+4 {
+		return ErrInvalidProxyHeader
+	}
+
+	// TLVs after the addresses are ignored.
+	c.remoteAddr = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[:ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen:])),
+	}
+	c.localAddr = &net.TCPAddr{
+		IP:   net.IP(append([]byte(nil), data[ipLen:2*ipLen]...)),
+		Port: int(binary.BigEndian.Uint16(data[2*ipLen+2:])),
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type connAddrPlugin struct {
+	addrs chan net.Addr
+}
+
+func (p *connAddrPlugin) HandleConnAccept(conn net.Conn) (net.Conn, bool) {
+	p.addrs <- conn.RemoteAddr()
+	return conn, true
+}
+
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x21, 0x11, 0, 12)
+	header = append(header, src.IP.To4()...)
+	header = append(header, dst.IP.To4()...)
+	header = binary.BigEndian.AppendUint16(header, uint16(src.Port))
+	return binary.BigEndian.AppendUint16(header, uint16(dst.Port))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.0.11").To4(), Port: 8972}
+
+	cases := map[string][]byte{
+		"v1": []byte("PROXY TCP4 203.0.113.7 192.168.0.11 56324 8972\r\n"),
+		"v2": proxyV2Header(src, dst),
+	}
+	for name, header := range cases {
+		client, server := net.Pipe()
+		go func() {
+			_, _ = client.Write(append(header, "irpc"...))
+		}()
+
+		pc, err := readProxyHeader(server)
+		assert.NoError(t, err, name)
+		assert.Equal(t, src.String(), pc.RemoteAddr().String(), name)
+		assert.Equal(t, dst.String(), pc.LocalAddr().String(), name)
+
+		// data after the header is kept
+		buf := make([]byte, 4)
+		_, err = pc.Read(buf)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "irpc", string(buf), name)
+		_ = client.Close()
+	}
+
+	client, server := net.Pipe()
+	go func() { _, _ = client.Write([]byte("PROXY TCP4 bad\r\n")) }()
+	_, err := readProxyHeader(server)
+	assert.Equal(t, ErrInvalidProxyHeader, err)
+	_ = client.Close()
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("10.0.0.0/8")
+
+	for _, c := range []struct {
+		trusted  []*net.IPNet
+		expected string
+	}{
+		{[]*net.IPNet{loopback}, "203.0.113.7:56324"},
+		// headers of untrusted peers are not parsed
+		{[]*net.IPNet{other}, ""},
+		{nil, ""},
+	} {
+		plugin := &connAddrPlugin{addrs: make(chan net.Addr, 1)}
+		s := New(WithProxyProtocol(c.trusted))
+		s.Plugins.Add(plugin)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		go func() { _ = s.ServeListener(ln) }()
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		assert.NoError(t, err)
+		_, err = conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 56324 8972\r\n"))
+		assert.NoError(t, err)
+
+		addr := <-plugin.addrs
+		if c.expected != "" {
+			assert.Equal(t, c.expected, addr.String())
+		} else {
+			assert.Equal(t, conn.LocalAddr().String(), addr.String())
+		}
+
+		_ = conn.Close()
+		_ = s.Close()
+	}
+}
+
+func TestProxyProtocolServe(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	plugin := &connAddrPlugin{addrs: make(chan net.Addr, 1)}
+	s := New(WithProxyProtocol([]*net.IPNet{loopback}))
+	s.Plugins.Add(plugin)
+	go func() { _ = s.Serve("tcp", "127.0.0.1:0") }()
+	defer s.Close()
+	assert.Eventually(t, func() bool { return s.Address() != nil }, time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp", s.Address().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// the gateway matches the request after the header
+	heartbeat := protocol.NewMessage()
+	heartbeat.SetMessageType(protocol.Request)
+	heartbeat.SetSeq(1)
+	heartbeat.SetHeartbeat(true)
+	_, err = conn.Write(append([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 56324 8972\r\n"), heartbeat.Encode()...))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "203.0.113.7:56324", (<-plugin.addrs).String())
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	res := protocol.NewMessage()
+	assert.NoError(t, res.Decode(conn))
+	assert.True(t, res.IsHeartbeat())
+	assert.Equal(t, uint64(1), res.Seq())
+}
@@ -4,22 +4,172 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"net"
+	"sync"
+
+	"github.com/derekAHua/irpc/share"
+	"github.com/quic-go/quic-go"
 )
 
 func init() {
 	makeListeners["quic"] = quicMakeListener
 }
 
+// quicMakeListener listens for QUIC connections, and every stream opened by clients is an irpc connection.
+// 0-RTT is only accepted if it is allowed by WithQUICConfig.
 func quicMakeListener(s *Server, address string) (ln net.Listener, err error) {
 	if s.tlsConfig == nil {
 		return nil, errors.New("TLSConfig must be configured in server.Options")
 	}
 
-	if len(s.tlsConfig.NextProtos) == 0 {
-		s.tlsConfig.NextProtos = []string{"irpc"}
+	// the config may be shared by TLS listeners of other networks
+	tlsConfig := s.tlsConfig
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{share.QUICNextProto}
+	}
+
+	config, _ := s.options["QUICConfig"].(*quic.Config)
+	if config == nil {
+		config = &quic.Config{}
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// established connections are not closed with the listener, so that in-flight requests can be drained.
+	tr := &quic.Transport{Conn: udpConn}
+	l, err := tr.ListenEarly(tlsConfig, config)
+	if err != nil {
+		_ = udpConn.Close()
+		return nil, err
+	}
+
+	qln := &quicListener{
+		tr:      tr,
+		ln:      l,
+		streams: make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	go qln.acceptConns()
+	return qln, nil
+}
+
+// quicListener accepts streams of QUIC connections as irpc connections.
+type quicListener struct {
+	tr *quic.Transport
+	ln *quic.EarlyListener
+
+	streams   chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	mu     sync.Mutex
+	active int  // streams not closed
+	closed bool // the transport is closed after the listener is closed and all streams are closed
+}
+
+func (ln *quicListener) acceptConns() {
+	for {
+		conn, err := ln.ln.Accept(context.Background())
+		if err != nil {
+			ln.close(err)
+			return
+		}
+		go ln.acceptStreams(conn)
 	}
+}
+
+func (ln *quicListener) acceptStreams(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(conn.Context())
+		if err != nil {
+			return
+		}
 
-	return quick.Listen("udp", address, s.tlsConfig, nil)
+		ln.mu.Lock()
+		if ln.closed {
+			ln.mu.Unlock()
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			continue
+		}
+		ln.active++
+		ln.mu.Unlock()
+
+		select {
+		case ln.streams <- share.NewQUICStreamConn(conn, stream, ln.release):
+		case <-ln.done:
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+			ln.release()
+		}
+	}
+}
+
+// release closes the transport if the listener is closed and it is the last stream.
+func (ln *quicListener) release() {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	ln.active--
+	if ln.closed && ln.active == 0 {
+		ln.closeTransport()
+	}
+}
+
+func (ln *quicListener) closeTransport() {
+	_ = ln.tr.Close()
+	_ = ln.tr.Conn.Close()
+}
+
+func (ln *quicListener) close(err error) {
+	ln.closeOnce.Do(func() {
+		ln.err = err
+		close(ln.done)
+
+		ln.mu.Lock()
+		ln.closed = true
+		if ln.active == 0 {
+			ln.closeTransport()
+		}
+		ln.mu.Unlock()
+	})
+}
+
+func (ln *quicListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.streams:
+		return conn, nil
+	case <-ln.done:
+		return nil, ln.err
+	}
+}
+
+// Close stops accepting connections and streams. Established streams are closed by the server.
+func (ln *quicListener) Close() error {
+	err := ln.ln.Close()
+	ln.close(net.ErrClosed)
+	return err
+}
+
+func (ln *quicListener) Addr() net.Addr {
+	return ln.ln.Addr()
+}
+
+// WithQUICConfig sets the config of QUIC connections. By default the defaults of quic-go are used.
+// Set Allow0RTT to accept requests in 0-RTT data of resumed connections, which saves a round trip
+// but lets attackers replay the requests, so it should only be allowed if all services are idempotent.
+func WithQUICConfig(config *quic.Config) Option {
+	return func(s *Server) {
+		s.options["QUICConfig"] = config
+	}
 }
@@ -0,0 +1,82 @@
+//go:build quic
+// +build quic
+
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTLSConfigs(t *testing.T) (serverConfig, clientConfig *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	serverConfig = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	clientConfig = &tls.Config{RootCAs: pool}
+	return
+}
+
+func TestQUIC(t *testing.T) {
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+
+	s := New(WithTLSConfig(serverConfig))
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	ln, err := s.makeListener("quic", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	opt := client.DefaultOption
+	opt.TLSConfig = clientConfig
+
+	call := func(cli *client.Client, a int) {
+		reply := &Reply{}
+		assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: a, B: 20}, reply))
+		assert.Equal(t, a*20, reply.C)
+	}
+
+	// both clients are streams of one QUIC connection
+	cli1 := client.NewClient(opt)
+	assert.NoError(t, cli1.Connect("quic", ln.Addr().String()))
+	cli2 := client.NewClient(opt)
+	assert.NoError(t, cli2.Connect("quic", ln.Addr().String()))
+	assert.Equal(t, cli1.Conn.LocalAddr().String(), cli2.Conn.LocalAddr().String())
+	call(cli1, 1)
+	call(cli2, 2)
+
+	assert.NoError(t, cli1.Close())
+	call(cli2, 3)
+	assert.NoError(t, cli2.Close())
+
+	// the connection is closed with its last stream, and a new one resumes the session
+	cli3 := client.NewClient(opt)
+	assert.NoError(t, cli3.Connect("quic", ln.Addr().String()))
+	defer func() { _ = cli3.Close() }()
+	call(cli3, 4)
+
+	assert.Empty(t, serverConfig.NextProtos)
+}
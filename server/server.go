@@ -28,25 +28,68 @@ var (
 	// ErrServerClosed is returned by the Server.ServeListener after a call Server.Shutdown or Server.Close.
 	ErrServerClosed  = errors.New("ServeListener: Server closed")
 	ErrReqReachLimit = errors.New("request reached rate limit")
+	// ErrServerOverloaded is returned to requests rejected by the handler pool set by WithHandlerPool,
+	// or because the worker queue of WithEventLoop is full.
+	// The requests have not been handled, so clients can retry them on other servers.
+	ErrServerOverloaded = errors.New("server is overloaded")
+	// ErrDeadlineExceeded is returned to requests whose deadlines set by clients in protocol.ExtDeadline or share.ServerTimeout
+	// have passed before they are handled.
+	ErrDeadlineExceeded = errors.New("request deadline exceeded before handling")
 )
 
 const (
 	// ReaderBuffSize is used for bufio.Reader.
 	ReaderBuffSize = 1024
 
-	//// WriteChanSize is used for response.
-	//WriteChanSize = 1024 * 1024
+	// maxChunkAssemblies is the max number of chunked requests a connection can send at the same time.
+	maxChunkAssemblies = 256
+
+	// WriteChanSize is the number of responses queued for the write loop of a connection with write coalescing.
+	WriteChanSize = 1024
 )
 
 type Handler func(ctx *Context) error
 
 // Server is the irpc server that use TCP or UDP.
 type Server struct {
-	ln           net.Listener
+	// lns are the listeners being served, and one server can serve any number of listeners.
+	lns          []net.Listener
 	readTimeout  time.Duration
 	writeTimeout time.Duration
 
-	gatewayHTTPServer  *http.Server
+	// chunkSize splits large payloads of responses into chunk frames.
+	chunkSize int
+	// maxPayloadSizes limits payload sizes of requests by service, and "" is the default.
+	maxPayloadSizes map[string]int
+	// checksum adds checksums to responses to v2 requests.
+	checksum bool
+	// compressThreshold is the payload size over which responses are compressed.
+	compressThreshold int
+	// zeroCopyDecode decodes requests by protocol.Message.DecodeZeroCopy.
+	zeroCopyDecode bool
+	// proxyProtocol parses PROXY protocol headers of accepted connections if it is set.
+	proxyProtocol *proxyProtocol
+	// writeBatchBytes and writeBatchDelay coalesce responses of AsyncWrite.
+	writeBatchBytes int
+	writeBatchDelay time.Duration
+	// eventLoopWorkers serves connections by the event loop with so many workers if it is positive.
+	eventLoopWorkers int
+	eventLoopOnce    sync.Once
+	eventLoop        *netpoller
+	eventLoopErr     error
+	// handlerWorkers handles requests by a pool of so many workers if it is positive,
+	// which queues at most handlerQueueSize requests for at most handlerQueueWait.
+	handlerWorkers   int
+	handlerQueueSize int
+	handlerQueueWait time.Duration
+	handlerPoolOnce  sync.Once
+	handlerPool      *handlerPool
+	// adaptiveLimiter limits in-flight requests of each method by their latency if it is set.
+	adaptiveLimiter *adaptiveLimiter
+	// concurrencyLimiter limits concurrent requests of services and methods set by SetConcurrencyLimit.
+	concurrencyLimiter concurrencyLimiter
+
+	gatewayHTTPServers []*http.Server
 	DisableHTTPGateway bool // should disable http invoke or not.
 	DisableJSONRPC     bool // should disable json rpc or not.
 	AsyncWrite         bool // set true if your server only serves few clients
@@ -79,6 +122,9 @@ type Server struct {
 	AuthFunc func(ctx context.Context, req *protocol.Message, token string) error
 
 	handlerMsgNum int32
+	// asyncWriters is the number of connections whose responses are written by serveAsyncWrite,
+	// which Shutdown waits for to flush the responses before closing the connections.
+	asyncWriters int32
 
 	HandleServiceError func(error)
 }
@@ -93,6 +139,8 @@ func New(options ...Option) *Server {
 		serviceMap: make(map[string]*service),
 		router:     make(map[string]Handler),
 		AsyncWrite: false, // 除非你想做进一步优化测试，否则建议你设置为false
+
+		compressThreshold: protocol.DefaultCompressThreshold,
 	}
 
 	for _, op := range options {
@@ -105,6 +153,8 @@ func New(options ...Option) *Server {
 	return s
 }
 
+// AddHandler adds handler for servicePath.serviceMethod, which takes precedence over registered services.
+// Handlers are called without PreCallPlugin and PostCallPlugin, which check registered methods and functions.
 func (s *Server) AddHandler(servicePath, serviceMethod string, handler func(*Context) error) {
 	s.router[servicePath+"."+serviceMethod] = handler
 }
@@ -116,7 +166,11 @@ func (s *Server) readRequest(ctx context.Context, r io.Reader) (req *protocol.Me
 	}
 
 	req = protocol.GetPooledMsg()
-	err = req.Decode(r)
+	if s.zeroCopyDecode {
+		err = req.DecodeZeroCopy(r)
+	} else {
+		err = req.Decode(r)
+	}
 	if err == io.EOF {
 		return
 	}
@@ -139,7 +193,12 @@ func (s *Server) auth(ctx context.Context, req *protocol.Message) (err error) {
 }
 
 func (s *Server) handleRequest(ctx context.Context, req *protocol.Message) (res *protocol.Message, err error) {
-	defer res.HandleError(err)
+	// errors of plugins and methods are sent to the client
+	defer func() {
+		if res != nil {
+			res.HandleError(err)
+		}
+	}()
 
 	serviceName := req.ServicePath
 	methodName := req.ServiceMethod
@@ -172,6 +231,10 @@ func (s *Server) handleRequest(ctx context.Context, req *protocol.Message) (res
 		res.HandleError(errors.New("irpc: can't find method " + methodName))
 		return
 	}
+	if mType.stream {
+		res.HandleError(errors.New("irpc: method " + methodName + " is a streaming method"))
+		return
+	}
 
 	// get a argv object from object pool.
 	argv := reflectTypePools.Get(mType.ArgType)
@@ -238,12 +301,21 @@ func (s *Server) handleRequestForFunction(ctx context.Context, service *service,
 	reply := reflectTypePools.Get(mType.ReplyType)
 	defer reflectTypePools.Put(mType.ReplyType, reply)
 
+	// functions are checked by plugins as methods are, such as the access rules of methods.
+	argv, err = s.Plugins.DoPreCall(ctx, req.ServicePath, req.ServiceMethod, argv)
+	if err != nil {
+		return
+	}
+
 	if mType.ArgType.Kind() != reflect.Ptr {
 		err = service.callForFunction(ctx, mType, reflect.ValueOf(argv).Elem(), reflect.ValueOf(reply))
 	} else {
 		err = service.callForFunction(ctx, mType, reflect.ValueOf(argv), reflect.ValueOf(reply))
 	}
 
+	if err == nil {
+		reply, err = s.Plugins.DoPostCall(ctx, req.ServicePath, req.ServiceMethod, argv, reply)
+	}
 	if err != nil {
 		return
 	}
@@ -260,14 +332,64 @@ func (s *Server) handleRequestForFunction(ctx context.Context, service *service,
 
 // ----------------------------------------------------------------------------------------------------------------
 
-// Address returns listened address.
+// Address returns the address of the first listener, or nil if the server is not serving.
+// Use Addresses for servers with several listeners.
 func (s *Server) Address() net.Addr {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if s.ln == nil {
+	if len(s.lns) == 0 {
 		return nil
 	}
-	return s.ln.Addr()
+	return s.lns[0].Addr()
+}
+
+// Addresses returns the addresses of all listeners being served.
+func (s *Server) Addresses() []net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]net.Addr, 0, len(s.lns))
+	for _, ln := range s.lns {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// addListener tracks ln, so that it is closed with the server.
+// It returns false if the server has been closed.
+func (s *Server) addListener(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isShutdown() {
+		return false
+	}
+	select {
+	case <-s.doneChan:
+		return false
+	default:
+	}
+	s.lns = append(s.lns, ln)
+	return true
+}
+
+func (s *Server) removeListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, l := range s.lns {
+		if l == ln {
+			s.lns = append(s.lns[:i], s.lns[i+1:]...)
+			return
+		}
+	}
+}
+
+// closeListenersLocked closes all listeners and returns the first error.
+func (s *Server) closeListenersLocked() (err error) {
+	for _, ln := range s.lns {
+		if e := ln.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
 }
 
 // ActiveClientConn returns active connections.
@@ -317,15 +439,12 @@ func (s *Server) getDoneChan() <-chan struct{} {
 	return s.doneChan
 }
 
-// Close immediately closes all active net.Listeners.
+// Close immediately closes all active net.Listeners and connections.
 func (s *Server) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var err error
-	if s.ln != nil {
-		err = s.ln.Close()
-	}
+	err := s.closeListenersLocked()
 	for c := range s.activeConn {
 		_ = c.Close()
 		delete(s.activeConn, c)
@@ -354,8 +473,9 @@ var shutdownPollInterval = 1000 * time.Millisecond
 
 // Shutdown gracefully shuts down the server without interrupting any
 // active connections. Shutdown works by first closing the
-// listener, then closing all idle connections, and then waiting
-// indefinitely for connections to return to idle and then shut down.
+// listener, then stopping reading requests and sending a GoAway frame
+// to every client, and then waiting indefinitely for in-flight requests
+// to finish before closing the connections.
 // If the provided context expires before the shutdown is complete,
 // Shutdown returns the context's error, otherwise it returns any
 // error returned from closing the Server's underlying Listener.
@@ -371,10 +491,13 @@ func (s *Server) Shutdown(ctx context.Context) (err error) {
 			}
 		}
 
-		_ = s.ln.Close()
+		_ = s.closeListenersLocked()
+		// stop reading new requests, so that serveConn tells clients to go away.
 		for conn := range s.activeConn {
-			if tcpConn, ok := conn.(*net.TCPConn); ok {
-				_ = tcpConn.CloseRead()
+			if cr, ok := conn.(closeReader); ok {
+				_ = cr.CloseRead()
+			} else {
+				_ = conn.SetReadDeadline(time.Now())
 			}
 		}
 		s.mu.Unlock()
@@ -395,12 +518,9 @@ func (s *Server) Shutdown(ctx context.Context) (err error) {
 			}
 		}
 
-		if s.gatewayHTTPServer != nil {
-			if err = s.closeHTTP1APIGateway(ctx); err != nil {
-				log.Warnf("failed to close gateway: %v", err)
-			} else {
-				log.Info("closed gateway")
-			}
+		if gerr := s.closeHTTP1APIGateway(ctx); gerr != nil {
+			err = gerr
+			log.Warnf("failed to close gateway: %v", err)
 		}
 
 		s.mu.Lock()
@@ -459,7 +579,7 @@ func (s *Server) startProcess() (int, error) {
 func (s *Server) checkProcessMsg() bool {
 	size := atomic.LoadInt32(&s.handlerMsgNum)
 	log.Info("need handle in-processing msg size:", size)
-	return size == 0
+	return size == 0 && atomic.LoadInt32(&s.asyncWriters) == 0
 }
 
 func (s *Server) closeDoneChanLocked() {
@@ -12,6 +12,20 @@ func (s *Server) getService(serviceName string) *service {
 	return s.serviceMap[serviceName]
 }
 
+// hasMethod reports whether serviceMethod of servicePath is registered as a method, a function or a handler.
+func (s *Server) hasMethod(servicePath, serviceMethod string) bool {
+	if _, ok := s.router[servicePath+"."+serviceMethod]; ok {
+		return true
+	}
+	service := s.getService(servicePath)
+	return service != nil && (service.method[serviceMethod] != nil || service.function[serviceMethod] != nil)
+}
+
+// closeReader is implemented by TCP and unix connections, whose reads return io.EOF after CloseRead.
+type closeReader interface {
+	CloseRead() error
+}
+
 func (s *Server) closeConn(conn net.Conn) {
 	s.deleteActiveConn(conn)
 	_ = conn.Close()
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"sync"
+
+	"github.com/derekAHua/irpc/share"
+)
+
+// callSet holds the cancel functions of in-flight requests of one connection,
+// so that cancellation frames from the client can reach the service methods.
+type callSet struct {
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+}
+
+func newCallSet() *callSet {
+	return &callSet{cancels: make(map[uint64]context.CancelFunc)}
+}
+
+// add makes ctx cancelable and registers it with seq.
+func (cs *callSet) add(ctx *share.Context, seq uint64) {
+	var cancel context.CancelFunc
+	ctx.Context, cancel = context.WithCancel(ctx.Context)
+
+	cs.mu.Lock()
+	cs.cancels[seq] = cancel
+	cs.mu.Unlock()
+}
+
+// remove unregisters seq and releases its context.
+func (cs *callSet) remove(seq uint64) {
+	cs.mu.Lock()
+	cancel := cs.cancels[seq]
+	delete(cs.cancels, seq)
+	cs.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// seqs returns the seqs of the in-flight requests.
+func (cs *callSet) seqs() []uint64 {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(cs.cancels))
+	for seq := range cs.cancels {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// cancelAll cancels all in-flight requests. It is called when the connection is closed.
+func (cs *callSet) cancelAll() {
+	cs.mu.Lock()
+	cancels := cs.cancels
+	cs.cancels = make(map[uint64]context.CancelFunc)
+	cs.mu.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type Blocker struct {
+	canceled chan error
+}
+
+func (b *Blocker) Wait(ctx context.Context, _ *Args, _ *Reply) error {
+	select {
+	case <-ctx.Done():
+		b.canceled <- ctx.Err()
+	case <-time.After(5 * time.Second):
+		b.canceled <- nil
+	}
+	return nil
+}
+
+func TestClientCancelPropagation(t *testing.T) {
+	b := &Blocker{canceled: make(chan error, 1)}
+	s := New()
+	assert.NoError(t, s.RegisterName("Blocker", b, ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = cli.Call(ctx, "Blocker", "Wait", &Args{}, &Reply{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, context.Canceled, <-b.canceled)
+}
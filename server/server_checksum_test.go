@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingArith struct {
+	Arith
+	calls int
+}
+
+func (t *countingArith) Mul(ctx context.Context, args *Args, reply *Reply) error {
+	t.calls++
+	return t.Arith.Mul(ctx, args, reply)
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	arith := &countingArith{}
+	s := New()
+	assert.NoError(t, s.RegisterName("Arith", arith, ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+	r := bufio.NewReader(conn)
+
+	req := protocol.NewMessage()
+	req.SetMessageType(protocol.Request)
+	req.SetSerializeType(protocol.JSON)
+	req.SetChecksum(true)
+	req.ServicePath = "Arith"
+	req.ServiceMethod = "Mul"
+	req.Payload, _ = json.Marshal(&Args{A: 10, B: 20})
+
+	// corrupt the payload
+	req.SetSeq(1)
+	data := req.Encode()
+	data[len(data)-6] ^= 0x01
+	_, err = conn.Write(data)
+	assert.NoError(t, err)
+
+	res := protocol.NewMessage()
+	assert.NoError(t, res.Decode(r))
+	assert.Equal(t, uint64(1), res.Seq())
+	assert.Equal(t, protocol.Error, res.MessageStatusType())
+	assert.Equal(t, protocol.ErrChecksumMismatch.Error(), res.Metadata[protocol.ServiceError])
+	assert.Equal(t, 0, arith.calls)
+
+	// the connection is still usable, and the response has a checksum
+	req.SetSeq(2)
+	_, err = conn.Write(req.Encode())
+	assert.NoError(t, err)
+
+	res = protocol.NewMessage()
+	assert.NoError(t, res.Decode(r))
+	assert.Equal(t, uint64(2), res.Seq())
+	assert.True(t, res.HasChecksum())
+	reply := &Reply{}
+	assert.NoError(t, json.Unmarshal(res.Payload, reply))
+	assert.Equal(t, 200, reply.C)
+	assert.Equal(t, 1, arith.calls)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+	"github.com/stretchr/testify/assert"
+)
+
+type Blob struct {
+	Data []byte
+}
+
+type BlobEcho int
+
+func (e *BlobEcho) Echo(_ context.Context, args *Blob, reply *Blob) error {
+	reply.Data = args.Data
+	return nil
+}
+
+func TestChunkedCall(t *testing.T) {
+	s := New(WithChunkSize(4096), WithMaxPayloadSize("Limited", 16<<10))
+	assert.NoError(t, s.RegisterName("BlobEcho", new(BlobEcho), ""))
+	assert.NoError(t, s.RegisterName("Limited", new(BlobEcho), ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	opt := client.DefaultOption
+	opt.ProtocolVersion = protocol.Version2
+	opt.ChunkSize = 4096
+	opt.CompressType = protocol.Gzip
+	cli := client.NewClient(opt)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+
+	data := bytes.Repeat([]byte("irpc chunk "), 10000)
+
+	reply := &Blob{}
+	assert.NoError(t, cli.Call(context.Background(), "BlobEcho", "Echo", &Blob{Data: data}, reply))
+	assert.Equal(t, data, reply.Data)
+
+	// the payload of the response is written to the writer
+	var buf bytes.Buffer
+	ctx := context.WithValue(context.Background(), share.ResPayloadWriterKey, &buf)
+	assert.NoError(t, cli.Call(ctx, "BlobEcho", "Echo", &Blob{Data: data}, &Blob{}))
+	reply = &Blob{}
+	assert.NoError(t, share.Codecs[opt.SerializeType].Decode(buf.Bytes(), reply))
+	assert.Equal(t, data, reply.Data)
+
+	// the limit of the service is checked during reassembly
+	err = cli.Call(context.Background(), "Limited", "Echo", &Blob{Data: data}, &Blob{})
+	assert.EqualError(t, err, protocol.ErrPayloadTooLarge.Error())
+
+	// the connection is still usable
+	reply = &Blob{}
+	assert.NoError(t, cli.Call(context.Background(), "Limited", "Echo", &Blob{Data: data[:100]}, reply))
+	assert.Equal(t, data[:100], reply.Data)
+}
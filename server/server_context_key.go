@@ -25,4 +25,12 @@ var (
 
 	// HttpConnContextKey is used to store http connection.
 	HttpConnContextKey = &contextKey{"http-conn"}
+
+	// PeerIdentityContextKey is used to store the identity of the client verified by mutual TLS.
+	// The associated value will be of type *PeerIdentity, and it is absent if the client has no certificate.
+	PeerIdentityContextKey = &contextKey{"peer-identity"}
+
+	// PeerCredContextKey is used to store the credentials of the client connected by a unix socket.
+	// The associated value will be of type *PeerCred, and it is absent for other connections.
+	PeerCredContextKey = &contextKey{"peer-cred"}
 )
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+type Sleeper struct {
+	name string
+}
+
+func (s *Sleeper) Sleep(_ context.Context, args *Args, reply *Reply) error {
+	time.Sleep(time.Duration(args.A) * time.Millisecond)
+	reply.C = args.A
+	return nil
+}
+
+func (s *Sleeper) Name(_ context.Context, _ *Args, reply *string) error {
+	*reply = s.name
+	return nil
+}
+
+func startSleeperServer(t *testing.T, name string, options ...Option) (*Server, string) {
+	s := New(options...)
+	assert.NoError(t, s.RegisterName("Sleeper", &Sleeper{name: name}, ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+
+	return s, ln.Addr().String()
+}
+
+func TestShutdownGoAway(t *testing.T) {
+	for _, async := range []bool{false, true} {
+		testShutdownGoAway(t, async)
+	}
+}
+
+func testShutdownGoAway(t *testing.T, async bool) {
+	s, addr := startSleeperServer(t, "s", func(s *Server) { s.AsyncWrite = async })
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr))
+	defer func() { _ = cli.Close() }()
+
+	call := cli.Go(context.Background(), "Sleeper", "Sleep", &Args{A: 300}, &Reply{}, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	go func() { _ = s.Shutdown(context.Background()) }()
+
+	// requests sent after the server stops reading are failed by the GoAway and can be retried
+	var err error
+	for i := 0; i < 100; i++ {
+		err = cli.Call(context.Background(), "Sleeper", "Sleep", &Args{A: 1}, &Reply{})
+		if err != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, client.ErrServerGoingAway, err)
+
+	// the in-flight request is drained
+	call = <-call.Done
+	assert.NoError(t, call.Error)
+	assert.Equal(t, 300, call.Reply.(*Reply).C)
+}
+
+func TestXClientGoAwayFailover(t *testing.T) {
+	s1, addr1 := startSleeperServer(t, "s1")
+	s2, addr2 := startSleeperServer(t, "s2")
+	defer func() { _ = s2.Close() }()
+
+	d, err := client.NewMultipleServersDiscovery([]*client.KVPair{{Key: "tcp@" + addr1}, {Key: "tcp@" + addr2}})
+	assert.NoError(t, err)
+	xc := client.NewXClient("Sleeper", client.Failfast, client.RoundRobin, d, client.DefaultOption)
+	defer func() { _ = xc.Close() }()
+
+	// connect to both servers
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, xc.Call(context.Background(), "Sleep", &Args{A: 1}, &Reply{}))
+	}
+
+	// keep s1 draining while it goes away
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr1))
+	defer func() { _ = cli.Close() }()
+	call := cli.Go(context.Background(), "Sleeper", "Sleep", &Args{A: 500}, &Reply{}, nil)
+	time.Sleep(50 * time.Millisecond)
+	go func() { _ = s1.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 4; i++ {
+		var name string
+		assert.NoError(t, xc.Call(context.Background(), "Name", &Args{}, &name))
+		assert.Equal(t, "s2", name)
+	}
+
+	assert.NoError(t, (<-call.Done).Error)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+)
+
+// handshake replies to the handshake req with what the server supports, and authenticates the connection
+// by AuthFunc if it is set, so that the following requests are not authenticated again.
+// It returns the error of the authentication, and the connection should be closed if it is not nil.
+func (s *Server) handshake(ctx *share.Context, conn net.Conn, writeCh chan *[]byte, req *protocol.Message) error {
+	defer protocol.FreeMsg(req)
+
+	res := req.Clone()
+	res.SetMessageType(protocol.Response)
+	res.SetSerializeType(protocol.JSON)
+	defer protocol.FreeMsg(res)
+
+	hs := protocol.NewHandshake(share.SerializeTypes())
+	data, err := json.Marshal(hs)
+	if err != nil {
+		return err
+	}
+	// the payload is always sent, so that clients can tell an authentication failure from a server without handshakes.
+	res.Payload = data
+
+	err = s.auth(ctx, req)
+	res.HandleError(err)
+	_ = s.writeResponse(conn, writeCh, res)
+	return err
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshake(t *testing.T) {
+	var auths int32
+	s := New()
+	s.AuthFunc = func(_ context.Context, _ *protocol.Message, token string) error {
+		atomic.AddInt32(&auths, 1)
+		if token != "secret" {
+			return errors.New("invalid token")
+		}
+		return nil
+	}
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	opt := client.DefaultOption
+	opt.Handshake = true
+	opt.Auth = "secret"
+	opt.ProtocolVersion = protocol.Version2
+	opt.CompressType = protocol.CompressType(7) // unknown to the server
+	cli := client.NewClient(opt)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+
+	// the connection is authenticated once
+	for i := 0; i < 3; i++ {
+		reply := &Reply{}
+		assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: 10, B: i}, reply))
+		assert.Equal(t, 10*i, reply.C)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&auths))
+
+	opt.Auth = "wrong"
+	cli2 := client.NewClient(opt)
+	assert.EqualError(t, cli2.Connect("tcp", ln.Addr().String()), "invalid token")
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeMultipleListeners(t *testing.T) {
+	s := New()
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	unixLn, err := net.Listen("unix", filepath.Join(t.TempDir(), "irpc.sock"))
+	assert.NoError(t, err)
+
+	errs := make(chan error, 2)
+	for _, ln := range []net.Listener{tcpLn, unixLn} {
+		ln := ln
+		go func() { errs <- s.ServeListener(ln) }()
+	}
+	assert.Eventually(t, func() bool {
+		return len(s.Addresses()) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.ElementsMatch(t, []net.Addr{tcpLn.Addr(), unixLn.Addr()}, s.Addresses())
+
+	for _, addr := range s.Addresses() {
+		cli := client.NewClient(client.DefaultOption)
+		assert.NoError(t, cli.Connect(addr.Network(), addr.String()))
+		reply := &Reply{}
+		assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: 10, B: 20}, reply))
+		assert.Equal(t, 200, reply.C)
+		_ = cli.Close()
+	}
+
+	// all listeners are closed with the server
+	assert.NoError(t, s.Close())
+	for i := 0; i < 2; i++ {
+		select {
+		case <-errs:
+		case <-time.After(time.Second):
+			t.Fatal("listener is not closed")
+		}
+	}
+	assert.Empty(t, s.Addresses())
+	assert.Equal(t, ErrServerClosed, s.ServeListener(tcpLn))
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"github.com/derekAHua/irpc/log"
 	"github.com/derekAHua/irpc/protocol"
@@ -14,12 +15,14 @@ import (
 	"net"
 	"net/http"
 	"runtime"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 // Serve starts and listens RPC requests.
 // It is blocking until receiving connections from clients.
+// Serve can be called concurrently to serve several networks and addresses by one server.
 func (s *Server) Serve(network, address string) (err error) {
 	var ln net.Listener
 	ln, err = s.makeListener(network, address)
@@ -29,7 +32,11 @@ func (s *Server) Serve(network, address string) (err error) {
 
 	switch network {
 	case "http", "ws", "wss":
-		s.ln = ln
+		if !s.addListener(ln) {
+			_ = ln.Close()
+			return ErrServerClosed
+		}
+		defer s.removeListener(ln)
 		rpcPath := share.DefaultRPCPath
 		mux := http.NewServeMux()
 
@@ -42,9 +49,13 @@ func (s *Server) Serve(network, address string) (err error) {
 		srv := &http.Server{Handler: mux}
 		err = srv.Serve(ln)
 	default:
+		if s.proxyProtocol != nil {
+			// headers are read before the gateway, so that it matches what follows them
+			ln = s.proxyProtocol.listener(ln, s.tlsConfig)
+		}
 		// try to start gateway
 		ln = s.startGateway(network, ln)
-		err = s.ServeListener(ln)
+		err = s.serveListener(ln)
 	}
 
 	return
@@ -79,10 +90,20 @@ func (s *Server) ServeWS(conn *websocket.Conn) {
 // ServeListener accepts incoming connections on the Listener ln,
 // creating a new service goroutine for each.
 // The service goroutines read requests and then call services to reply to them.
+// ServeListener can be called concurrently with other listeners, which are all closed with the server.
 func (s *Server) ServeListener(ln net.Listener) (err error) {
-	s.mu.Lock()
-	s.ln = ln
-	s.mu.Unlock()
+	if s.proxyProtocol != nil {
+		ln = s.proxyProtocol.listener(ln, s.tlsConfig)
+	}
+	return s.serveListener(ln)
+}
+
+func (s *Server) serveListener(ln net.Listener) (err error) {
+	if !s.addListener(ln) {
+		_ = ln.Close()
+		return ErrServerClosed
+	}
+	defer s.removeListener(ln)
 
 	var (
 		tempDelay time.Duration
@@ -127,7 +148,11 @@ func (s *Server) ServeListener(ln net.Listener) (err error) {
 
 		tempDelay = 0 // reset delay time
 
-		if tc, ok = conn.(*net.TCPConn); ok {
+		raw := conn
+		if pc, isProxy := conn.(*proxyConn); isProxy {
+			raw = pc.Conn
+		}
+		if tc, ok = raw.(*net.TCPConn); ok {
 			if period := s.options["TCPKeepAlivePeriod"]; period != nil {
 				_ = tc.SetKeepAlive(true)
 				_ = tc.SetKeepAlivePeriod(period.(time.Duration))
@@ -135,32 +160,42 @@ func (s *Server) ServeListener(ln net.Listener) (err error) {
 			}
 		}
 
-		if conn, ok = s.Plugins.DoPostConnAccept(conn); !ok {
-			_ = conn.Close()
-			continue
-		}
+		s.acceptConn(conn)
+	}
+}
 
-		if tlsConn, ok := conn.(*tls.Conn); ok {
-			if d := s.readTimeout; d != 0 {
-				_ = conn.SetReadDeadline(time.Now().Add(d))
-			}
-			if d := s.writeTimeout; d != 0 {
-				_ = conn.SetWriteDeadline(time.Now().Add(d))
-			}
-			if err = tlsConn.Handshake(); err != nil {
-				log.Errorf("irpc: TLS handshake error from %s: %v", conn.RemoteAddr(), err)
-				return
-			}
+// acceptConn invokes plugins and the TLS handshake of the accepted conn and serves it.
+func (s *Server) acceptConn(conn net.Conn) {
+	conn, ok := s.Plugins.DoPostConnAccept(conn)
+	if !ok {
+		_ = conn.Close()
+		return
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if d := s.readTimeout; d != 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(d))
+		}
+		if d := s.writeTimeout; d != 0 {
+			_ = conn.SetWriteDeadline(time.Now().Add(d))
 		}
+		if err := tlsConn.Handshake(); err != nil {
+			log.Errorf("irpc: TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+	}
 
-		s.setActiveConn(conn)
+	s.setActiveConn(conn)
 
-		if share.Trace {
-			log.Debugf("server accepted an conn: %v", conn.RemoteAddr().String())
-		}
+	if share.Trace {
+		log.Debugf("server accepted an conn: %v", conn.RemoteAddr().String())
+	}
 
-		go s.serveConn(conn)
+	if s.eventLoopWorkers > 0 && s.serveEventLoop(conn) {
+		return
 	}
+	go s.serveConn(conn)
 }
 
 func (s *Server) serveConn(conn net.Conn) {
@@ -196,15 +231,12 @@ func (s *Server) serveConn(conn net.Conn) {
 
 	r := bufio.NewReaderSize(conn, ReaderBuffSize)
 
-	var writeCh chan *[]byte
-	if s.AsyncWrite {
-		writeCh = make(chan *[]byte, 1)
-		defer close(writeCh)
-		go s.serveAsyncWrite(conn, writeCh)
-	}
+	cs := s.newConnState(conn)
+	defer s.closeConnState(cs)
 
 	for {
 		if s.isShutdown() {
+			s.goAway(cs)
 			return
 		}
 
@@ -213,127 +245,399 @@ func (s *Server) serveConn(conn net.Conn) {
 			_ = conn.SetReadDeadline(t0.Add(s.readTimeout))
 		}
 
-		ctx := share.WithValue(context.Background(), RemoteConnContextKey, conn)
-
+		ctx := cs.newContext()
 		req, err := s.readRequest(ctx, r)
-		if err != nil {
-			switch err {
-			case io.EOF:
-				log.Infof("client has closed this connection: %s", conn.RemoteAddr().String())
-			case net.ErrClosed:
-				log.Infof("irpc: connection %s is closed", conn.RemoteAddr().String())
-			case ErrReqReachLimit:
-				s.handleError(ctx, conn, writeCh, req, err)
-				continue
-			default:
-				log.Warnf("irpc: failed to read request: %v", err)
-			}
-			protocol.FreeMsg(req)
+		if !s.handleFrame(ctx, cs, req, err, goDispatch) {
 			return
 		}
+	}
+}
 
-		if share.Trace {
-			log.Debugf("server received an request %+v from conn: %v", req, conn.RemoteAddr().String())
+// connState is the state of a connection shared by the frames read from it.
+type connState struct {
+	conn    net.Conn
+	writeCh chan *[]byte
+	streams *streamSet
+	calls   *callSet
+	chunks  protocol.Assembler
+	peer    *PeerIdentity
+	cred    *PeerCred
+
+	// authenticated is set if the connection has been authenticated in the handshake.
+	authenticated bool
+	// handling counts the requests being handled, which may still write to writeCh.
+	handling sync.WaitGroup
+}
+
+func (s *Server) newConnState(conn net.Conn) *connState {
+	cs := &connState{
+		conn:    conn,
+		streams: newStreamSet(),
+		calls:   newCallSet(),
+		chunks:  protocol.Assembler{MaxSize: s.maxPayloadSize, MaxAssemblies: maxChunkAssemblies},
+		peer:    newPeerIdentity(conn),
+	}
+	cs.cred, _ = GetPeerCred(conn)
+	if s.AsyncWrite {
+		size := 1
+		if s.writeBatchBytes > 0 {
+			size = WriteChanSize
 		}
+		cs.writeCh = make(chan *[]byte, size)
+		atomic.AddInt32(&s.asyncWriters, 1)
+		go s.serveAsyncWrite(conn, cs.writeCh)
+	}
+	return cs
+}
 
-		ctx.SetValue(StartRequestContextKey, time.Now().UnixNano())
-		authFail := false
-		if !req.IsHeartbeat() {
-			err = s.auth(ctx, req)
-			authFail = err != nil
+// closeConnState is called after no more frames are read from the connection.
+func (s *Server) closeConnState(cs *connState) {
+	if cs.writeCh != nil {
+		if s.isShutdown() {
+			// the writer flushes the responses of the drained requests, then Shutdown closes the connection
+			go func() {
+				cs.handling.Wait()
+				close(cs.writeCh)
+			}()
+		} else {
+			close(cs.writeCh)
 		}
+	}
+	// in-flight requests are drained instead of canceled when the server shuts down
+	if !s.isShutdown() {
+		cs.streams.closeAll()
+		cs.calls.cancelAll()
+	}
+}
+
+// newContext returns the context of a request read from the connection.
+func (cs *connState) newContext() *share.Context {
+	ctx := share.WithValue(context.Background(), RemoteConnContextKey, cs.conn)
+	if cs.peer != nil {
+		ctx.SetValue(PeerIdentityContextKey, cs.peer)
+	}
+	if cs.cred != nil {
+		ctx.SetValue(PeerCredContextKey, cs.cred)
+	}
+	return ctx
+}
 
+// goDispatch handles each request in its own goroutine.
+func goDispatch(task func()) bool {
+	go task()
+	return true
+}
+
+// handleFrame handles a frame read from the connection of cs, and err is the error of reading it.
+// Requests are handled by dispatch, and rejected with ErrServerOverloaded if dispatch returns false.
+// It returns false if the connection should be closed.
+func (s *Server) handleFrame(ctx *share.Context, cs *connState, req *protocol.Message, err error, dispatch func(task func()) bool) bool {
+	conn, writeCh, streams, calls := cs.conn, cs.writeCh, cs.streams, cs.calls
+
+	if err != nil && s.isShutdown() {
+		s.goAway(cs)
+		protocol.FreeMsg(req)
+		return false
+	}
+	if err != nil {
+		switch err {
+		case io.EOF:
+			log.Infof("client has closed this connection: %s", conn.RemoteAddr().String())
+		case net.ErrClosed:
+			log.Infof("irpc: connection %s is closed", conn.RemoteAddr().String())
+		case ErrReqReachLimit:
+			s.handleError(ctx, conn, writeCh, req, err)
+			return true
+		case protocol.ErrChecksumMismatch:
+			// the request has been read completely, so reply with the error without invoking the service.
+			log.Warnf("irpc: corrupted request %d from %s", req.Seq(), conn.RemoteAddr().String())
+			cs.chunks.Discard(req)
+			streams.cancel(req.Seq())
+			req.SetFrameType(protocol.FrameCall)
+			s.handleError(ctx, conn, writeCh, req, err)
+			return true
+		default:
+			log.Warnf("irpc: failed to read request: %v", err)
+		}
+		protocol.FreeMsg(req)
+		return false
+	}
+
+	if share.Trace {
+		log.Debugf("server received an request %+v from conn: %v", req, conn.RemoteAddr().String())
+	}
+
+	if req.FrameType() == protocol.FrameChunk {
+		if err = cs.chunks.Add(req); err == protocol.ErrTooManyAssemblies {
+			log.Warnf("irpc: too many chunked requests from %s", conn.RemoteAddr().String())
+			protocol.FreeMsg(req)
+			return false
+		}
 		if err != nil {
+			// reject the request before the client has sent all chunks
+			req.SetFrameType(protocol.FrameCall)
 			s.handleError(ctx, conn, writeCh, req, err)
-			if authFail {
-				log.Infof("auth failed for conn %s: %v", conn.RemoteAddr().String(), err)
-				return
-			}
-			continue
+			return true
+		}
+		protocol.FreeMsg(req)
+		return true
+	}
+	if req.FrameType() == protocol.FrameCancel {
+		cs.chunks.Cancel(req.Seq())
+	}
+	if err = cs.chunks.Complete(req); err == nil {
+		if limit := s.maxPayloadSize(req); limit > 0 && len(req.Payload) > limit {
+			err = protocol.ErrPayloadTooLarge
 		}
+	}
+	if err == protocol.ErrMessageDropped {
+		protocol.FreeMsg(req)
+		return true
+	}
+	if err != nil {
+		s.handleError(ctx, conn, writeCh, req, err)
+		return true
+	}
 
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					// maybe panic because the writeCh is closed.
-					log.Errorf("[panic] failed to handle request: %v", r)
-				}
-			}()
+	// frames of opened streams go to their streams directly,
+	// and a FrameStream request with a new seq opens a stream.
+	if ft := req.FrameType(); ft == protocol.FrameStream || ft == protocol.FrameStreamEnd || ft == protocol.FrameStreamWindow {
+		if streams.deliver(req) {
+			return true
+		}
+		if ft != protocol.FrameStream || req.ServicePath == "" {
+			protocol.FreeMsg(req)
+			return true
+		}
+	}
 
-			atomic.AddInt32(&s.handlerMsgNum, 1)
-			defer atomic.AddInt32(&s.handlerMsgNum, -1)
+	if req.FrameType() == protocol.FrameCancel {
+		if !streams.cancel(req.Seq()) {
+			calls.remove(req.Seq())
+		}
+		protocol.FreeMsg(req)
+		return true
+	}
 
-			if req.IsHeartbeat() {
-				// reuse request as response
-				_ = s.Plugins.DoHeartbeatRequest(ctx, req)
-				req.SetMessageType(protocol.Response)
-				s.writeResponse(conn, writeCh, req)
-				protocol.FreeMsg(req)
-				return
-			}
+	if req.FrameType() == protocol.FrameHandshake {
+		if err = s.handshake(ctx, conn, writeCh, req); err != nil {
+			log.Infof("handshake auth failed for conn %s: %v", conn.RemoteAddr().String(), err)
+			return false
+		}
+		cs.authenticated = s.AuthFunc != nil
+		return true
+	}
 
-			resMetadata := make(map[string]string)
-			ctx.SetValue(share.ReqMetaDataKey, req.Metadata)
-			ctx.SetValue(share.ResMetaDataKey, resMetadata)
+	start := time.Now()
+	ctx.SetValue(StartRequestContextKey, start.UnixNano())
+	authFail := false
+	if !req.IsHeartbeat() && !cs.authenticated {
+		err = s.auth(ctx, req)
+		authFail = err != nil
+	}
 
-			cancelFunc := parseServerTimeout(ctx, req)
-			if cancelFunc != nil {
-				defer cancelFunc()
-			}
+	if err != nil {
+		s.handleError(ctx, conn, writeCh, req, err)
+		if authFail {
+			log.Infof("auth failed for conn %s: %v", conn.RemoteAddr().String(), err)
+			return false
+		}
+		return true
+	}
+
+	// the adaptive limit rejects excess requests early, before they are queued or take workers.
+	// methods which don't exist don't get limits, so that clients can't grow the limiter by random names.
+	var limit *adaptiveLimit
+	if s.adaptiveLimiter != nil && req.FrameType() != protocol.FrameStream && !req.IsHeartbeat() && s.hasMethod(req.ServicePath, req.ServiceMethod) {
+		limit = s.adaptiveLimiter.get(req.ServicePath + "." + req.ServiceMethod)
+		if !limit.acquire() {
+			s.handleError(ctx, conn, writeCh, req, ErrServerOverloaded)
+			return true
+		}
+	}
 
-			_ = s.Plugins.DoPreHandleRequest(ctx, req)
+	var stream *serverStream
+	cancelable := false
+	if req.FrameType() == protocol.FrameStream {
+		stream = s.newServerStream(conn, writeCh, streams, req)
+		// a stream lives as long as its handler, so it doesn't occupy a worker of dispatch.
+		dispatch = goDispatch
+	} else if !req.IsHeartbeat() && !req.IsOneway() {
+		calls.add(ctx, req.Seq())
+		cancelable = true
+	}
 
-			if share.Trace {
-				log.Debugf("server handle request %+v from conn: %v", req, conn.RemoteAddr().String())
+	// the timeout includes the time waiting for the concurrency limits and the workers
+	var cancelFunc context.CancelFunc
+	if !req.IsHeartbeat() {
+		cancelFunc = parseServerTimeout(ctx, req, start)
+	}
+	// releaseBulkheads releases the concurrency limits which have admitted the request
+	var releaseBulkheads func()
+
+	// counted before dispatching, so that Shutdown waits for the requests queued by dispatch too.
+	atomic.AddInt32(&s.handlerMsgNum, 1)
+	cs.handling.Add(1)
+	handle := func() {
+		defer atomic.AddInt32(&s.handlerMsgNum, -1)
+		defer cs.handling.Done()
+		if cancelFunc != nil {
+			defer cancelFunc()
+		}
+		// released after the response is written
+		if limit != nil {
+			defer func() { limit.release(time.Since(start)) }()
+		}
+		if releaseBulkheads != nil {
+			defer releaseBulkheads()
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				// maybe panic because the writeCh is closed.
+				log.Errorf("[panic] failed to handle request: %v", r)
 			}
+		}()
+		if cancelable {
+			defer calls.remove(req.Seq())
+		}
 
-			// first use handler
-			if handler, ok := s.router[req.ServicePath+"."+req.ServiceMethod]; ok {
-				sCtx := NewContext(ctx, conn, req, writeCh)
-				err := handler(sCtx)
-				if err != nil {
-					log.Errorf("[handler internal error]: servicePath: %s, serviceMethod, err: %v", req.ServicePath, req.ServiceMethod, err)
-				}
+		if req.IsHeartbeat() {
+			// reuse request as response
+			_ = s.Plugins.DoHeartbeatRequest(ctx, req)
+			req.SetMessageType(protocol.Response)
+			_ = s.writeResponse(conn, writeCh, req)
+			protocol.FreeMsg(req)
+			return
+		}
 
-				protocol.FreeMsg(req)
-				return
-			}
+		resMetadata := make(map[string]string)
+		ctx.SetValue(share.ReqMetaDataKey, req.Metadata)
+		ctx.SetValue(share.ResMetaDataKey, resMetadata)
+		if len(req.Extensions) > 0 {
+			ctx.SetValue(share.ReqExtensionsKey, req.Extensions)
+		}
+
+		if stream == nil && ctx.Err() == context.DeadlineExceeded {
+			// nobody waits for the response any more
+			s.handleError(ctx, conn, writeCh, req, ErrDeadlineExceeded)
+			return
+		}
+
+		_ = s.Plugins.DoPreHandleRequest(ctx, req)
 
-			var res *protocol.Message
-			res, err = s.handleRequest(ctx, req)
+		if share.Trace {
+			log.Debugf("server handle request %+v from conn: %v", req, conn.RemoteAddr().String())
+		}
+
+		if stream != nil {
+			s.handleStream(ctx, stream, streams, req)
+			protocol.FreeMsg(req)
+			return
+		}
+
+		// first use handler
+		if handler, ok := s.router[req.ServicePath+"."+req.ServiceMethod]; ok {
+			sCtx := NewContext(ctx, conn, req, writeCh)
+			sCtx.s = s
+			err := handler(sCtx)
 			if err != nil {
-				if s.HandleServiceError != nil {
-					s.HandleServiceError(err)
-				} else {
-					log.Warnf("irpc: failed to handle request: %v", err)
-				}
+				log.Errorf("[handler internal error]: servicePath: %s, serviceMethod, err: %v", req.ServicePath, req.ServiceMethod, err)
+			}
+
+			protocol.FreeMsg(req)
+			return
+		}
+
+		var res *protocol.Message
+		res, err = s.handleRequest(ctx, req)
+		if err != nil {
+			if s.HandleServiceError != nil {
+				s.HandleServiceError(err)
+			} else {
+				log.Warnf("irpc: failed to handle request: %v", err)
 			}
+		}
 
-			if !req.IsOneway() {
-				if len(resMetadata) > 0 { // copy meta in context to request
-					meta := res.Metadata
-					if meta == nil {
-						res.Metadata = resMetadata
-					} else {
-						for k, v := range resMetadata {
-							if meta[k] == "" {
-								meta[k] = v
-							}
+		// nobody waits for the response of a canceled request
+		if !req.IsOneway() && ctx.Err() != context.Canceled {
+			if len(resMetadata) > 0 { // copy meta in context to request
+				meta := res.Metadata
+				if meta == nil {
+					res.Metadata = resMetadata
+				} else {
+					for k, v := range resMetadata {
+						if meta[k] == "" {
+							meta[k] = v
 						}
 					}
 				}
-
-				s.sendResponse(ctx, conn, writeCh, err, req, res)
 			}
 
-			if share.Trace {
-				log.Debugf("server write response %+v for an request %+v from conn: %v", res, req, conn.RemoteAddr().String())
-			}
+			s.sendResponse(ctx, conn, writeCh, err, req, res)
+		}
 
-			protocol.FreeMsg(req)
-			protocol.FreeMsg(res)
-		}()
+		if share.Trace {
+			log.Debugf("server write response %+v for an request %+v from conn: %v", res, req, conn.RemoteAddr().String())
+		}
+
+		protocol.FreeMsg(req)
+		protocol.FreeMsg(res)
 	}
+
+	reject := func() {
+		if limit != nil {
+			// the latency of a request which is not handled is not measured
+			limit.release(0)
+		}
+		if releaseBulkheads != nil {
+			releaseBulkheads()
+		}
+		if cancelFunc != nil {
+			cancelFunc()
+		}
+		s.rejectOverloaded(ctx, cs, req, cancelable)
+	}
+	run := func() {
+		if s.handlerWorkers > 0 && stream == nil && !req.IsHeartbeat() {
+			s.queueHandler(ctx, req, handle, reject)
+			return
+		}
+		if !dispatch(handle) {
+			reject()
+		}
+	}
+	if stream != nil || req.IsHeartbeat() {
+		run()
+		return true
+	}
+
+	// the concurrency limits admit the request before it is queued or takes a worker,
+	// and a request waiting in the queue of a limit waits at most until it times out.
+	s.concurrencyLimiter.admit(ctx, req.ServicePath, req.ServiceMethod, func(release func(), err error) {
+		if err != nil {
+			reject()
+			return
+		}
+		releaseBulkheads = release
+		run()
+	})
+	return true
+}
+
+// rejectOverloaded replies ErrServerOverloaded to req, which is counted by handleFrame but not handled.
+func (s *Server) rejectOverloaded(ctx *share.Context, cs *connState, req *protocol.Message, cancelable bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			// maybe panic because the writeCh is closed.
+			log.Errorf("[panic] failed to reject request: %v", r)
+		}
+	}()
+	atomic.AddInt32(&s.handlerMsgNum, -1)
+	defer cs.handling.Done()
+	if cancelable {
+		cs.calls.remove(req.Seq())
+	}
+	s.handleError(ctx, cs.conn, cs.writeCh, req, ErrServerOverloaded)
 }
 
 func (s *Server) handleError(ctx *share.Context, conn net.Conn, writeCh chan *[]byte, req *protocol.Message, err error) {
@@ -342,6 +646,12 @@ func (s *Server) handleError(ctx *share.Context, conn net.Conn, writeCh chan *[]
 		res.SetMessageType(protocol.Response)
 
 		res.HandleError(err)
+		switch err {
+		case ErrServerOverloaded:
+			res.Metadata[protocol.ServerOverloaded] = "1"
+		case ErrDeadlineExceeded:
+			res.Metadata[protocol.DeadlineExceeded] = "1"
+		}
 		s.sendResponse(ctx, conn, writeCh, err, req, res)
 		protocol.FreeMsg(res)
 	} else {
@@ -351,42 +661,85 @@ func (s *Server) handleError(ctx *share.Context, conn net.Conn, writeCh chan *[]
 }
 
 func (s *Server) sendResponse(ctx *share.Context, conn net.Conn, writeCh chan *[]byte, err error, req, res *protocol.Message) {
-	if len(res.Payload) > 1024 && req.CompressType() != protocol.None {
+	if len(res.Payload) > s.compressThreshold && req.CompressType() != protocol.None {
 		res.SetCompressType(req.CompressType())
 	}
 
 	_ = s.Plugins.DoPreWriteResponse(ctx, req, res, err)
-	s.writeResponse(conn, writeCh, res)
+	_ = s.writeResponse(conn, writeCh, res)
 	_ = s.Plugins.DoPostWriteResponse(ctx, req, res, err)
 }
 
-func (s *Server) writeResponse(conn net.Conn, writeCh chan *[]byte, res *protocol.Message) {
-	data := res.EncodeSlicePointer()
-	if s.AsyncWrite {
-		writeCh <- data
+func (s *Server) writeResponse(conn net.Conn, writeCh chan *[]byte, res *protocol.Message) error {
+	if s.checksum && res.Version() >= protocol.Version2 {
+		res.SetChecksum(true)
+	}
+	return res.EncodeChunks(s.chunkSize, func(data *[]byte) (err error) {
+		if s.AsyncWrite {
+			writeCh <- data
+		} else {
+			if s.writeTimeout != 0 {
+				_ = conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+			}
+			_, err = conn.Write(*data)
+			protocol.PutData(data)
+		}
+		return
+	})
+}
+
+// maxPayloadSize returns the max payload size of the request m.
+func (s *Server) maxPayloadSize(m *protocol.Message) int {
+	if size, ok := s.maxPayloadSizes[m.ServicePath]; ok {
+		return size
+	}
+	return s.maxPayloadSizes[""]
+}
+
+// goAway tells the client that no more requests will be handled on the connection of cs.
+// It is sent after the last request is read, and lists the requests and streams in flight,
+// which are still answered before the connection is closed.
+func (s *Server) goAway(cs *connState) {
+	conn := cs.conn
+	seqs := append(cs.calls.seqs(), cs.streams.seqs()...)
+	payload := make([]byte, 8*len(seqs))
+	for i, seq := range seqs {
+		binary.BigEndian.PutUint64(payload[8*i:], seq)
+	}
+
+	msg := protocol.GetPooledMsg()
+	msg.SetMessageType(protocol.Request)
+	msg.SetOneway(true)
+	msg.SetFrameType(protocol.FrameGoAway)
+	msg.Payload = payload
+
+	// queued behind the responses being written
+	var err error
+	data := msg.EncodeSlicePointer()
+	if cs.writeCh != nil {
+		cs.writeCh <- data
 	} else {
 		if s.writeTimeout != 0 {
 			_ = conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
 		}
-		_, _ = conn.Write(*data)
+		_, err = conn.Write(*data)
 		protocol.PutData(data)
 	}
+	protocol.FreeMsg(msg)
+
+	if err != nil && share.Trace {
+		log.Debugf("failed to send GoAway to %s: %v", conn.RemoteAddr().String(), err)
+	}
 }
 
 func (s *Server) serveAsyncWrite(conn net.Conn, writeCh chan *[]byte) {
-	for {
-		select {
-		case <-s.doneChan:
-			return
-		case data := <-writeCh:
-			if data == nil {
-				return
-			}
-			if s.writeTimeout != 0 {
-				_ = conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
-			}
-			_, _ = conn.Write(*data)
-			protocol.PutData(data)
-		}
+	defer atomic.AddInt32(&s.asyncWriters, -1)
+	w := protocol.BatchWriter{
+		MaxBatchBytes: s.writeBatchBytes,
+		MaxDelay:      s.writeBatchDelay,
+		WriteTimeout:  s.writeTimeout,
+	}
+	if err := w.Serve(conn, writeCh, s.doneChan); err != nil && share.Trace {
+		log.Debugf("failed to write responses to %s: %v", conn.RemoteAddr().String(), err)
 	}
 }
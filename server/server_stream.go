@@ -0,0 +1,331 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/derekAHua/irpc/codec"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/derekAHua/irpc/share"
+)
+
+// ErrStreamClosed is returned by ServerStream when the stream has been finished.
+var ErrStreamClosed = errors.New("stream is closed")
+
+// StreamBufferSize is the number of client messages buffered for each stream.
+// It is the window granted to the client, which sends more messages as the stream consumes them,
+// so that a slow stream doesn't stop the connection reader. See protocol.StreamWindow.
+var StreamBufferSize = 64
+
+// ServerStream is the server side of a streaming call.
+// A streaming method has the signature
+//
+//	func (t *T) Watch(ctx context.Context, args *Args, stream ServerStream) error
+//
+// args is decoded from the request that opens the stream.
+// The stream is finished when the method returns, and a non-nil error is delivered to the client.
+type ServerStream interface {
+	// Context returns the context of the stream. It is done when the stream is finished or the connection is closed.
+	Context() context.Context
+	// Send encodes v and sends it to the client.
+	Send(v interface{}) error
+	// Recv decodes the next message from the client into v.
+	// It returns io.EOF after the client has closed its sending side.
+	Recv(v interface{}) error
+}
+
+type serverStream struct {
+	s       *Server
+	conn    net.Conn
+	writeCh chan *[]byte
+	header  protocol.Header
+	codec   codec.Codec
+	recvCh  chan *protocol.Message
+	recvEOF bool
+	// consumed is the number of messages received since the last grant of the window.
+	consumed int
+	// window is the number of messages the stream may send to the client.
+	window protocol.StreamWindow
+
+	mu     sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	closed bool
+}
+
+// streamSet holds the open streams of one connection.
+type streamSet struct {
+	mu      sync.Mutex
+	streams map[uint64]*serverStream
+}
+
+func newStreamSet() *streamSet {
+	return &streamSet{streams: make(map[uint64]*serverStream)}
+}
+
+func (ss *streamSet) add(st *serverStream) {
+	ss.mu.Lock()
+	ss.streams[st.header.Seq()] = st
+	ss.mu.Unlock()
+}
+
+func (ss *streamSet) remove(seq uint64) {
+	ss.mu.Lock()
+	delete(ss.streams, seq)
+	ss.mu.Unlock()
+}
+
+// deliver passes a stream frame from the client to its stream without waiting for the stream.
+// It returns false if the stream does not exist.
+func (ss *streamSet) deliver(req *protocol.Message) bool {
+	seq := req.Seq()
+	ss.mu.Lock()
+	st := ss.streams[seq]
+	ss.mu.Unlock()
+	if st == nil {
+		return false
+	}
+
+	if req.FrameType() == protocol.FrameStreamWindow {
+		st.window.Add(req.StreamWindowSize())
+		protocol.FreeMsg(req)
+		return true
+	}
+
+	select {
+	case <-st.done:
+		protocol.FreeMsg(req)
+		return true
+	default:
+	}
+	select {
+	case st.recvCh <- req:
+	default:
+		// the client has sent more than its window
+		protocol.FreeMsg(req)
+		ss.remove(seq)
+		st.finish(protocol.ErrStreamOverflow)
+	}
+	return true
+}
+
+// cancel closes the stream identified by seq without sending anything to the client.
+func (ss *streamSet) cancel(seq uint64) bool {
+	ss.mu.Lock()
+	st := ss.streams[seq]
+	delete(ss.streams, seq)
+	ss.mu.Unlock()
+
+	if st == nil {
+		return false
+	}
+	st.close()
+	return true
+}
+
+// seqs returns the seqs of the open streams.
+func (ss *streamSet) seqs() []uint64 {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	seqs := make([]uint64, 0, len(ss.streams))
+	for seq := range ss.streams {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+// closeAll cancels all streams. It is called when the connection is closed.
+func (ss *streamSet) closeAll() {
+	ss.mu.Lock()
+	streams := ss.streams
+	ss.streams = make(map[uint64]*serverStream)
+	ss.mu.Unlock()
+
+	for _, st := range streams {
+		st.close()
+	}
+}
+
+// newServerStream registers the stream opened by req and grants the window of the client.
+// It runs in the connection reader so that frames following the request always find their stream.
+func (s *Server) newServerStream(conn net.Conn, writeCh chan *[]byte, streams *streamSet, req *protocol.Message) *serverStream {
+	st := &serverStream{
+		s:       s,
+		conn:    conn,
+		writeCh: writeCh,
+		header:  *req.Header,
+		// with room for the end of the stream after a full window
+		recvCh: make(chan *protocol.Message, StreamBufferSize+1),
+		done:   make(chan struct{}),
+	}
+	streams.add(st)
+	st.grant(StreamBufferSize)
+	return st
+}
+
+// handleStream invokes a streaming method and finishes the stream when it returns.
+func (s *Server) handleStream(ctx *share.Context, st *serverStream, streams *streamSet, req *protocol.Message) {
+	var err error
+	defer func() {
+		// removed after the end of the stream is written, so that a GoAway listing the open streams doesn't miss it
+		st.finish(err)
+		streams.remove(st.header.Seq())
+	}()
+
+	serviceName := req.ServicePath
+	methodName := req.ServiceMethod
+	service := s.getService(serviceName)
+	if service == nil {
+		err = errors.New("irpc: can't find service " + serviceName)
+		return
+	}
+	mType := service.method[methodName]
+	if mType == nil || !mType.stream {
+		err = errors.New("irpc: can't find streaming method " + methodName)
+		return
+	}
+
+	st.codec = share.Codecs[req.SerializeType()]
+	if st.codec == nil {
+		err = fmt.Errorf("can't find codec for %d", req.SerializeType())
+		return
+	}
+
+	argv := reflectTypePools.Get(mType.ArgType)
+	defer reflectTypePools.Put(mType.ArgType, argv)
+	err = st.codec.Decode(req.Payload, argv)
+	if err != nil {
+		return
+	}
+
+	argv, err = s.Plugins.DoPreCall(ctx, serviceName, methodName, argv)
+	if err != nil {
+		return
+	}
+
+	sCtx := st.start(ctx)
+	if mType.ArgType.Kind() != reflect.Ptr {
+		err = service.call(sCtx, mType, reflect.ValueOf(argv).Elem(), reflect.ValueOf(st))
+	} else {
+		err = service.call(sCtx, mType, reflect.ValueOf(argv), reflect.ValueOf(st))
+	}
+}
+
+// start creates the context of the stream from the request context.
+func (st *serverStream) start(ctx context.Context) context.Context {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.ctx, st.cancel = context.WithCancel(ctx)
+	if st.closed {
+		st.cancel()
+	}
+	return st.ctx
+}
+
+// close cancels the stream without sending anything to the client.
+func (st *serverStream) close() bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.closed {
+		return false
+	}
+	st.closed = true
+	close(st.done)
+	if st.cancel != nil {
+		st.cancel()
+	}
+	return true
+}
+
+// finish closes the stream and tells the client with a FrameStreamEnd frame.
+func (st *serverStream) finish(err error) {
+	if !st.close() {
+		return
+	}
+
+	res := st.newFrame(protocol.FrameStreamEnd)
+	res.HandleError(err)
+	_ = st.s.writeResponse(st.conn, st.writeCh, res)
+	protocol.FreeMsg(res)
+}
+
+func (st *serverStream) newFrame(ft protocol.FrameType) *protocol.Message {
+	res := protocol.GetPooledMsg()
+	*res.Header = st.header
+	res.SetMessageType(protocol.Response)
+	res.SetMessageStatusType(protocol.Normal)
+	res.SetCompressType(protocol.None)
+	res.SetFrameType(ft)
+	return res
+}
+
+func (st *serverStream) Context() context.Context {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.ctx
+}
+
+// grant grants the client n more messages.
+func (st *serverStream) grant(n int) {
+	res := st.newFrame(protocol.FrameStreamWindow)
+	res.SetStreamWindow(n)
+	_ = st.s.writeResponse(st.conn, st.writeCh, res)
+	protocol.FreeMsg(res)
+}
+
+func (st *serverStream) Send(v interface{}) error {
+	if !st.window.Take(st.done) {
+		return ErrStreamClosed
+	}
+
+	data, err := st.codec.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	res := st.newFrame(protocol.FrameStream)
+	res.Payload = data
+	if len(data) > st.s.compressThreshold && st.header.CompressType() != protocol.None {
+		res.SetCompressType(st.header.CompressType())
+	}
+	err = st.s.writeResponse(st.conn, st.writeCh, res)
+	protocol.FreeMsg(res)
+	return err
+}
+
+func (st *serverStream) Recv(v interface{}) error {
+	if st.recvEOF {
+		return io.EOF
+	}
+
+	ctx := st.Context()
+	var req *protocol.Message
+	select {
+	case req = <-st.recvCh:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer protocol.FreeMsg(req)
+
+	if req.FrameType() == protocol.FrameStreamEnd {
+		st.recvEOF = true
+		return io.EOF
+	}
+
+	// grant the consumed messages in batches
+	st.consumed++
+	if st.consumed >= (StreamBufferSize+1)/2 {
+		st.grant(st.consumed)
+		st.consumed = 0
+	}
+	return st.codec.Decode(req.Payload, v)
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type Counter int
+
+func (c *Counter) Count(_ context.Context, args *Args, stream ServerStream) error {
+	for i := 1; i <= args.A; i++ {
+		if err := stream.Send(&Reply{C: i}); err != nil {
+			return err
+		}
+	}
+	if args.B < 0 {
+		return errors.New("negative")
+	}
+	return nil
+}
+
+func (c *Counter) Sum(_ context.Context, _ *Args, stream ServerStream) error {
+	sum := 0
+	for {
+		args := &Args{}
+		err := stream.Recv(args)
+		if err == io.EOF {
+			return stream.Send(&Reply{C: sum})
+		}
+		if err != nil {
+			return err
+		}
+		sum += args.A
+		if err = stream.Send(&Reply{C: sum}); err != nil {
+			return err
+		}
+	}
+}
+
+func startStreamServer(t *testing.T) (*Server, string) {
+	s := New()
+	err := s.RegisterName("Counter", new(Counter), "")
+	assert.NoError(t, err)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+
+	return s, ln.Addr().String()
+}
+
+func TestServerStream(t *testing.T) {
+	s, addr := startStreamServer(t)
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	err := cli.Connect("tcp", addr)
+	assert.NoError(t, err)
+	defer func() { _ = cli.Close() }()
+
+	stream, err := cli.NewStream(context.Background(), "Counter", "Count", &Args{A: 3})
+	assert.NoError(t, err)
+	for i := 1; i <= 3; i++ {
+		reply := &Reply{}
+		assert.NoError(t, stream.Recv(reply))
+		assert.Equal(t, i, reply.C)
+	}
+	assert.Equal(t, io.EOF, stream.Recv(&Reply{}))
+
+	stream, err = cli.NewStream(context.Background(), "Counter", "Count", &Args{A: 1, B: -1})
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Recv(&Reply{}))
+	assert.EqualError(t, stream.Recv(&Reply{}), "negative")
+
+	// a plain call still works on the same connection
+	err = cli.Call(context.Background(), "Counter", "Count", &Args{A: 1}, &Reply{})
+	assert.EqualError(t, err, "irpc: method Count is a streaming method")
+}
+
+func TestBidirectionalStream(t *testing.T) {
+	s, addr := startStreamServer(t)
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	err := cli.Connect("tcp", addr)
+	assert.NoError(t, err)
+	defer func() { _ = cli.Close() }()
+
+	stream, err := cli.NewStream(context.Background(), "Counter", "Sum", &Args{})
+	assert.NoError(t, err)
+
+	sum := 0
+	for i := 1; i <= 5; i++ {
+		sum += i
+		assert.NoError(t, stream.Send(&Args{A: i}))
+		reply := &Reply{}
+		assert.NoError(t, stream.Recv(reply))
+		assert.Equal(t, sum, reply.C)
+	}
+	assert.NoError(t, stream.CloseSend())
+
+	reply := &Reply{}
+	assert.NoError(t, stream.Recv(reply))
+	assert.Equal(t, 15, reply.C)
+	assert.Equal(t, io.EOF, stream.Recv(reply))
+}
+
+func TestStreamUnknownMethod(t *testing.T) {
+	s, addr := startStreamServer(t)
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	err := cli.Connect("tcp", addr)
+	assert.NoError(t, err)
+	defer func() { _ = cli.Close() }()
+
+	stream, err := cli.NewStream(context.Background(), "Counter", "Missing", &Args{})
+	assert.NoError(t, err)
+	assert.EqualError(t, stream.Recv(&Reply{}), "irpc: can't find streaming method Missing")
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	defer func(size int) { StreamBufferSize = size }(StreamBufferSize)
+	defer func(size int) { client.StreamBufferSize = size }(client.StreamBufferSize)
+	StreamBufferSize = 2
+	client.StreamBufferSize = 2
+
+	s, addr := startStreamServer(t)
+	defer func() { _ = s.Close() }()
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", addr))
+	defer func() { _ = cli.Close() }()
+
+	// the stream sends more than the client buffers, and calls on the connection are not blocked by it
+	stream, err := cli.NewStream(context.Background(), "Counter", "Count", &Args{A: 10})
+	assert.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	reply := &Reply{}
+	assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: 2, B: 3}, reply))
+	assert.Equal(t, 6, reply.C)
+
+	// the messages are received in order as the client consumes them
+	for i := 1; i <= 10; i++ {
+		assert.NoError(t, stream.Recv(reply))
+		assert.Equal(t, i, reply.C)
+	}
+	assert.Equal(t, io.EOF, stream.Recv(reply))
+
+	// and the client waits for the window of a slow stream
+	stream, err = cli.NewStream(context.Background(), "Counter", "Sum", &Args{})
+	assert.NoError(t, err)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			_ = stream.Send(&Args{A: i})
+		}
+		_ = stream.CloseSend()
+	}()
+	sum := 0
+	for i := 1; i <= 10; i++ {
+		sum += i
+		assert.NoError(t, stream.Recv(reply))
+		assert.Equal(t, sum, reply.C)
+	}
+	assert.NoError(t, stream.Recv(reply))
+	assert.Equal(t, 55, reply.C)
+}
+
+func TestStreamOverflow(t *testing.T) {
+	defer func(size int) { StreamBufferSize = size }(StreamBufferSize)
+	StreamBufferSize = 1
+
+	conn, peer := net.Pipe()
+	defer func() { _ = conn.Close() }()
+	go func() { _, _ = io.Copy(io.Discard, peer) }()
+
+	streams := newStreamSet()
+	newFrame := func() *protocol.Message {
+		req := protocol.NewMessage()
+		req.SetSeq(1)
+		req.SetFrameType(protocol.FrameStream)
+		return req
+	}
+	st := New().newServerStream(conn, nil, streams, newFrame())
+
+	// the client sends more than its window, so the stream is reset instead of blocking the reader
+	for i := 0; i < 3; i++ {
+		assert.True(t, streams.deliver(newFrame()))
+	}
+	assert.Empty(t, streams.streams)
+	select {
+	case <-st.done:
+	default:
+		t.Fatal("the stream is not reset")
+	}
+}
@@ -8,22 +8,28 @@ import (
 	"time"
 )
 
-func parseServerTimeout(ctx *share.Context, req *protocol.Message) context.CancelFunc {
-	if req == nil || req.Metadata == nil {
+// parseServerTimeout sets the deadline of ctx by the timeout sent by the client, which started when the request
+// was read at start, so that the time waiting in queues is counted.
+// The timeout of v2 requests is in the protocol.ExtDeadline extension, and the others use share.ServerTimeout.
+func parseServerTimeout(ctx *share.Context, req *protocol.Message, start time.Time) context.CancelFunc {
+	if req == nil {
 		return nil
 	}
 
-	st := req.Metadata[share.ServerTimeout]
-	if st == "" {
-		return nil
-	}
-
-	timeout, err := strconv.ParseInt(st, 10, 64)
-	if err != nil {
-		return nil
+	timeout, ok := req.Deadline()
+	if !ok {
+		st := req.Metadata[share.ServerTimeout]
+		if st == "" {
+			return nil
+		}
+		ms, err := strconv.ParseInt(st, 10, 64)
+		if err != nil {
+			return nil
+		}
+		timeout = time.Duration(ms) * time.Millisecond
 	}
 
-	newCtx, cancel := context.WithTimeout(ctx.Context, time.Duration(timeout)*time.Millisecond)
+	newCtx, cancel := context.WithDeadline(ctx.Context, start.Add(timeout))
 	ctx.Context = newCtx
 	return cancel
 }
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteCoalescing(t *testing.T) {
+	s := New(WithWriteCoalescing(64<<10, 100*time.Microsecond))
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	opt := client.DefaultOption
+	opt.WriteBatchBytes = 64 << 10
+	opt.WriteBatchDelay = 100 * time.Microsecond
+	cli := client.NewClient(opt)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+
+	// pipelined calls share batches in both directions
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				reply := &Reply{}
+				assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: i, B: j}, reply))
+				assert.Equal(t, i*j, reply.C)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// calls fail instead of blocking after the connection is closed
+	assert.NoError(t, cli.Close())
+	assert.Error(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: 1, B: 2}, &Reply{}))
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/share"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZeroCopyDecode(t *testing.T) {
+	s := New(WithZeroCopyDecode())
+	assert.NoError(t, s.RegisterName("BlobEcho", new(BlobEcho), ""))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+
+	// concurrent requests reuse pooled buffers
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				data := bytes.Repeat([]byte(fmt.Sprintf("%d-%d ", i, j)), 100*i)
+				ctx := context.WithValue(context.Background(), share.ReqMetaDataKey, map[string]string{"id": fmt.Sprint(i)})
+				reply := &Blob{}
+				assert.NoError(t, cli.Call(ctx, "BlobEcho", "Echo", &Blob{Data: data}, reply))
+				assert.Equal(t, data, reply.Data)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -20,11 +20,15 @@ var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
 // Precompute the reflectType for context.
 var typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 
+// Precompute the reflectType for ServerStream.
+var typeOfServerStream = reflect.TypeOf((*ServerStream)(nil)).Elem()
+
 type methodType struct {
 	sync.Mutex // protects counters
 	method     reflect.Method
 	ArgType    reflect.Type
 	ReplyType  reflect.Type
+	stream     bool // the third argument is a ServerStream instead of a reply
 }
 
 type functionType struct {
@@ -92,16 +96,17 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 			}
 			continue
 		}
-		// Third arg must be a pointer.
+		// Third arg must be a pointer or a ServerStream.
 		replyType := mType.In(3)
-		if replyType.Kind() != reflect.Ptr {
+		stream := replyType == typeOfServerStream
+		if !stream && replyType.Kind() != reflect.Ptr {
 			if reportErr {
 				log.Info("method", mName, " reply type not a pointer:", replyType)
 			}
 			continue
 		}
 		// Reply type must be exported.
-		if !isExportedOrBuiltinType(replyType) {
+		if !stream && !isExportedOrBuiltinType(replyType) {
 			if reportErr {
 				log.Info("method", mName, " reply type not exported:", replyType)
 			}
@@ -121,6 +126,11 @@ func suitableMethods(typ reflect.Type, reportErr bool) map[string]*methodType {
 			}
 			continue
 		}
+		if stream {
+			methods[mName] = &methodType{method: method, ArgType: argType, stream: true}
+			reflectTypePools.Init(argType)
+			continue
+		}
 		methods[mName] = &methodType{method: method, ArgType: argType, ReplyType: replyType}
 
 		// init pool for reflect.Type of args and reply
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+
+	"github.com/derekAHua/irpc/share"
+)
+
+func init() {
+	makeListeners["shm"] = shmMakeListener
+}
+
+func shmMakeListener(_ *Server, address string) (ln net.Listener, err error) {
+	return share.ListenShm(address)
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeShm(t *testing.T) {
+	s := New()
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	assert.NoError(t, s.RegisterName("BlobEcho", new(BlobEcho), ""))
+
+	name := "test-" + t.Name()
+	go func() { _ = s.Serve("shm", name) }()
+	defer func() { _ = s.Close() }()
+	assert.Eventually(t, func() bool {
+		return s.Address() != nil
+	}, time.Second, 10*time.Millisecond)
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("shm", name))
+	defer func() { _ = cli.Close() }()
+
+	// payloads larger than the ring are written in parts
+	data := bytes.Repeat([]byte("irpc shared memory "), 100000)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(a int) {
+			defer wg.Done()
+			reply := &Reply{}
+			assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: a, B: 10}, reply))
+			assert.Equal(t, a*10, reply.C)
+
+			blob := &Blob{}
+			assert.NoError(t, cli.Call(context.Background(), "BlobEcho", "Echo", &Blob{Data: data}, blob))
+			assert.Equal(t, data, blob.Data)
+		}(i)
+	}
+	wg.Wait()
+}
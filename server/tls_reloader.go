@@ -0,0 +1,131 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/derekAHua/irpc/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// certReloadDelay gathers changes of files written one by one into one reload.
+const certReloadDelay = 100 * time.Millisecond
+
+// CertReloader loads the certificate, key and client CAs of a server from files,
+// and reloads them when the files change, so that certificates are rotated without restarting the server.
+// New handshakes use the reloaded certificates, and established connections are not affected.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	base    *tls.Config
+	config  atomic.Value // *tls.Config
+	watcher *fsnotify.Watcher
+}
+
+// NewCertReloader loads certFile and keyFile, and caFile to verify client certificates if it is not empty.
+// base is the template of the TLS config, such as ClientAuth and MinVersion, and can be nil.
+func NewCertReloader(certFile, keyFile, caFile string, base *tls.Config) (*CertReloader, error) {
+	if base == nil {
+		base = &tls.Config{}
+	}
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, caFile: caFile, base: base}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// directories are watched, because files are often replaced by renaming, such as Kubernetes secrets.
+	dirs := make(map[string]bool)
+	for _, file := range []string{certFile, keyFile, caFile} {
+		if file != "" {
+			dirs[filepath.Dir(file)] = true
+		}
+	}
+	for dir := range dirs {
+		if err = watcher.Add(dir); err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
+	}
+	r.watcher = watcher
+
+	go r.watch()
+	return r, nil
+}
+
+// TLSConfig returns the TLS config of the server, which uses the latest certificates for new handshakes.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.config.Load().(*tls.Config), nil
+		},
+	}
+}
+
+// Close stops watching the files.
+func (r *CertReloader) Close() error {
+	return r.watcher.Close()
+}
+
+func (r *CertReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	config := r.base.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("no CA certificates in " + r.caFile)
+		}
+		config.ClientCAs = pool
+	}
+
+	r.config.Store(config)
+	return nil
+}
+
+func (r *CertReloader) watch() {
+	timer := time.NewTimer(certReloadDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case _, ok := <-r.watcher.Events:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			timer.Reset(certReloadDelay)
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			log.Warnf("irpc: failed to watch certificates: %v", err)
+		case <-timer.C:
+			// a failed reload keeps the old certificates, and the next change retries.
+			if err := r.reload(); err != nil {
+				log.Warnf("irpc: failed to reload certificates: %v", err)
+			} else {
+				log.Infof("irpc: reloaded certificate %s", r.certFile)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "irpc test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM encoded certificate and key signed by the CA.
+func (ca *testCA) issue(t *testing.T, serial int64, template *x509.Certificate) (certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.crt")
+	writeServerCert := func(serial int64) {
+		certPEM, keyPEM := ca.issue(t, serial, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}})
+		assert.NoError(t, os.WriteFile(certFile, certPEM, 0o600))
+		assert.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	}
+	writeServerCert(2)
+	assert.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+
+	reloader, err := NewCertReloader(certFile, keyFile, caFile, &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert})
+	assert.NoError(t, err)
+	defer func() { _ = reloader.Close() }()
+
+	peers := make(chan *PeerIdentity, 1)
+	s := New(WithTLSConfig(reloader.TLSConfig()))
+	s.AuthFunc = func(ctx context.Context, _ *protocol.Message, _ string) error {
+		peer, _ := ctx.Value(PeerIdentityContextKey).(*PeerIdentity)
+		peers <- peer
+		return nil
+	}
+	assert.NoError(t, s.RegisterName("Arith", new(Arith), ""))
+	ln, err := s.makeListener("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	defer func() { _ = s.Close() }()
+
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/default/sa/arith")
+	certPEM, keyPEM := ca.issue(t, 3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "arith-client", Organization: []string{"irpc"}},
+		URIs:        []*url.URL{spiffeID},
+		DNSNames:    []string{"client.example.org"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	// connect returns the serial number of the server certificate
+	connect := func() int64 {
+		opt := client.DefaultOption
+		opt.TLSConfig = &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{clientCert}}
+		cli := client.NewClient(opt)
+		assert.NoError(t, cli.Connect("tcp", ln.Addr().String()))
+		defer func() { _ = cli.Close() }()
+
+		reply := &Reply{}
+		assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &Args{A: 2, B: 3}, reply))
+		assert.Equal(t, 6, reply.C)
+
+		peer := <-peers
+		if assert.NotNil(t, peer) {
+			assert.True(t, peer.Verified)
+			assert.Len(t, peer.Chain, 2)
+			assert.Len(t, peer.PeerCertificates, 1)
+			assert.Equal(t, "arith-client", peer.Subject.CommonName)
+			assert.Equal(t, spiffeID.String(), peer.SPIFFEID)
+			assert.Equal(t, []string{"client.example.org"}, peer.DNSNames)
+		}
+		return cli.Conn.(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(2), connect())
+
+	// new handshakes use the reloaded certificate
+	writeServerCert(4)
+	assert.Eventually(t, func() bool {
+		return connect() == 4
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// an invalid certificate is ignored and the last one is kept
+	assert.NoError(t, os.WriteFile(certFile, []byte("invalid"), 0o600))
+	time.Sleep(3 * certReloadDelay)
+	assert.Equal(t, int64(4), connect())
+}
+
+func TestPeerIdentityUnverified(t *testing.T) {
+	ca := newTestCA(t)
+	serverPEM, serverKeyPEM := ca.issue(t, 2, &x509.Certificate{IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}})
+	serverCert, err := tls.X509KeyPair(serverPEM, serverKeyPEM)
+	assert.NoError(t, err)
+
+	// a self-signed certificate can claim any name
+	self := newTestCA(t)
+	spiffeID, _ := url.Parse("spiffe://example.org/ns/default/sa/admin")
+	certPEM, keyPEM := self.issue(t, 3, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "admin"},
+		URIs:        []*url.URL{spiffeID},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	assert.NoError(t, err)
+
+	c, s := net.Pipe()
+	serverConn := tls.Server(s, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAnyClientCert})
+	clientConn := tls.Client(c, &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
+	go func() { _ = clientConn.Handshake() }()
+	assert.NoError(t, serverConn.Handshake())
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	peer := newPeerIdentity(serverConn)
+	if assert.NotNil(t, peer) {
+		assert.False(t, peer.Verified)
+		assert.Len(t, peer.PeerCertificates, 1)
+		assert.Empty(t, peer.Chain)
+		assert.Empty(t, peer.Subject.CommonName)
+		assert.Empty(t, peer.SPIFFEID)
+		assert.Empty(t, peer.URIs)
+	}
+}
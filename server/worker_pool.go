@@ -0,0 +1,55 @@
+package server
+
+import "sync"
+
+// workerPool handles tasks by a fixed number of goroutines, so that bursts of requests are queued
+// instead of starting unbounded goroutines.
+type workerPool struct {
+	tasks chan func()
+	wg    sync.WaitGroup
+
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// newWorkerPool starts workers goroutines with a queue of queueSize tasks.
+func newWorkerPool(workers, queueSize int) *workerPool {
+	p := &workerPool{tasks: make(chan func(), queueSize)}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		task()
+	}
+}
+
+// submit queues task, and returns false without waiting if the queue is full or the pool is stopped.
+func (p *workerPool) submit(task func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return false
+	}
+
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop waits for the queued tasks to finish. No tasks can be submitted after stop.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	close(p.tasks)
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/derekAHua/irpc/log"
+	"github.com/derekAHua/irpc/server"
 	"github.com/rcrowley/go-metrics"
 	"github.com/rpcxio/libkv"
 	"github.com/rpcxio/libkv/store"
@@ -25,6 +26,9 @@ func init() {
 type ConsulRegisterPlugin struct {
 	// service address, for example, tcp@127.0.0.1:8972, quic@127.0.0.1:1234
 	ServiceAddress string
+	// Server is the server whose other listeners, for example, unix@/var/run/irpc.sock, are registered in consul too.
+	// Its addresses are read when a service is registered and on every update, so listeners served later are added then.
+	Server *server.Server
 	// consul addresses
 	ConsulServers []string
 	// base path for irpc server, for example com/example/irpc
@@ -95,14 +99,14 @@ func (p *ConsulRegisterPlugin) Start() error {
 					}
 
 					//set this same metrics for all services at this server
-					for _, name := range p.Services {
-						nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+					for _, node := range registryNodes(p.BasePath, p.Services, serviceAddresses(p.ServiceAddress, p.Server)) {
+						nodePath := node.path
 						kvPaire, err := p.kv.Get(nodePath)
 						if err != nil {
 							log.Warnf("can't get data of node: %s, will re-create, because of %v", nodePath, err.Error())
 
 							p.metasLock.RLock()
-							meta := p.metas[name]
+							meta := p.metas[node.service]
 							p.metasLock.RUnlock()
 
 							err = p.kv.Put(nodePath, []byte(meta), &store.WriteOptions{TTL: p.UpdateInterval * 2})
@@ -140,8 +144,8 @@ func (p *ConsulRegisterPlugin) Stop() error {
 		p.BasePath = p.BasePath[1:]
 	}
 
-	for _, name := range p.Services {
-		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	for _, node := range registryNodes(p.BasePath, p.Services, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath := node.path
 		exist, err := p.kv.Exists(nodePath)
 		if err != nil {
 			log.Errorf("cannot delete path %s: %v", nodePath, err)
@@ -208,11 +212,13 @@ func (p *ConsulRegisterPlugin) Register(name string, _ interface{}, metadata str
 		return err
 	}
 
-	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
-	err = p.kv.Put(nodePath, []byte(metadata), &store.WriteOptions{TTL: p.UpdateInterval * 2})
-	if err != nil {
-		log.Errorf("cannot create consul path %s: %v", nodePath, err)
-		return err
+	for _, node := range registryNodes(p.BasePath, []string{name}, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath = node.path
+		err = p.kv.Put(nodePath, []byte(metadata), &store.WriteOptions{TTL: p.UpdateInterval * 2})
+		if err != nil {
+			log.Errorf("cannot create consul path %s: %v", nodePath, err)
+			return err
+		}
 	}
 
 	p.Services = append(p.Services, name)
@@ -266,12 +272,14 @@ func (p *ConsulRegisterPlugin) Unregister(name string) (err error) {
 		return err
 	}
 
-	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	for _, node := range registryNodes(p.BasePath, []string{name}, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath = node.path
 
-	err = p.kv.Delete(nodePath)
-	if err != nil {
-		log.Errorf("cannot remove consul path %s: %v", nodePath, err)
-		return err
+		err = p.kv.Delete(nodePath)
+		if err != nil {
+			log.Errorf("cannot remove consul path %s: %v", nodePath, err)
+			return err
+		}
 	}
 
 	var services = make([]string, 0, len(p.Services)-1)
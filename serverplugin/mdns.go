@@ -12,6 +12,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/derekAHua/irpc/server"
 	"github.com/grandcat/zeroconf"
 	metrics "github.com/rcrowley/go-metrics"
 )
@@ -31,6 +32,9 @@ type MDNSRegisterPlugin struct {
 	// Registered services
 	Services       []*serviceMeta
 	UpdateInterval time.Duration
+	// Server is the irpc server whose listeners are announced with the services too, if it is set.
+	// Its addresses are read when a service is registered.
+	Server *server.Server
 
 	server *zeroconf.Server
 	domain string
@@ -165,14 +169,14 @@ func (p *MDNSRegisterPlugin) Register(name string, _ interface{}, metadata strin
 		return
 	}
 
-	sm := &serviceMeta{
-		Service:        name,
-		Meta:           metadata,
-		ServiceAddress: p.ServiceAddress,
+	for _, address := range serviceAddresses(p.ServiceAddress, p.Server) {
+		p.Services = append(p.Services, &serviceMeta{
+			Service:        name,
+			Meta:           metadata,
+			ServiceAddress: address,
+		})
 	}
 
-	p.Services = append(p.Services, sm)
-
 	if p.server == nil {
 		p.initMDNS()
 		return
@@ -0,0 +1,93 @@
+package serverplugin
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/derekAHua/irpc/server"
+)
+
+// PeerCredRule allows or denies clients of unix sockets by their uid and gid.
+// A client is denied if its uid or gid is denied. Otherwise it is allowed if both allow lists are empty,
+// or its uid or gid is allowed.
+// The gid is the primary group of the client process read from SO_PEERCRED, and its supplementary groups
+// are not checked, so a user can't be denied by a group other than its primary group.
+type PeerCredRule struct {
+	AllowUIDs []uint32
+	AllowGIDs []uint32
+	DenyUIDs  []uint32
+	DenyGIDs  []uint32
+}
+
+// CurrentUserRule returns the rule which only allows clients of the same user as this process.
+func CurrentUserRule() PeerCredRule {
+	return PeerCredRule{AllowUIDs: []uint32{uint32(os.Getuid())}}
+}
+
+// Allow reports whether the client of cred is allowed.
+func (r *PeerCredRule) Allow(cred *server.PeerCred) bool {
+	if containsID(r.DenyUIDs, cred.UID) || containsID(r.DenyGIDs, cred.GID) {
+		return false
+	}
+	if len(r.AllowUIDs) == 0 && len(r.AllowGIDs) == 0 {
+		return true
+	}
+	return containsID(r.AllowUIDs, cred.UID) || containsID(r.AllowGIDs, cred.GID)
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PeerCredPlugin is a plugin that controls which users can connect by unix sockets and call methods,
+// by the credentials of the client processes read from SO_PEERCRED.
+type PeerCredPlugin struct {
+	// Rule is checked when a connection is accepted.
+	Rule PeerCredRule
+	// Methods are the rules checked before calling methods, keyed by "Service.Method" or "Service".
+	// The rule of a method takes precedence over the rule of its service.
+	// Functions registered by RegisterFunction are checked by their service and function names too.
+	// Handlers added by Server.AddHandler are not called through plugins, so only Rule applies to them.
+	Methods map[string]PeerCredRule
+	// AllowNoCred allows connections without peer credentials, such as TCP connections.
+	// They are denied by default.
+	AllowNoCred bool
+}
+
+// HandleConnAccept checks the credentials of the client.
+func (plugin *PeerCredPlugin) HandleConnAccept(conn net.Conn) (net.Conn, bool) {
+	cred, err := server.GetPeerCred(conn)
+	if err != nil {
+		return conn, plugin.AllowNoCred
+	}
+	return conn, plugin.Rule.Allow(cred)
+}
+
+// PreCall checks the credentials of the client by the rule of the method.
+func (plugin *PeerCredPlugin) PreCall(ctx context.Context, serviceName, methodName string, args interface{}) (interface{}, error) {
+	rule, ok := plugin.Methods[serviceName+"."+methodName]
+	if !ok {
+		if rule, ok = plugin.Methods[serviceName]; !ok {
+			return args, nil
+		}
+	}
+
+	cred, _ := ctx.Value(server.PeerCredContextKey).(*server.PeerCred)
+	if cred == nil {
+		if plugin.AllowNoCred {
+			return args, nil
+		}
+		return args, fmt.Errorf("permission denied: %s.%s requires peer credentials", serviceName, methodName)
+	}
+	if !rule.Allow(cred) {
+		return args, fmt.Errorf("permission denied: uid %d gid %d can't call %s.%s", cred.UID, cred.GID, serviceName, methodName)
+	}
+	return args, nil
+}
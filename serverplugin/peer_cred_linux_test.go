@@ -0,0 +1,87 @@
+//go:build linux
+// +build linux
+
+package serverplugin
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/derekAHua/irpc/client"
+	"github.com/derekAHua/irpc/server"
+	"github.com/stretchr/testify/assert"
+)
+
+type PeerCredArith struct{}
+
+func (PeerCredArith) Mul(_ context.Context, args *[2]int, reply *int) error {
+	*reply = args[0] * args[1]
+	return nil
+}
+
+func (PeerCredArith) Add(_ context.Context, args *[2]int, reply *int) error {
+	*reply = args[0] + args[1]
+	return nil
+}
+
+func peerCredSub(_ context.Context, args *[2]int, reply *int) error {
+	*reply = args[0] - args[1]
+	return nil
+}
+
+func TestPeerCredPlugin(t *testing.T) {
+	uid := uint32(os.Getuid())
+	ln, tcpLn := servePeerCredPlugin(t, &PeerCredPlugin{
+		Rule: CurrentUserRule(),
+		Methods: map[string]PeerCredRule{
+			"Arith.Add": {DenyUIDs: []uint32{uid}},
+			"Calc.Sub":  {DenyUIDs: []uint32{uid}},
+		},
+	})
+
+	cli := client.NewClient(client.DefaultOption)
+	assert.NoError(t, cli.Connect("unix", ln.Addr().String()))
+	defer func() { _ = cli.Close() }()
+	var reply int
+	assert.NoError(t, cli.Call(context.Background(), "Arith", "Mul", &[2]int{3, 4}, &reply))
+	assert.Equal(t, 12, reply)
+	assert.Error(t, cli.Call(context.Background(), "Arith", "Add", &[2]int{3, 4}, &reply))
+	// functions are checked as methods
+	assert.Error(t, cli.Call(context.Background(), "Calc", "Sub", &[2]int{3, 4}, &reply))
+
+	// TCP connections without peer credentials are closed
+	assertConnDenied(t, "tcp", tcpLn.Addr().String())
+
+	// connections of denied users are closed
+	ln, _ = servePeerCredPlugin(t, &PeerCredPlugin{Rule: PeerCredRule{DenyUIDs: []uint32{uid}}})
+	assertConnDenied(t, "unix", ln.Addr().String())
+}
+
+func servePeerCredPlugin(t *testing.T, plugin *PeerCredPlugin) (ln, tcpLn net.Listener) {
+	s := server.New()
+	s.Plugins.Add(plugin)
+	assert.NoError(t, s.RegisterName("Arith", new(PeerCredArith), ""))
+	assert.NoError(t, s.RegisterFunctionName("Calc", "Sub", peerCredSub, ""))
+
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "irpc.sock"))
+	assert.NoError(t, err)
+	tcpLn, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(ln) }()
+	go func() { _ = s.ServeListener(tcpLn) }()
+	t.Cleanup(func() { _ = s.Close() })
+	return ln, tcpLn
+}
+
+func assertConnDenied(t *testing.T, network, address string) {
+	cli := client.NewClient(client.DefaultOption)
+	if err := cli.Connect(network, address); err != nil {
+		return
+	}
+	defer func() { _ = cli.Close() }()
+	var reply int
+	assert.Error(t, cli.Call(context.Background(), "Arith", "Mul", &[2]int{3, 4}, &reply))
+}
@@ -0,0 +1,46 @@
+package serverplugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/derekAHua/irpc/server"
+	"github.com/derekAHua/irpc/share"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPeerCredRule(t *testing.T) {
+	alice := &server.PeerCred{UID: 1000, GID: 100}
+	bob := &server.PeerCred{UID: 1001, GID: 100}
+
+	assert.True(t, (&PeerCredRule{}).Allow(alice))
+	assert.True(t, (&PeerCredRule{AllowUIDs: []uint32{1000}}).Allow(alice))
+	assert.False(t, (&PeerCredRule{AllowUIDs: []uint32{1000}}).Allow(bob))
+	assert.True(t, (&PeerCredRule{AllowGIDs: []uint32{100}}).Allow(bob))
+	assert.False(t, (&PeerCredRule{AllowGIDs: []uint32{100}, DenyUIDs: []uint32{1001}}).Allow(bob))
+	assert.False(t, (&PeerCredRule{DenyGIDs: []uint32{100}}).Allow(alice))
+}
+
+func TestPeerCredPluginPreCall(t *testing.T) {
+	plugin := &PeerCredPlugin{
+		Methods: map[string]PeerCredRule{
+			"Arith":     {AllowUIDs: []uint32{1000}},
+			"Arith.Add": {},
+		},
+	}
+	ctx := share.WithValue(context.Background(), server.PeerCredContextKey, &server.PeerCred{UID: 1001})
+
+	_, err := plugin.PreCall(ctx, "Arith", "Mul", nil)
+	assert.Error(t, err)
+	_, err = plugin.PreCall(ctx, "Arith", "Add", nil)
+	assert.NoError(t, err)
+	_, err = plugin.PreCall(ctx, "Echo", "Echo", nil)
+	assert.NoError(t, err)
+
+	// clients without credentials are denied by the rules of methods
+	_, err = plugin.PreCall(context.Background(), "Arith", "Add", nil)
+	assert.Error(t, err)
+	plugin.AllowNoCred = true
+	_, err = plugin.PreCall(context.Background(), "Arith", "Add", nil)
+	assert.NoError(t, err)
+}
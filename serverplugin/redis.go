@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/derekAHua/irpc/log"
+	"github.com/derekAHua/irpc/server"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/rpcxio/libkv"
 	"github.com/rpcxio/libkv/store"
@@ -25,6 +26,9 @@ func init() {
 type RedisRegisterPlugin struct {
 	// service address, for example, tcp@127.0.0.1:8972, quic@127.0.0.1:1234
 	ServiceAddress string
+	// Server is the server whose listeners are all written to redis besides ServiceAddress, if it is set.
+	// Listeners served after a service is registered are written every UpdateInterval.
+	Server *server.Server
 	// redis addresses
 	RedisServers []string
 	// base path for irpc server, for example com/example/irpc
@@ -89,14 +93,14 @@ func (p *RedisRegisterPlugin) Start() error {
 						extra["connections"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("connections", p.Metrics).RateMean())
 					}
 					//set this same metrics for all services at this server
-					for _, name := range p.Services {
-						nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+					for _, node := range registryNodes(p.BasePath, p.Services, serviceAddresses(p.ServiceAddress, p.Server)) {
+						nodePath := node.path
 						kvPair, err := p.kv.Get(nodePath)
 						if err != nil {
 							log.Infof("can't get data of node: %s, because of %v", nodePath, err.Error())
 
 							p.metasLock.RLock()
-							meta := p.metas[name]
+							meta := p.metas[node.service]
 							p.metasLock.RUnlock()
 
 							err = p.kv.Put(nodePath, []byte(meta), &store.WriteOptions{TTL: p.UpdateInterval * 2})
@@ -131,8 +135,8 @@ func (p *RedisRegisterPlugin) Stop() error {
 		p.kv = kv
 	}
 
-	for _, name := range p.Services {
-		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	for _, node := range registryNodes(p.BasePath, p.Services, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath := node.path
 		exist, err := p.kv.Exists(nodePath)
 		if err != nil {
 			log.Errorf("cannot delete path %s: %v", nodePath, err)
@@ -197,11 +201,13 @@ func (p *RedisRegisterPlugin) Register(name string, _ interface{}, metadata stri
 		return err
 	}
 
-	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
-	err = p.kv.Put(nodePath, []byte(metadata), &store.WriteOptions{TTL: p.UpdateInterval * 2})
-	if err != nil {
-		log.Errorf("cannot create redis path %s: %v", nodePath, err)
-		return err
+	for _, node := range registryNodes(p.BasePath, []string{name}, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath = node.path
+		err = p.kv.Put(nodePath, []byte(metadata), &store.WriteOptions{TTL: p.UpdateInterval * 2})
+		if err != nil {
+			log.Errorf("cannot create redis path %s: %v", nodePath, err)
+			return err
+		}
 	}
 
 	p.Services = append(p.Services, name)
@@ -248,12 +254,14 @@ func (p *RedisRegisterPlugin) Unregister(name string) (err error) {
 		return err
 	}
 
-	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	for _, node := range registryNodes(p.BasePath, []string{name}, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath = node.path
 
-	err = p.kv.Delete(nodePath)
-	if err != nil {
-		log.Errorf("cannot remove redis path %s: %v", nodePath, err)
-		return err
+		err = p.kv.Delete(nodePath)
+		if err != nil {
+			log.Errorf("cannot remove redis path %s: %v", nodePath, err)
+			return err
+		}
 	}
 
 	var services = make([]string, 0, len(p.Services)-1)
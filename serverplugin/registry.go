@@ -0,0 +1,66 @@
+package serverplugin
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/derekAHua/irpc/server"
+)
+
+// serviceAddresses returns the addresses advertised by a registry plugin, which are address and,
+// if s is not nil, the addresses of the listeners of s in the form of network@address, without duplicates.
+// Listeners on an unspecified IP, such as :8972, are advertised with the host of address, and listeners
+// on the port of address are advertised by address only, since it names their network, such as quic.
+func serviceAddresses(address string, s *server.Server) []string {
+	var result []string
+	if address != "" {
+		result = append(result, address)
+	}
+	if s == nil {
+		return result
+	}
+
+	hostPort := address
+	if i := strings.Index(address, "@"); i >= 0 {
+		hostPort = address[i+1:]
+	}
+	host, port, _ := net.SplitHostPort(hostPort)
+
+	seen := map[string]bool{hostPort: true}
+	for _, addr := range s.Addresses() {
+		a := addr.String()
+		if h, p, err := net.SplitHostPort(a); err == nil {
+			if p == port {
+				continue
+			}
+			if ip := net.ParseIP(h); h == "" || ip != nil && ip.IsUnspecified() {
+				h = host
+			}
+			a = net.JoinHostPort(h, p)
+		}
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		result = append(result, addr.Network()+"@"+a)
+	}
+	return result
+}
+
+// registryNode is the node of a service at one of its addresses in a registry.
+type registryNode struct {
+	service string
+	path    string
+}
+
+// registryNodes returns the nodes of services at addresses under basePath.
+func registryNodes(basePath string, services, addresses []string) []registryNode {
+	nodes := make([]registryNode, 0, len(services)*len(addresses))
+	for _, name := range services {
+		for _, address := range addresses {
+			nodes = append(nodes, registryNode{service: name, path: fmt.Sprintf("%s/%s/%s", basePath, name, address)})
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,47 @@
+package serverplugin
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/derekAHua/irpc/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceAddresses(t *testing.T) {
+	assert.Equal(t, []string{"tcp@127.0.0.1:8972"}, serviceAddresses("tcp@127.0.0.1:8972", nil))
+
+	s := server.New()
+	defer func() { _ = s.Close() }()
+	assert.Equal(t, []string{"tcp@127.0.0.1:8972"}, serviceAddresses("tcp@127.0.0.1:8972", s))
+
+	tcp, err := net.Listen("tcp", "0.0.0.0:0")
+	assert.NoError(t, err)
+	sock := filepath.Join(t.TempDir(), "irpc.sock")
+	unix, err := net.Listen("unix", sock)
+	assert.NoError(t, err)
+	go func() { _ = s.ServeListener(tcp) }()
+	go func() { _ = s.ServeListener(unix) }()
+	assert.Eventually(t, func() bool { return len(s.Addresses()) == 2 }, time.Second, 10*time.Millisecond)
+
+	// the listener on an unspecified IP is advertised with the host of the service address
+	_, port, _ := net.SplitHostPort(tcp.Addr().String())
+	assert.ElementsMatch(t, []string{"tcp@127.0.0.1:8972", "tcp@127.0.0.1:" + port, "unix@" + sock},
+		serviceAddresses("tcp@127.0.0.1:8972", s))
+
+	// the listener of the service address is not advertised twice
+	assert.ElementsMatch(t, []string{"quic@10.0.0.1:" + port, "unix@" + sock},
+		serviceAddresses("quic@10.0.0.1:"+port, s))
+}
+
+func TestRegistryNodes(t *testing.T) {
+	nodes := registryNodes("irpc", []string{"Arith", "Echo"}, []string{"tcp@127.0.0.1:8972", "unix@/tmp/irpc.sock"})
+	assert.Equal(t, []registryNode{
+		{service: "Arith", path: "irpc/Arith/tcp@127.0.0.1:8972"},
+		{service: "Arith", path: "irpc/Arith/unix@/tmp/irpc.sock"},
+		{service: "Echo", path: "irpc/Echo/tcp@127.0.0.1:8972"},
+		{service: "Echo", path: "irpc/Echo/unix@/tmp/irpc.sock"},
+	}, nodes)
+}
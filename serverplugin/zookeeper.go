@@ -14,6 +14,7 @@ import (
 	"github.com/rpcxio/libkv/store/zookeeper"
 
 	"github.com/derekAHua/irpc/log"
+	"github.com/derekAHua/irpc/server"
 	metrics "github.com/rcrowley/go-metrics"
 	"github.com/rpcxio/libkv/store"
 )
@@ -26,6 +27,9 @@ func init() {
 type ZooKeeperRegisterPlugin struct {
 	// service address, for example, tcp@127.0.0.1:8972, quic@127.0.0.1:1234
 	ServiceAddress string
+	// Server is the server whose listeners get zookeeper nodes too, if it is set.
+	// Its addresses are read when a service is registered and refreshed every UpdateInterval.
+	Server *server.Server
 	// zookeeper addresses
 	ZooKeeperServers []string
 	// base path for irpc server, for example com/example/irpc
@@ -94,14 +98,14 @@ func (p *ZooKeeperRegisterPlugin) Start() error {
 						extra["connections"] = fmt.Sprintf("%.2f", metrics.GetOrRegisterMeter("connections", p.Metrics).RateMean())
 					}
 					//set this same metrics for all services at this server
-					for _, name := range p.Services {
-						nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+					for _, node := range registryNodes(p.BasePath, p.Services, serviceAddresses(p.ServiceAddress, p.Server)) {
+						nodePath := node.path
 						kvPaire, err := p.kv.Get(nodePath)
 						if err != nil {
 							log.Infof("can't get data of node: %s, because of %v", nodePath, err.Error())
 
 							p.metasLock.RLock()
-							meta := p.metas[name]
+							meta := p.metas[node.service]
 							p.metasLock.RUnlock()
 
 							err = p.kv.Put(nodePath, []byte(meta), &store.WriteOptions{TTL: p.UpdateInterval * 2})
@@ -139,8 +143,8 @@ func (p *ZooKeeperRegisterPlugin) Stop() error {
 		p.BasePath = p.BasePath[1:]
 	}
 
-	for _, name := range p.Services {
-		nodePath := fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	for _, node := range registryNodes(p.BasePath, p.Services, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath := node.path
 		exist, err := p.kv.Exists(nodePath)
 		if err != nil {
 			log.Errorf("cannot delete zk path %s: %v", nodePath, err)
@@ -208,13 +212,15 @@ func (p *ZooKeeperRegisterPlugin) Register(name string, _ interface{}, metadata
 		return err
 	}
 
-	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
-	// call delete first when previous is nil, if key exists already, create new key will fail.
-	_ = p.kv.Delete(nodePath)
-	_, _, err = p.kv.AtomicPut(nodePath, []byte(metadata), nil, &store.WriteOptions{TTL: p.UpdateInterval * 2})
-	if err != nil {
-		log.Errorf("cannot create zk path %s: %v", nodePath, err)
-		return err
+	for _, node := range registryNodes(p.BasePath, []string{name}, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath = node.path
+		// call delete first when previous is nil, if key exists already, create new key will fail.
+		_ = p.kv.Delete(nodePath)
+		_, _, err = p.kv.AtomicPut(nodePath, []byte(metadata), nil, &store.WriteOptions{TTL: p.UpdateInterval * 2})
+		if err != nil {
+			log.Errorf("cannot create zk path %s: %v", nodePath, err)
+			return err
+		}
 	}
 
 	p.Services = append(p.Services, name)
@@ -267,12 +273,14 @@ func (p *ZooKeeperRegisterPlugin) Unregister(name string) (err error) {
 		return err
 	}
 
-	nodePath = fmt.Sprintf("%s/%s/%s", p.BasePath, name, p.ServiceAddress)
+	for _, node := range registryNodes(p.BasePath, []string{name}, serviceAddresses(p.ServiceAddress, p.Server)) {
+		nodePath = node.path
 
-	err = p.kv.Delete(nodePath)
-	if err != nil {
-		log.Errorf("cannot remove zk path %s: %v", nodePath, err)
-		return err
+		err = p.kv.Delete(nodePath)
+		if err != nil {
+			log.Errorf("cannot remove zk path %s: %v", nodePath, err)
+			return err
+		}
 	}
 
 	var services = make([]string, 0, len(p.Services)-1)
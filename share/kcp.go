@@ -0,0 +1,26 @@
+package share
+
+// KCPConfig tunes KCP sessions of clients and servers.
+// FEC shards must be the same on both sides.
+type KCPConfig struct {
+	// NoDelay, Interval(ms), Resend and NoCongestion are passed to SetNoDelay of sessions if any of them is set.
+	// For example, NoDelay, Interval 10, Resend 2 and NoCongestion is the fast mode.
+	NoDelay      bool
+	Interval     int
+	Resend       int
+	NoCongestion bool
+
+	// SndWnd and RcvWnd are window sizes in packets. Defaults of kcp-go are used if they are zero.
+	SndWnd int
+	RcvWnd int
+
+	// DataShards and ParityShards configure forward error correction. FEC is disabled if both are zero.
+	DataShards   int
+	ParityShards int
+}
+
+// DefaultKCPConfig is used if KCPConfig is not set, which keeps the FEC shards servers have used.
+var DefaultKCPConfig = KCPConfig{
+	DataShards:   10,
+	ParityShards: 3,
+}
@@ -0,0 +1,23 @@
+//go:build kcp
+// +build kcp
+
+package share
+
+import kcp "github.com/xtaci/kcp-go"
+
+// Apply applies the tuning to the KCP session sess.
+func (c *KCPConfig) Apply(sess *kcp.UDPSession) {
+	if c.NoDelay || c.Interval > 0 || c.Resend > 0 || c.NoCongestion {
+		sess.SetNoDelay(boolToInt(c.NoDelay), c.Interval, c.Resend, boolToInt(c.NoCongestion))
+	}
+	if c.SndWnd > 0 || c.RcvWnd > 0 {
+		sess.SetWindowSize(c.SndWnd, c.RcvWnd)
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+//go:build quic
+// +build quic
+
+package share
+
+import (
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICNextProto is the ALPN protocol of irpc over QUIC.
+const QUICNextProto = "irpc"
+
+// quicStreamConn is an irpc connection over a stream of a QUIC connection.
+type quicStreamConn struct {
+	quic.Stream
+	conn quic.Connection
+
+	closeOnce sync.Once
+	onClose   func()
+}
+
+// NewQUICStreamConn returns a net.Conn over stream of conn.
+// onClose is called once after the stream is closed if it is not nil.
+func NewQUICStreamConn(conn quic.Connection, stream quic.Stream, onClose func()) net.Conn {
+	return &quicStreamConn{Stream: stream, conn: conn, onClose: onClose}
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes both directions of the stream, and the QUIC connection is kept for other streams.
+func (c *quicStreamConn) Close() (err error) {
+	c.closeOnce.Do(func() {
+		c.Stream.CancelRead(0)
+		err = c.Stream.Close()
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
@@ -1,6 +1,8 @@
 package share
 
 import (
+	"sort"
+
 	"github.com/derekAHua/irpc/codec"
 	"github.com/derekAHua/irpc/protocol"
 )
@@ -15,9 +17,15 @@ const (
 	// ServerAddress is used to get address of the server by client
 	ServerAddress = "__ServerAddress"
 
-	// ServerTimeout timeout value passed from client to control timeout of server
+	// ServerTimeout timeout value passed from v1 clients to control timeout of server.
+	// v2 clients send it in the protocol.ExtDeadline extension instead.
 	ServerTimeout = "__ServerTimeout"
 
+	// Priority is the priority of a request passed from v1 clients, an integer from MinPriority to MaxPriority
+	// which is 0 by default. v2 clients send it in the protocol.ExtPriority extension instead. Servers with a handler pool handle queued requests of higher priorities first,
+	// and reject requests of lower priorities first when they are overloaded.
+	Priority = "__Priority"
+
 	// SendFileServiceName is name of the file transfer service.
 	SendFileServiceName = "_FileTransfer"
 
@@ -25,6 +33,12 @@ const (
 	StreamServiceName = "_StreamService"
 )
 
+// MinPriority and MaxPriority bound the priorities of requests. Servers clamp priorities out of the range.
+const (
+	MinPriority = -3
+	MaxPriority = 3
+)
+
 // Trace is a flag to write a trace log or not.
 // You should not enable this flag for product environment and enable it only for test.
 // It writes trace log with logger Debug level.
@@ -44,6 +58,16 @@ func RegisterCodec(t protocol.SerializeType, c codec.Codec) {
 	Codecs[t] = c
 }
 
+// SerializeTypes returns the serialize types of Codecs in order.
+func SerializeTypes() []protocol.SerializeType {
+	types := make([]protocol.SerializeType, 0, len(Codecs))
+	for t := range Codecs {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
 // ContextKey defines key type in context.
 type ContextKey string
 
@@ -53,6 +77,16 @@ var ReqMetaDataKey = ContextKey("__req_metadata")
 // ResMetaDataKey is used to set metadata in context of responses.
 var ResMetaDataKey = ContextKey("__res_metadata")
 
+// ReqPriorityKey is used to set the priority of requests in context. Its value is an int.
+var ReqPriorityKey = ContextKey("__req_priority")
+
+// ReqExtensionsKey is used to set extensions of v2 requests in context. Its value is []protocol.Extension.
+var ReqExtensionsKey = ContextKey("__req_extensions")
+
+// ResPayloadWriterKey is used to set an io.Writer in context of requests.
+// The payload of the response is written to it as it arrives instead of being decoded into the reply.
+var ResPayloadWriterKey = ContextKey("__res_payload_writer")
+
 // FileTransferArgs args from clients.
 type FileTransferArgs struct {
 	FileName string            `json:"file_name,omitempty"`
@@ -0,0 +1,569 @@
+//go:build linux
+// +build linux
+
+package share
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/derekAHua/irpc/log"
+	"golang.org/x/sys/unix"
+)
+
+// ShmRingSize is the size of each direction of shared-memory connections dialed by this process.
+// It must be a power of two.
+var ShmRingSize = 1 << 20
+
+// ShmMaxRingSize is the max ring size of shared-memory connections, which limits the memory
+// a client can make listeners of this process map.
+var ShmMaxRingSize = 16 << 20
+
+const (
+	// shmRingHeaderSize keeps the positions of a ring in different cache lines from each other and from the data.
+	shmRingHeaderSize = 256
+	// the tail and writerWaiting are written by the writer of a ring, and the head and readerWaiting by its reader.
+	shmTailOffset          = 0
+	shmWriterWaitingOffset = 8
+	shmHeadOffset          = 64
+	shmReaderWaitingOffset = 72
+
+	shmHandshakeTimeout = 5 * time.Second
+	shmHandshakeAck     = 'k'
+
+	// shmSeals keep the size of the shared memory fixed, so that a peer can't shrink it under the mappings of the other.
+	shmSeals = unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_SEAL
+)
+
+// doorbells sent over the unix socket of a connection to wake up the peer.
+var (
+	shmDataReady  = []byte{'d'}
+	shmSpaceReady = []byte{'s'}
+)
+
+// shmAddr is the address of shared-memory connections.
+type shmAddr string
+
+func (a shmAddr) Network() string { return "shm" }
+func (a shmAddr) String() string  { return string(a) }
+
+// shmSocketAddress returns the unix socket which sets up connections to the shared-memory listener name.
+// A name with a slash is a path, and others are in the abstract namespace.
+func shmSocketAddress(name string) string {
+	if strings.Contains(name, "/") {
+		return name
+	}
+	return "@irpc-shm-" + name
+}
+
+// shmRing is a single-producer single-consumer ring in shared memory.
+// Its positions only increase, and the offset of a position is it modulo the size.
+type shmRing struct {
+	tail, head                   *uint64
+	writerWaiting, readerWaiting *uint32
+	data                         []byte
+	size                         uint64
+}
+
+func newShmRing(mem []byte) *shmRing {
+	return &shmRing{
+		tail:          (*uint64)(unsafe.Pointer(&mem[shmTailOffset])),
+		head:          (*uint64)(unsafe.Pointer(&mem[shmHeadOffset])),
+		writerWaiting: (*uint32)(unsafe.Pointer(&mem[shmWriterWaitingOffset])),
+		readerWaiting: (*uint32)(unsafe.Pointer(&mem[shmReaderWaitingOffset])),
+		data:          mem[shmRingHeaderSize:],
+		size:          uint64(len(mem) - shmRingHeaderSize),
+	}
+}
+
+func (r *shmRing) readable() bool {
+	return atomic.LoadUint64(r.tail) != atomic.LoadUint64(r.head)
+}
+
+func (r *shmRing) writable() bool {
+	return atomic.LoadUint64(r.tail)-atomic.LoadUint64(r.head) < r.size
+}
+
+func (r *shmRing) read(b []byte) int {
+	head := atomic.LoadUint64(r.head)
+	n := atomic.LoadUint64(r.tail) - head
+	if n > uint64(len(b)) {
+		n = uint64(len(b))
+	}
+	if n == 0 {
+		return 0
+	}
+	off := head & (r.size - 1)
+	if m := uint64(copy(b[:n], r.data[off:])); m < n {
+		copy(b[m:n], r.data)
+	}
+	atomic.StoreUint64(r.head, head+n)
+	return int(n)
+}
+
+func (r *shmRing) write(b []byte) int {
+	tail := atomic.LoadUint64(r.tail)
+	n := r.size - (tail - atomic.LoadUint64(r.head))
+	if n > uint64(len(b)) {
+		n = uint64(len(b))
+	}
+	if n == 0 {
+		return 0
+	}
+	off := tail & (r.size - 1)
+	if m := uint64(copy(r.data[off:], b[:n])); m < n {
+		copy(r.data, b[m:n])
+	}
+	atomic.StoreUint64(r.tail, tail+n)
+	return int(n)
+}
+
+// shmConn is a net.Conn over two rings in memory shared by the client and the server.
+// Its unix socket passes the memory when the connection is set up, and then it carries doorbells,
+// which wake up the peer waiting for data or space, so that waiting sides don't spin.
+type shmConn struct {
+	sock *net.UnixConn
+	mem  []byte
+	rx   *shmRing
+	tx   *shmRing
+	addr shmAddr
+
+	dataReady  chan struct{}
+	spaceReady chan struct{}
+	// done is closed after the unix socket is closed by either side.
+	done chan struct{}
+
+	rmu, wmu      sync.Mutex
+	readDeadline  shmDeadline
+	writeDeadline shmDeadline
+
+	closed    int32
+	closeOnce sync.Once
+}
+
+// newShmConn maps the memory of fd, where the client writes to the first ring and the server to the second.
+func newShmConn(sock *net.UnixConn, fd int, ringSize int, isClient bool, name string) (*shmConn, error) {
+	if ringSize <= 0 || ringSize > ShmMaxRingSize || ringSize&(ringSize-1) != 0 {
+		return nil, fmt.Errorf("invalid shared-memory ring size %d", ringSize)
+	}
+	size := 2 * (shmRingHeaderSize + ringSize)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return nil, err
+	}
+	if st.Size != int64(size) {
+		return nil, fmt.Errorf("shared memory of %d bytes, expect %d", st.Size, size)
+	}
+	mem, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &shmConn{
+		sock:          sock,
+		mem:           mem,
+		addr:          shmAddr(name),
+		dataReady:     make(chan struct{}, 1),
+		spaceReady:    make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		readDeadline:  makeShmDeadline(),
+		writeDeadline: makeShmDeadline(),
+	}
+	c2s, s2c := newShmRing(mem[:size/2]), newShmRing(mem[size/2:])
+	if isClient {
+		c.tx, c.rx = c2s, s2c
+	} else {
+		c.tx, c.rx = s2c, c2s
+	}
+	return c, nil
+}
+
+// serveDoorbells wakes up Read and Write by the doorbells of the peer until the socket is closed.
+func (c *shmConn) serveDoorbells() {
+	defer close(c.done)
+
+	buf := make([]byte, 16)
+	for {
+		n, err := c.sock.Read(buf)
+		for _, b := range buf[:n] {
+			switch b {
+			case shmDataReady[0]:
+				notify(c.dataReady)
+			case shmSpaceReady[0]:
+				notify(c.spaceReady)
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *shmConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	for {
+		if n := c.rx.read(b); n > 0 {
+			if atomic.CompareAndSwapUint32(c.rx.writerWaiting, 1, 0) {
+				_, _ = c.sock.Write(shmSpaceReady)
+			}
+			return n, nil
+		}
+
+		// the writer rings the doorbell if it writes after this, or the ring is readable below.
+		atomic.StoreUint32(c.rx.readerWaiting, 1)
+		if c.rx.readable() {
+			continue
+		}
+		select {
+		case <-c.dataReady:
+		case <-c.done:
+			// data written before the peer closed the connection is read first
+			if c.rx.readable() {
+				continue
+			}
+			if atomic.LoadInt32(&c.closed) == 1 {
+				return 0, net.ErrClosed
+			}
+			return 0, io.EOF
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *shmConn) Write(b []byte) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return 0, net.ErrClosed
+	}
+
+	for len(b) > 0 {
+		select {
+		case <-c.done:
+			if atomic.LoadInt32(&c.closed) == 1 {
+				return n, net.ErrClosed
+			}
+			return n, io.ErrClosedPipe
+		default:
+		}
+
+		if m := c.tx.write(b); m > 0 {
+			n += m
+			b = b[m:]
+			if atomic.CompareAndSwapUint32(c.tx.readerWaiting, 1, 0) {
+				_, _ = c.sock.Write(shmDataReady)
+			}
+			continue
+		}
+
+		// the reader rings the doorbell if it reads after this, or the ring is writable below.
+		atomic.StoreUint32(c.tx.writerWaiting, 1)
+		if c.tx.writable() {
+			continue
+		}
+		select {
+		case <-c.spaceReady:
+		case <-c.done:
+		case <-c.writeDeadline.wait():
+			return n, os.ErrDeadlineExceeded
+		}
+	}
+	return n, nil
+}
+
+// Close closes the socket, which wakes up Read and Write of both sides, and unmaps the memory after they return.
+func (c *shmConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closed, 1)
+		err = c.sock.Close()
+		<-c.done
+
+		c.rmu.Lock()
+		c.wmu.Lock()
+		_ = unix.Munmap(c.mem)
+		c.wmu.Unlock()
+		c.rmu.Unlock()
+	})
+	return err
+}
+
+func (c *shmConn) LocalAddr() net.Addr  { return c.addr }
+func (c *shmConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *shmConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *shmConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *shmConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// shmDeadline is a deadline of Read or Write, whose channel is closed when the deadline passes.
+type shmDeadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func makeShmDeadline() shmDeadline {
+	return shmDeadline{cancel: make(chan struct{})}
+}
+
+func (d *shmDeadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer has fired, wait for it to close cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+func (d *shmDeadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// DialShm connects to the shared-memory listener name on the same host.
+// It creates the shared memory of the connection and passes it to the server.
+func DialShm(ctx context.Context, name string) (net.Conn, error) {
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "unix", shmSocketAddress(name))
+	if err != nil {
+		return nil, err
+	}
+	sock := c.(*net.UnixConn)
+
+	conn, err := dialShm(ctx, sock, name)
+	if err != nil {
+		_ = sock.Close()
+		return nil, err
+	}
+	go conn.serveDoorbells()
+	return conn, nil
+}
+
+func dialShm(ctx context.Context, sock *net.UnixConn, name string) (*shmConn, error) {
+	ringSize := ShmRingSize
+	fd, err := unix.MemfdCreate("irpc-shm", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, err
+	}
+	// the memory is kept by the mappings after fd is closed
+	defer unix.Close(fd)
+	if err = unix.Ftruncate(fd, int64(2*(shmRingHeaderSize+ringSize))); err != nil {
+		return nil, err
+	}
+	if _, err = unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, shmSeals); err != nil {
+		return nil, err
+	}
+	conn, err := newShmConn(sock, fd, ringSize, true, name)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(shmHandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = sock.SetDeadline(deadline)
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(ringSize))
+	if _, _, err = sock.WriteMsgUnix(size[:], unix.UnixRights(fd), nil); err == nil {
+		var ack [1]byte
+		if _, err = io.ReadFull(sock, ack[:]); err == nil && ack[0] != shmHandshakeAck {
+			err = errors.New("invalid shared-memory handshake")
+		}
+	}
+	if err != nil {
+		_ = unix.Munmap(conn.mem)
+		return nil, err
+	}
+	_ = sock.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// shmListener accepts shared-memory connections set up over its unix socket.
+type shmListener struct {
+	ln    *net.UnixListener
+	name  string
+	conns chan net.Conn
+
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// ListenShm listens shared-memory connections of the name on the same host.
+func ListenShm(name string) (net.Listener, error) {
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: shmSocketAddress(name), Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+
+	l := &shmListener{ln: ln, name: name, conns: make(chan net.Conn), done: make(chan struct{})}
+	go l.accept()
+	return l, nil
+}
+
+func (l *shmListener) accept() {
+	for {
+		sock, err := l.ln.AcceptUnix()
+		if err != nil {
+			l.close(err)
+			return
+		}
+
+		// a slow client doesn't block accepting others
+		go func() {
+			conn, err := acceptShm(sock, l.name)
+			if err != nil {
+				log.Warnf("irpc: failed to set up shared-memory connection: %v", err)
+				_ = sock.Close()
+				return
+			}
+			go conn.serveDoorbells()
+
+			select {
+			case l.conns <- conn:
+			case <-l.done:
+				_ = conn.Close()
+			}
+		}()
+	}
+}
+
+func acceptShm(sock *net.UnixConn, name string) (*shmConn, error) {
+	_ = sock.SetDeadline(time.Now().Add(shmHandshakeTimeout))
+
+	var size [8]byte
+	oob := make([]byte, unix.CmsgSpace(4))
+	n, oobn, _, _, err := sock.ReadMsgUnix(size[:], oob)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	for _, fd := range fds {
+		defer unix.Close(fd)
+	}
+	if n != len(size) || len(fds) != 1 {
+		return nil, errors.New("invalid shared-memory handshake")
+	}
+	// the memory of a client is only mapped if the client can't resize it anymore,
+	// since accessing the mappings beyond a shrunk size crashes the server.
+	seals, err := unix.FcntlInt(uintptr(fds[0]), unix.F_GET_SEALS, 0)
+	if err != nil || seals&shmSeals != shmSeals {
+		return nil, errors.New("shared memory is not sealed")
+	}
+
+	conn, err := newShmConn(sock, fds[0], int(binary.BigEndian.Uint64(size[:])), false, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = sock.Write([]byte{shmHandshakeAck}); err != nil {
+		_ = unix.Munmap(conn.mem)
+		return nil, err
+	}
+	_ = sock.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (l *shmListener) close(err error) {
+	l.closeOnce.Do(func() {
+		l.err = err
+		close(l.done)
+		_ = l.ln.Close()
+	})
+}
+
+func (l *shmListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+func (l *shmListener) Close() error {
+	l.close(net.ErrClosed)
+	return nil
+}
+
+func (l *shmListener) Addr() net.Addr {
+	return shmAddr(l.name)
+}
@@ -0,0 +1,131 @@
+//go:build linux
+// +build linux
+
+package share
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestShmConn(t *testing.T) {
+	old := ShmRingSize
+	ShmRingSize = 4096
+	defer func() { ShmRingSize = old }()
+
+	for _, name := range []string{"test-" + t.Name(), filepath.Join(t.TempDir(), "irpc.shm")} {
+		ln, err := ListenShm(name)
+		assert.NoError(t, err)
+
+		cli, err := DialShm(context.Background(), name)
+		assert.NoError(t, err)
+		srv, err := ln.Accept()
+		assert.NoError(t, err)
+		assert.Equal(t, "shm", srv.LocalAddr().Network())
+
+		// the data is larger than the ring, so that both sides wait for space
+		data := bytes.Repeat([]byte("irpc shared memory "), 10000)
+		go func() {
+			_, _ = io.Copy(srv, srv)
+			_ = srv.Close()
+		}()
+		go func() {
+			_, err := cli.Write(data)
+			assert.NoError(t, err)
+		}()
+		got := make([]byte, len(data))
+		_, err = io.ReadFull(cli, got)
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+
+		_ = cli.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, err = cli.Read(got)
+		assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+		_ = cli.SetReadDeadline(time.Time{})
+
+		// a closed connection can't be read
+		assert.NoError(t, cli.Close())
+		_, err = cli.Read(got)
+		assert.Error(t, err)
+
+		assert.NoError(t, ln.Close())
+		_, err = ln.Accept()
+		assert.Error(t, err)
+	}
+}
+
+func TestShmConnEOF(t *testing.T) {
+	name := "test-" + t.Name()
+	ln, err := ListenShm(name)
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	cli, err := DialShm(context.Background(), name)
+	assert.NoError(t, err)
+	srv, err := ln.Accept()
+	assert.NoError(t, err)
+
+	// data written before closing is read before io.EOF
+	_, err = srv.Write([]byte("bye"))
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Close())
+
+	got, err := io.ReadAll(cli)
+	assert.NoError(t, err)
+	assert.Equal(t, "bye", string(got))
+	_, err = cli.Write([]byte("x"))
+	assert.Error(t, err)
+	assert.NoError(t, cli.Close())
+}
+
+func TestShmHandshakeRejected(t *testing.T) {
+	name := "test-" + t.Name()
+	ln, err := ListenShm(name)
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	// handshake passes the memory of ringSize sealed by seals, and returns the error of reading the ack
+	handshake := func(ringSize, seals int) error {
+		fd, err := unix.MemfdCreate("irpc-shm-test", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+		assert.NoError(t, err)
+		defer unix.Close(fd)
+		assert.NoError(t, unix.Ftruncate(fd, int64(2*(shmRingHeaderSize+ringSize))))
+		if seals != 0 {
+			_, err = unix.FcntlInt(uintptr(fd), unix.F_ADD_SEALS, seals)
+			assert.NoError(t, err)
+		}
+
+		c, err := net.Dial("unix", shmSocketAddress(name))
+		assert.NoError(t, err)
+		sock := c.(*net.UnixConn)
+		defer sock.Close()
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(ringSize))
+		_, _, err = sock.WriteMsgUnix(size[:], unix.UnixRights(fd), nil)
+		assert.NoError(t, err)
+		_ = sock.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = io.ReadFull(sock, size[:1])
+		return err
+	}
+
+	assert.NoError(t, handshake(4096, shmSeals))
+	conn, err := ln.Accept()
+	assert.NoError(t, err)
+	_ = conn.Close()
+
+	// memory the client can still shrink
+	assert.Equal(t, io.EOF, handshake(4096, 0))
+	assert.Equal(t, io.EOF, handshake(4096, unix.F_SEAL_GROW|unix.F_SEAL_SEAL))
+	// rings larger than ShmMaxRingSize
+	assert.Equal(t, io.EOF, handshake(2*ShmMaxRingSize, shmSeals))
+}
@@ -69,6 +69,8 @@ func Zip(data []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	dec := buf.Bytes()
+	// buf is put back into the pool when returning.
+	dec := make([]byte, buf.Len())
+	copy(dec, buf.Bytes())
 	return dec, nil
 }